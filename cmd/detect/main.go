@@ -47,6 +47,21 @@ func runDetect(context detect.Detect) (int, error) {
 		return context.Fail(), err
 	}
 
+	placeholders, err := compat.NewVersionPlaceholders(context.Buildpack.Metadata)
+	if err != nil {
+		return context.Fail(), err
+	}
+
+	err = compat.ResolveVersionPlaceholders(&options, placeholders)
+	if err != nil {
+		return context.Fail(), err
+	}
+
+	webServer, err := compat.CanonicalWebServer(options.PHP.WebServer)
+	if err != nil {
+		return context.Fail(), err
+	}
+
 	plan := buildplan.Plan{
 		Provides: []buildplan.Provided{{Name: compat.Layer}},
 		Requires: []buildplan.Required{{Name: compat.Layer}},
@@ -66,19 +81,16 @@ func runDetect(context detect.Detect) (int, error) {
 	}
 
 	if webDirExists {
-		webServer := "httpd"
-		if options.PHP.WebServer != "" {
-			webServer = options.PHP.WebServer
-		}
-
-		webServerVersion := "*"
-		if webServer == "httpd" {
+		// PHP's built in web server comes with PHP, and script applications do not need one
+		var webServerVersion string
+		switch webServer {
+		case compat.WebServerHTTPD:
 			webServerVersion = options.HTTPD.Version
-		} else if webServer == "nginx" {
+		case compat.WebServerNginx:
 			webServerVersion = options.Nginx.Version
 		}
 
-		if webServer != "php-server" {
+		if webServer == compat.WebServerHTTPD || webServer == compat.WebServerNginx {
 			plan.Requires = append(plan.Requires, buildplan.Required{
 				Name:     webServer,
 				Version:  webServerVersion,
@@ -98,5 +110,7 @@ func runDetect(context detect.Detect) (int, error) {
 		})
 	}
 
+	plan.Requires = compat.MergePHPModuleRequirements(plan.Requires, options)
+
 	return context.Pass(plan)
 }
@@ -6,10 +6,12 @@ import (
 	"testing"
 
 	"github.com/buildpack/libbuildpack/buildplan"
+	"github.com/cloudfoundry/libcfbuildpack/buildpack"
 	"github.com/cloudfoundry/libcfbuildpack/buildpackplan"
 	"github.com/cloudfoundry/libcfbuildpack/detect"
 	"github.com/cloudfoundry/libcfbuildpack/helper"
 	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/php-compat-cnb/compat"
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
 
@@ -26,6 +28,11 @@ func testDetect(t *testing.T, when spec.G, it spec.S) {
 	it.Before(func() {
 		RegisterTestingT(t)
 		factory = test.NewDetectFactory(t)
+		factory.Detect.Buildpack.Metadata = buildpack.Metadata{
+			compat.VersionPlaceholdersMetadata: map[string]interface{}{
+				"php": map[string]interface{}{"PHP_72_LATEST": "7.2.*"},
+			},
+		}
 	})
 
 	when(".bp-config exists", func() {
@@ -66,6 +73,58 @@ func testDetect(t *testing.T, when spec.G, it spec.S) {
 		})
 	})
 
+	when("PHP_MODULES is present", func() {
+		it.Before(func() {
+			err := helper.WriteFile(filepath.Join(factory.Detect.Application.Root, ".bp-config", "options.json"), 0644, `{"PHP_MODULES": ["cli", "pear"]}`)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		it.After(func() {
+			err := os.RemoveAll(filepath.Join(factory.Detect.Application.Root, ".bp-config"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		it("requires PHP for the modules that have a v3 equivalent", func() {
+			code, err := runDetect(factory.Detect)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(code).To(Equal(detect.PassStatusCode))
+			Expect(factory.Plans.Plan.Requires).To(Equal([]buildplan.Required{
+				{Name: "php-compat"},
+				{Name: "php", Metadata: buildplan.Metadata{"build": true, "launch": true}},
+			}))
+		})
+
+		it("adds the modules to the PHP requirement rather than requiring PHP twice", func() {
+			err := helper.WriteFile(filepath.Join(factory.Detect.Application.Root, ".bp-config", "options.json"), 0644, `{"PHP_VERSION": "7.3.*", "PHP_MODULES": ["fpm", "cli"]}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			code, err := runDetect(factory.Detect)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(code).To(Equal(detect.PassStatusCode))
+			Expect(factory.Plans.Plan.Requires).To(Equal([]buildplan.Required{
+				{Name: "php-compat"},
+				{Name: "php", Version: "7.3.*", Metadata: buildplan.Metadata{
+					"build":                     true,
+					"launch":                    true,
+					buildpackplan.VersionSource: "buildpack.yml",
+				}},
+			}))
+		})
+	})
+
+	when("an unknown version placeholder is present", func() {
+		it("fails detection with an explanation", func() {
+			err := helper.WriteFile(filepath.Join(factory.Detect.Application.Root, ".bp-config", "options.json"), 0644, `{"PHP_VERSION": "{PHP_56_LATEST}"}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			code, err := runDetect(factory.Detect)
+			Expect(err).To(MatchError(ContainSubstring(`PHP_VERSION has an unknown version placeholder "{PHP_56_LATEST}", expected one of {PHP_72_LATEST}`)))
+			Expect(code).To(Equal(detect.FailStatusCode))
+		})
+	})
+
 	when("a COMPOSER_PATH is not set and", func() {
 		when(".bp-config does not exist", func() {
 			it("fails detect", func() {
@@ -156,6 +215,52 @@ func testDetect(t *testing.T, when spec.G, it spec.S) {
 		})
 	})
 
+	when("the web server is a v2 alias", func() {
+		it("requires the web server it stands for", func() {
+			err := helper.WriteFile(filepath.Join(factory.Detect.Application.Root, ".bp-config/options.json"), 0644, `{"WEB_SERVER": "apache", "HTTPD_VERSION": "2.4.*"}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = helper.WriteFile(filepath.Join(factory.Detect.Application.Root, "htdocs/index.php"), 0644, "")
+			Expect(err).ToNot(HaveOccurred())
+
+			code, err := runDetect(factory.Detect)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(code).To(Equal(detect.PassStatusCode))
+
+			Expect(factory.Plans.Plan.Requires).To(Equal([]buildplan.Required{
+				{Name: "php-compat"},
+				{Name: "httpd", Version: "2.4.*", Metadata: buildplan.Metadata{"launch": true}},
+			}))
+		})
+	})
+
+	when("the web server is none", func() {
+		it("does not require a web server", func() {
+			err := helper.WriteFile(filepath.Join(factory.Detect.Application.Root, ".bp-config/options.json"), 0644, `{"WEB_SERVER": "none"}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = helper.WriteFile(filepath.Join(factory.Detect.Application.Root, "htdocs/index.php"), 0644, "")
+			Expect(err).ToNot(HaveOccurred())
+
+			code, err := runDetect(factory.Detect)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(code).To(Equal(detect.PassStatusCode))
+
+			Expect(factory.Plans.Plan.Requires).To(Equal([]buildplan.Required{{Name: "php-compat"}}))
+		})
+	})
+
+	when("the web server is unknown", func() {
+		it("fails detection listing the allowed values", func() {
+			err := helper.WriteFile(filepath.Join(factory.Detect.Application.Root, ".bp-config/options.json"), 0644, `{"WEB_SERVER": "lighttpd"}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			code, err := runDetect(factory.Detect)
+			Expect(err).To(MatchError("WEB_SERVER must be one of `httpd` (or `apache`), `nginx`, `php-server` or `none`, found `lighttpd`"))
+			Expect(code).To(Equal(detect.FailStatusCode))
+		})
+	})
+
 	when("the buildpack.yml is present and the options.json is missing", func() {
 		it("fails detection", func() {
 			err := helper.WriteFile(filepath.Join(factory.Detect.Application.Root, "buildpack.yml"), 0644, ``)
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildpack/libbuildpack/buildpack"
+	bplog "github.com/buildpack/libbuildpack/logger"
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+	"github.com/cloudfoundry/libcfbuildpack/logger"
+	"github.com/cloudfoundry/php-compat-cnb/compat"
+)
+
+// Exit codes, so that CI can tell a broken migration apart from one that still has work to do
+const (
+	SuccessCode   = 0
+	FailureCode   = 1
+	UsageCode     = 2
+	HasChangeCode = 3
+)
+
+// retiredBPConfig is where -write and -output move `.bp-config` once the application is migrated
+const retiredBPConfig = ".bp-config.migrated"
+
+const usage = `Usage: php-compat migrate [flags] [application directory]
+
+Migrates an application written for the v2 PHP buildpack to the layout used by the PHP Cloud Native Buildpacks.
+The application directory defaults to the current directory.  One of -write, -output, -dry-run or -check is required.
+Nothing is written unless the whole migration succeeds.  Once -write or -output succeeds, .bp-config is renamed to
+.bp-config.migrated so that the buildpack does not migrate the application again.  Launch processes, such as an
+APP_START_CMD that is not a PHP script, are added to the Procfile.
+
+Exit codes:
+  0  the migration succeeded, or there is nothing to migrate
+  1  the migration failed
+  2  the command was used incorrectly
+  3  -check found files that the migration would create or change
+
+Flags:
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "migrate" {
+		_, _ = fmt.Fprint(stderr, usage)
+		return UsageCode
+	}
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	write := flags.Bool("write", false, "rewrite the application in place")
+	output := flags.String("output", "", "write the migrated application to this directory, leaving the original untouched")
+	dryRun := flags.Bool("dry-run", false, "show the files that would be created or changed as unified diffs")
+	check := flags.Bool("check", false, "like -dry-run, but exit with code 3 if any file would be created or changed")
+	reportPath := flags.String("report", "", "write the JSON migration report to this file, or `-` for standard output")
+	buildpackRoot := flags.String("buildpack", "", "directory containing the buildpack.toml to read settings from, defaults to the one this command was packaged with")
+	applicationPath := flags.String("app-path", compat.DefaultApplicationPath, "where the application lives when it runs, used to expand `@{HOME}` in snippets")
+	composerExtensions := flags.String("composer-extensions", os.Getenv(compat.ComposerExtensionsEnv), fmt.Sprintf("what happens to Composer `ext-*` requirements missing from PHP_EXTENSIONS, `%s`, `%s` or `%s`", compat.AddComposerExtensions, compat.WarnComposerExtensions, compat.FailComposerExtensions))
+	mergePolicy := flags.String("merge-policy", os.Getenv(compat.MergePolicyEnv), fmt.Sprintf("how conflicts with an existing buildpack.yml are resolved, `%s`, `%s` or `%s`", compat.PreferBuildpackYAML, compat.PreferOptionsJSON, compat.FailOnConflict))
+	snippetConflicts := flags.String("snippet-conflicts", os.Getenv(compat.SnippetConflictsEnv), fmt.Sprintf("what happens when a migrated snippet would replace a different file, `%s`, `%s` or `%s`", compat.KeepExistingSnippets, compat.ReplaceExistingSnippets, compat.FailOnSnippetConflict))
+	rules := flags.String("rules", os.Getenv(compat.RulesEnv), fmt.Sprintf("comma separated `rule=severity` pairs changing whether a rule is `%s`, `%s` or `%s`, such as `custom-httpd=warn`", compat.SeverityError, compat.SeverityWarn, compat.SeverityOff))
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return UsageCode
+	}
+
+	log := logger.Logger{Logger: bplog.NewLogger(nil, stderr)}
+	if *reportPath != "-" {
+		log = logger.Logger{Logger: bplog.NewLogger(nil, stdout)}
+	}
+
+	appRoot, err := applicationRoot(flags.Args())
+	if err != nil {
+		log.BodyError(err.Error())
+		return UsageCode
+	}
+
+	modes := 0
+	for _, mode := range []bool{*write, *output != "", *dryRun, *check} {
+		if mode {
+			modes++
+		}
+	}
+	if modes != 1 {
+		log.BodyError("exactly one of -write, -output, -dry-run or -check is required")
+		return UsageCode
+	}
+
+	if *output != "" {
+		if err := checkOutput(appRoot, *output); err != nil {
+			log.BodyError(err.Error())
+			return UsageCode
+		}
+	}
+
+	policy, err := compat.ParseMergePolicy(*mergePolicy)
+	if err != nil {
+		log.BodyError(err.Error())
+		return UsageCode
+	}
+
+	composerExtensionsPolicy, err := compat.ParseComposerExtensionsPolicy(*composerExtensions)
+	if err != nil {
+		log.BodyError(err.Error())
+		return UsageCode
+	}
+
+	snippetConflictPolicy, err := compat.ParseSnippetConflictPolicy(*snippetConflicts)
+	if err != nil {
+		log.BodyError(err.Error())
+		return UsageCode
+	}
+
+	ruleSeverities, err := compat.ParseRuleSeverities(*rules)
+	if err != nil {
+		log.BodyError(err.Error())
+		return UsageCode
+	}
+
+	metadata, err := loadMetadata(*buildpackRoot)
+	if err != nil {
+		log.BodyError(err.Error())
+		return UsageCode
+	}
+
+	placeholders, err := compat.NewVersionPlaceholders(metadata)
+	if err != nil {
+		log.BodyError(err.Error())
+		return UsageCode
+	}
+
+	extensions, err := compat.NewExtensionCatalog(metadata)
+	if err != nil {
+		log.BodyError(err.Error())
+		return UsageCode
+	}
+
+	config := compat.Config{
+		Placeholders:       placeholders,
+		Extensions:         extensions,
+		MergePolicy:        policy,
+		ComposerExtensions: composerExtensionsPolicy,
+		SnippetConflicts:   snippetConflictPolicy,
+		DryRun:             compat.DryRunOff,
+		ApplicationPath:    *applicationPath,
+		ComposerPath:       os.Getenv("COMPOSER_PATH"),
+		Rules:              ruleSeverities,
+		Procfile:           true,
+		Sink:               compat.LoggerSink{Logger: log},
+	}
+
+	switch {
+	case *dryRun:
+		config.DryRun = compat.DryRunPass
+	case *check:
+		config.DryRun = compat.DryRunFail
+	case *output != "":
+		if err := copyApplication(appRoot, *output); err != nil {
+			log.BodyError(err.Error())
+			if err := clearOutput(*output); err != nil {
+				log.BodyError(err.Error())
+			}
+			return FailureCode
+		}
+		appRoot = *output
+	}
+
+	code := SuccessCode
+	result, err := compat.Migrate(compat.OSFileSystem{}, appRoot, config)
+	if err != nil {
+		log.BodyError(err.Error())
+		code = FailureCode
+		if _, ok := err.(compat.DryRunError); ok {
+			code = HasChangeCode
+		}
+	}
+
+	log.Header("PHP Compat migration report")
+	log.Body("%s", result.Report.Markdown())
+
+	if code == SuccessCode && (*write || *output != "") {
+		if err := retireBPConfig(appRoot); err != nil {
+			log.BodyError(err.Error())
+			code = FailureCode
+		} else {
+			log.Body("Renamed .bp-config to %s, so that the buildpack does not migrate the application again", retiredBPConfig)
+		}
+	}
+
+	if code == FailureCode && *output != "" {
+		if err := clearOutput(*output); err != nil {
+			log.BodyError(err.Error())
+		}
+	}
+
+	if *reportPath != "" {
+		if err := writeReport(*reportPath, result.Report, stdout); err != nil {
+			log.BodyError(err.Error())
+			code = FailureCode
+		}
+	}
+
+	return code
+}
+
+func applicationRoot(args []string) (string, error) {
+	if len(args) > 1 {
+		return "", fmt.Errorf("expected a single application directory, found %s", strings.Join(args, " "))
+	}
+
+	appRoot := "."
+	if len(args) == 1 {
+		appRoot = args[0]
+	}
+
+	info, err := os.Stat(appRoot)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", appRoot)
+	}
+
+	return filepath.Abs(appRoot)
+}
+
+// checkOutput refuses output directories that would end up copied into themselves or that already have contents
+func checkOutput(appRoot string, output string) error {
+	output, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+
+	if relative, err := filepath.Rel(appRoot, output); err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("output directory %s must not be inside the application", output)
+	}
+
+	entries, err := ioutil.ReadDir(output)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("output directory %s must be empty", output)
+	}
+
+	return nil
+}
+
+// clearOutput empties the output directory of a failed migration, so that it never holds a partly migrated copy of
+// the application
+func clearOutput(output string) error {
+	entries, err := ioutil.ReadDir(output)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(output, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retireBPConfig renames the migrated `.bp-config` folder to retiredBPConfig.  The buildpack detects applications by
+// `.bp-config/options.json`, so leaving it would migrate the application again at every build.  The folder is kept
+// rather than deleted, as it may hold files that the migration left out.
+func retireBPConfig(appRoot string) error {
+	source := filepath.Join(appRoot, ".bp-config")
+	if _, err := os.Stat(source); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	destination := filepath.Join(appRoot, retiredBPConfig)
+	if _, err := os.Stat(destination); err == nil {
+		return fmt.Errorf("unable to rename .bp-config, %s already exists", retiredBPConfig)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Rename(source, destination)
+}
+
+// loadMetadata reads the buildpack metadata from buildpackRoot or, if that is empty, from the buildpack that contains
+// this command
+func loadMetadata(buildpackRoot string) (buildpack.Metadata, error) {
+	var (
+		b   buildpack.Buildpack
+		err error
+	)
+
+	if buildpackRoot != "" {
+		b, err = buildpack.New(buildpackRoot, bplog.Logger{})
+	} else {
+		b, err = buildpack.DefaultBuildpack(bplog.Logger{})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read buildpack.toml, use -buildpack to choose the buildpack directory: %s", err)
+	}
+
+	return b.Metadata, nil
+}
+
+// copyApplication copies the application to output, so that it can be migrated there.  Unlike helper.CopyDirectory,
+// empty directories are kept, as the migration checks for some of them.
+func copyApplication(appRoot string, output string) error {
+	return filepath.Walk(appRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(appRoot, path)
+		if err != nil {
+			return err
+		}
+		destination := filepath.Join(output, relative)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			return helper.CopySymlink(path, destination)
+		case info.IsDir():
+			return os.MkdirAll(destination, info.Mode().Perm())
+		default:
+			return helper.CopyFile(path, destination)
+		}
+	})
+}
+
+func writeReport(path string, report compat.Report, stdout io.Writer) error {
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if path == "-" {
+		_, err = fmt.Fprintf(stdout, "%s\n", contents)
+		return err
+	}
+
+	return helper.WriteFile(path, 0644, "%s\n", contents)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+	"github.com/cloudfoundry/php-compat-cnb/compat"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestUnitPHPCompat(t *testing.T) {
+	spec.Run(t, "PHPCompat", testPHPCompat, spec.Report(report.Terminal{}))
+}
+
+func testPHPCompat(t *testing.T, when spec.G, it spec.S) {
+	var (
+		appRoot string
+		stdout  *bytes.Buffer
+		stderr  *bytes.Buffer
+	)
+
+	migrate := func(args ...string) int {
+		args = append([]string{"migrate", "-buildpack", filepath.Join("..", "..")}, args...)
+		return run(append(args, appRoot), stdout, stderr)
+	}
+
+	it.Before(func() {
+		RegisterTestingT(t)
+
+		var err error
+		appRoot, err = ioutil.TempDir("", "php-compat-app")
+		Expect(err).ToNot(HaveOccurred())
+
+		stdout, stderr = &bytes.Buffer{}, &bytes.Buffer{}
+
+		Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"PHP_VERSION": "{PHP_73_LATEST}", "PHP_EXTENSIONS": ["bz2"]}`)).To(Succeed())
+		Expect(helper.WriteFile(filepath.Join(appRoot, "index.php"), 0644, "<?php")).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(appRoot, "htdocs"), 0755)).To(Succeed())
+	})
+
+	it.After(func() {
+		Expect(os.RemoveAll(appRoot)).To(Succeed())
+	})
+
+	it("requires the migrate command", func() {
+		Expect(run(nil, stdout, stderr)).To(Equal(UsageCode))
+		Expect(stderr.String()).To(ContainSubstring("Usage: php-compat migrate"))
+	})
+
+	it("requires exactly one mode", func() {
+		Expect(migrate()).To(Equal(UsageCode))
+		Expect(migrate("-write", "-dry-run")).To(Equal(UsageCode))
+		Expect(stdout.String()).To(ContainSubstring("exactly one of -write, -output, -dry-run or -check is required"))
+	})
+
+	it("rewrites the application in place", func() {
+		Expect(migrate("-write")).To(Equal(SuccessCode))
+
+		Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.ini.d", "compat-extensions.ini"))).To(Equal([]byte("extension=bz2.so\n")))
+		Expect(ioutil.ReadFile(filepath.Join(appRoot, "buildpack.yml"))).To(ContainSubstring("version: 7.3.*"))
+		Expect(stdout.String()).To(ContainSubstring("PHP Compat migration report"))
+	})
+
+	it("renames .bp-config once the application is migrated", func() {
+		Expect(migrate("-write")).To(Equal(SuccessCode))
+
+		Expect(filepath.Join(appRoot, ".bp-config")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(appRoot, ".bp-config.migrated", "options.json")).To(BeARegularFile())
+		Expect(stdout.String()).To(ContainSubstring("Renamed .bp-config to .bp-config.migrated"))
+	})
+
+	it("fails rather than replace an earlier .bp-config.migrated", func() {
+		Expect(os.Mkdir(filepath.Join(appRoot, ".bp-config.migrated"), 0755)).To(Succeed())
+
+		Expect(migrate("-write")).To(Equal(FailureCode))
+		Expect(filepath.Join(appRoot, ".bp-config", "options.json")).To(BeARegularFile())
+		Expect(stdout.String()).To(ContainSubstring(".bp-config.migrated already exists"))
+	})
+
+	it("keeps .bp-config when the migration fails", func() {
+		Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "httpd", "httpd.conf"), 0644, "Listen 8080\n")).To(Succeed())
+
+		Expect(migrate("-write")).To(Equal(FailureCode))
+		Expect(filepath.Join(appRoot, ".bp-config", "options.json")).To(BeARegularFile())
+	})
+
+	it("leaves the application as it was when a later step fails", func() {
+		Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"PHP_EXTENSIONS": ["mcryptx"]}`)).To(Succeed())
+		Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "a.ini"), 0644, "memory_limit = 1G\n")).To(Succeed())
+
+		Expect(migrate("-write")).To(Equal(FailureCode))
+		Expect(filepath.Join(appRoot, ".php.ini.d")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(appRoot, "buildpack.yml")).ToNot(BeAnExistingFile())
+	})
+
+	it("leaves the output directory empty when the migration fails", func() {
+		output, err := ioutil.TempDir("", "php-compat-output")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(output)
+
+		Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"PHP_EXTENSIONS": ["mcryptx"]}`)).To(Succeed())
+
+		Expect(migrate("-output", output)).To(Equal(FailureCode))
+		Expect(ioutil.ReadDir(output)).To(BeEmpty())
+	})
+
+	it("writes the migrated application to another directory", func() {
+		output, err := ioutil.TempDir("", "php-compat-output")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(output)
+
+		Expect(migrate("-output", output)).To(Equal(SuccessCode))
+
+		Expect(filepath.Join(output, "index.php")).To(BeARegularFile())
+		Expect(filepath.Join(output, "htdocs")).To(BeADirectory())
+		Expect(filepath.Join(output, ".bp-config")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(output, ".bp-config.migrated", "options.json")).To(BeARegularFile())
+		Expect(filepath.Join(appRoot, ".bp-config", "options.json")).To(BeARegularFile())
+		Expect(ioutil.ReadFile(filepath.Join(output, ".php.ini.d", "compat-extensions.ini"))).To(Equal([]byte("extension=bz2.so\n")))
+		Expect(filepath.Join(appRoot, "buildpack.yml")).ToNot(BeAnExistingFile())
+	})
+
+	when("APP_START_CMD is not a PHP script", func() {
+		it.Before(func() {
+			Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"APP_START_CMD": "bin/worker --queue default"}`)).To(Succeed())
+		})
+
+		it("adds it to the Procfile", func() {
+			Expect(helper.WriteFile(filepath.Join(appRoot, "Procfile"), 0644, "release: bin/migrate")).To(Succeed())
+
+			Expect(migrate("-write")).To(Equal(SuccessCode))
+			Expect(ioutil.ReadFile(filepath.Join(appRoot, "Procfile"))).To(Equal([]byte("release: bin/migrate\nworker: bin/worker --queue default\n")))
+			Expect(stdout.String()).To(ContainSubstring("`worker` process added to Procfile"))
+		})
+
+		it("fails rather than replace a process the Procfile already runs", func() {
+			Expect(helper.WriteFile(filepath.Join(appRoot, "Procfile"), 0644, "worker: bin/other\n")).To(Succeed())
+
+			Expect(migrate("-write")).To(Equal(FailureCode))
+			Expect(ioutil.ReadFile(filepath.Join(appRoot, "Procfile"))).To(Equal([]byte("worker: bin/other\n")))
+			Expect(filepath.Join(appRoot, ".bp-config", "options.json")).To(BeARegularFile())
+			Expect(filepath.Join(appRoot, "buildpack.yml")).ToNot(BeAnExistingFile())
+			Expect(stdout.String()).To(ContainSubstring("Procfile already runs `bin/other` as the `worker` process"))
+		})
+
+		it("only shows the Procfile lines in a dry run", func() {
+			Expect(migrate("-dry-run")).To(Equal(SuccessCode))
+			Expect(filepath.Join(appRoot, "Procfile")).ToNot(BeAnExistingFile())
+			Expect(stdout.String()).To(ContainSubstring("+++ b/Procfile"))
+			Expect(stdout.String()).To(ContainSubstring("+worker: bin/worker --queue default"))
+		})
+	})
+
+	it("refuses an output directory inside the application", func() {
+		Expect(migrate("-output", filepath.Join(appRoot, "out"))).To(Equal(UsageCode))
+		Expect(stdout.String()).To(ContainSubstring("must not be inside the application"))
+	})
+
+	it("refuses an output directory inside the application whose name starts with ..", func() {
+		Expect(migrate("-output", filepath.Join(appRoot, "..out"))).To(Equal(UsageCode))
+		Expect(stdout.String()).To(ContainSubstring("must not be inside the application"))
+	})
+
+	it("shows a dry run without changing anything", func() {
+		Expect(migrate("-dry-run")).To(Equal(SuccessCode))
+
+		Expect(stdout.String()).To(ContainSubstring("+++ b/.php.ini.d/compat-extensions.ini"))
+		Expect(filepath.Join(appRoot, ".php.ini.d")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(appRoot, ".bp-config", "options.json")).To(BeARegularFile())
+	})
+
+	it("fails a check while there is still something to migrate", func() {
+		Expect(migrate("-check")).To(Equal(HasChangeCode))
+		Expect(filepath.Join(appRoot, "buildpack.yml")).ToNot(BeAnExistingFile())
+	})
+
+	it("fails when the migration fails", func() {
+		Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "httpd", "httpd.conf"), 0644, "Listen 8080\n")).To(Succeed())
+
+		Expect(migrate("-write")).To(Equal(FailureCode))
+		Expect(stdout.String()).To(ContainSubstring("httpd must listen on $PORT"))
+	})
+
+	it("writes the JSON report to standard output", func() {
+		Expect(migrate("-dry-run", "-report", "-")).To(Equal(SuccessCode))
+
+		var r compat.Report
+		Expect(json.Unmarshal(stdout.Bytes(), &r)).To(Succeed())
+		Expect(r.DryRun).To(BeTrue())
+		Expect(r.GeneratedFiles).To(ConsistOf(".php.ini.d/compat-extensions.ini", "buildpack.yml"))
+		Expect(stderr.String()).To(ContainSubstring("PHP Compat migration report"))
+	})
+}
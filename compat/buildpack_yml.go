@@ -0,0 +1,209 @@
+package compat
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MergePolicyEnv selects the MergePolicy used when an application has both buildpack.yml and options.json
+const MergePolicyEnv = "BP_PHP_COMPAT_MERGE_POLICY"
+
+// MergePolicy decides which file wins when buildpack.yml and options.json set the same key to different values
+type MergePolicy string
+
+const (
+	PreferBuildpackYAML MergePolicy = "buildpack.yml"
+	PreferOptionsJSON   MergePolicy = "options.json"
+	FailOnConflict      MergePolicy = "fail"
+)
+
+// ParseMergePolicy validates a merge policy, defaulting to FailOnConflict
+func ParseMergePolicy(value string) (MergePolicy, error) {
+	switch policy := MergePolicy(value); policy {
+	case "":
+		return FailOnConflict, nil
+	case PreferBuildpackYAML, PreferOptionsJSON, FailOnConflict:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%s must be one of `%s`, `%s` or `%s`, found `%s`", MergePolicyEnv, PreferBuildpackYAML, PreferOptionsJSON, FailOnConflict, value)
+	}
+}
+
+// Conflict is a key that buildpack.yml and options.json set to different values
+type Conflict struct {
+	Key           string
+	BuildpackYAML interface{}
+	OptionsJSON   interface{}
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("`%s` is `%v` in buildpack.yml but `%v` in options.json", c.Key, c.BuildpackYAML, c.OptionsJSON)
+}
+
+// buildpackYAMLOptions maps the buildpack.yml keys to the options.json keys they are migrated from
+var buildpackYAMLOptions = map[string]string{
+	"php.version":               "PHP_VERSION",
+	"php.webserver":             "WEB_SERVER",
+	"php.serveradmin":           "ADMIN_EMAIL",
+	"php.script":                "APP_START_CMD",
+	"php.webdirectory":          "WEBDIR",
+	"php.libdirectory":          "LIBDIR",
+	"httpd.version":             "HTTPD_VERSION",
+	"nginx.version":             "NGINX_VERSION",
+	"composer.version":          "COMPOSER_VERSION",
+	"composer.install_global":   "COMPOSER_INSTALL_GLOBAL",
+	"composer.install_options":  "COMPOSER_INSTALL_OPTIONS",
+	"composer.vendor_directory": "COMPOSER_VENDOR_DIR",
+}
+
+// WriteOptionsToBuildpackYAML writes the options to buildpack.yml.  When buildpack.yml already exists, the options
+// are merged into it: keys that only exist in buildpack.yml are kept, missing keys are filled in from the options and
+// keys that disagree are resolved using the policy.  Only the keys that options.json actually sets, as listed in
+// Options.Keys, can disagree, the v2 defaults never override buildpack.yml.  Only the lines for keys that change are
+// rewritten, so sections meant for other buildpacks, ordering and comments all survive.
+func WriteOptionsToBuildpackYAML(appRoot string, options Options, policy MergePolicy) ([]Conflict, error) {
+	return writeOptionsToBuildpackYAML(newWorkspace(OSFileSystem{}, appRoot, false), options, policy)
+}
+
+func writeOptionsToBuildpackYAML(w *workspace, options Options, policy MergePolicy) ([]Conflict, error) {
+	optionsBytes, err := yaml.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+
+	existingBytes, exists, err := w.ReadFile("buildpack.yml")
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []Conflict
+	if exists {
+		var existing, generated yaml.MapSlice
+		if err := yaml.Unmarshal(existingBytes, &existing); err != nil {
+			return nil, fmt.Errorf("unable to parse buildpack.yml: %s", err)
+		}
+
+		if err := yaml.Unmarshal(optionsBytes, &generated); err != nil {
+			return nil, err
+		}
+
+		var merged yaml.MapSlice
+		var changes []yamlChange
+		explicit := func(key string) bool {
+			option, ok := buildpackYAMLOptions[key]
+			return !ok || containsString(options.Keys, option)
+		}
+
+		merged, changes, conflicts = mergeYAML(nil, existing, generated, policy, explicit)
+		if policy == FailOnConflict && len(conflicts) > 0 {
+			return conflicts, fmt.Errorf("buildpack.yml and `.bp-config/options.json` have %d conflicting setting(s), set %s to `%s` or `%s` to choose which one wins", len(conflicts), MergePolicyEnv, PreferBuildpackYAML, PreferOptionsJSON)
+		}
+
+		optionsBytes, err = applyYAMLChanges(existingBytes, merged, changes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = w.WriteFile("buildpack.yml", 0655, optionsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return conflicts, nil
+}
+
+type yamlChange struct {
+	path  []string
+	value interface{}
+}
+
+// mergeYAML fills in the generated keys that are missing from existing, keeping the order of existing.  Along with
+// the merged result, it returns each key that had to change.  Only the keys that explicit reports, by their dotted
+// path, can conflict with existing, the others are defaults that give way to it.
+func mergeYAML(path []string, existing yaml.MapSlice, generated yaml.MapSlice, policy MergePolicy, explicit func(string) bool) (yaml.MapSlice, []yamlChange, []Conflict) {
+	merged := append(yaml.MapSlice{}, existing...)
+
+	var changes []yamlChange
+	var conflicts []Conflict
+	for _, item := range generated {
+		itemPath := append(append([]string{}, path...), fmt.Sprintf("%v", item.Key))
+		key := strings.Join(itemPath, ".")
+
+		index := -1
+		for i, existingItem := range merged {
+			if fmt.Sprintf("%v", existingItem.Key) == fmt.Sprintf("%v", item.Key) {
+				index = i
+				break
+			}
+		}
+
+		generatedMap, generatedIsMap := item.Value.(yaml.MapSlice)
+		if index < 0 {
+			if !generatedIsMap || len(generatedMap) > 0 {
+				merged = append(merged, item)
+				changes = append(changes, yamlChange{path: itemPath, value: item.Value})
+			}
+			continue
+		}
+
+		if merged[index].Value == nil {
+			merged[index].Value = item.Value
+			changes = append(changes, yamlChange{path: itemPath, value: item.Value})
+			continue
+		}
+
+		existingMap, existingIsMap := merged[index].Value.(yaml.MapSlice)
+		if existingIsMap && generatedIsMap {
+			var nestedChanges []yamlChange
+			var nestedConflicts []Conflict
+			merged[index].Value, nestedChanges, nestedConflicts = mergeYAML(itemPath, existingMap, generatedMap, policy, explicit)
+			changes = append(changes, nestedChanges...)
+			conflicts = append(conflicts, nestedConflicts...)
+			continue
+		}
+
+		if fmt.Sprintf("%v", merged[index].Value) == fmt.Sprintf("%v", item.Value) || !explicit(key) {
+			continue
+		}
+
+		conflicts = append(conflicts, Conflict{Key: key, BuildpackYAML: merged[index].Value, OptionsJSON: item.Value})
+		if policy == PreferOptionsJSON {
+			merged[index].Value = item.Value
+			changes = append(changes, yamlChange{path: itemPath, value: item.Value})
+		}
+	}
+
+	return merged, changes, conflicts
+}
+
+// applyYAMLChanges edits the original buildpack.yml in place.  Sections that are not block mappings are rewritten
+// whole from the merged result.
+func applyYAMLChanges(original []byte, merged yaml.MapSlice, changes []yamlChange) ([]byte, error) {
+	document := newYAMLDocument(original)
+
+	for _, change := range changes {
+		edited := false
+		if len(change.path) == 2 {
+			var err error
+			edited, err = document.set(change.path[0], change.path[1], change.value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !edited {
+			for _, item := range merged {
+				if fmt.Sprintf("%v", item.Key) == change.path[0] {
+					if err := document.replaceSection(change.path[0], item.Value); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+
+	return document.Bytes(), nil
+}
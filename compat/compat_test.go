@@ -2,16 +2,23 @@ package compat
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	libbuildpack "github.com/buildpack/libbuildpack/buildpack"
 	bplog "github.com/buildpack/libbuildpack/logger"
+	"github.com/cloudfoundry/libcfbuildpack/buildpack"
 	"github.com/cloudfoundry/libcfbuildpack/logger"
 
+	"github.com/buildpack/libbuildpack/buildplan"
 	"github.com/cloudfoundry/libcfbuildpack/buildpackplan"
 	"github.com/cloudfoundry/libcfbuildpack/helper"
+	"github.com/cloudfoundry/libcfbuildpack/layers"
 	. "github.com/onsi/gomega"
 	"gopkg.in/yaml.v2"
 
@@ -51,10 +58,9 @@ func testCompat(t *testing.T, when spec.G, it spec.S) {
 			})
 
 			it("fails build", func() {
-				contributor, _, err := NewContributor(factory.Build)
-				Expect(err).ToNot(HaveOccurred())
+				m := newMigration(OSFileSystem{}, appRoot, Config{})
 
-				err = contributor.CheckForPythonExtentions()
+				err := m.CheckForPythonExtentions()
 
 				Expect(err).To(MatchError("Use of .extensions folder has been removed. Please remove this folder from your application."))
 			})
@@ -108,13 +114,57 @@ func testCompat(t *testing.T, when spec.G, it spec.S) {
 				})
 			})
 
+			when("and we're reporting options", func() {
+				it("remembers the options in the order they appear", func() {
+					options, err := LoadOptionsJSON(appRoot)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(options.Keys).To(Equal([]string{
+						"WEB_SERVER",
+						"HTTPD_VERSION",
+						"PHP_VERSION",
+						"NGINX_VERSION",
+						"COMPOSER_VERSION",
+						"ADDITIONAL_PREPROCESS_CMDS",
+						"COMPOSER_INSTALL_GLOBAL",
+						"COMPOSER_INSTALL_OPTIONS",
+						"COMPOSER_VENDOR_DIR",
+					}))
+				})
+
+				it("logs one finding per option", func() {
+					buf := bytes.Buffer{}
+					factory.Build.Logger = logger.Logger{Logger: bplog.NewLogger(&buf, &buf)}
+
+					m := newMigration(OSFileSystem{}, appRoot, Config{Sink: LoggerSink{Logger: factory.Build.Logger}})
+
+					Expect(m.ReportOptions(Options{Keys: []string{"PHP_VERSION", "HTTPD_STRIP", "PHP_MODULES", "COMPOSER_GITHUB_OAUTH_TOKEN"}})).To(Succeed())
+
+					Expect(buf.String()).To(ContainSubstring("PHP_VERSION: Migrated to `php.version` in buildpack.yml."))
+					Expect(buf.String()).To(ContainSubstring("HTTPD_STRIP is ignored: HTTPD files are no longer stripped."))
+					Expect(buf.String()).To(ContainSubstring("PHP_MODULES: The full PHP distribution is always installed"))
+					Expect(buf.String()).To(ContainSubstring("COMPOSER_GITHUB_OAUTH_TOKEN is unsupported: Tokens are no longer read from options.json."))
+				})
+
+				it("drops the known keys that are not migrated", func() {
+					m := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					Expect(m.ReportOptions(Options{Keys: []string{"PHP_VERSION", "PHP_71_LATEST", "NEWRELIC_LICENSE", "HTTPD_STRIP"}})).To(Succeed())
+
+					Expect(m.report.Findings).To(Equal([]Finding{
+						{Rule: "legacy-option", Outcome: OutcomeMigrated, File: ".bp-config/options.json", Key: "PHP_VERSION", Action: "Migrated to `php.version` in buildpack.yml."},
+						{Rule: "legacy-option", Outcome: OutcomeDropped, File: ".bp-config/options.json", Key: "PHP_71_LATEST", Action: "Version placeholders are resolved from the buildpack, the value set here is not used. Remove this setting from options.json."},
+						{Rule: "legacy-option", Outcome: OutcomeDropped, File: ".bp-config/options.json", Key: "NEWRELIC_LICENSE", Action: "The PHP buildpacks do not install the New Relic agent. Use a New Relic buildpack instead and remove this setting from options.json."},
+						{Rule: "legacy-option", Outcome: OutcomeDropped, File: ".bp-config/options.json", Key: "HTTPD_STRIP", Action: "HTTPD files are no longer stripped. Remove this setting from options.json."},
+					}))
+				})
+			})
+
 			when("and contains additional commands", func() {
 				it("will copy those to a `.profile.d` script", func() {
-					contributor, _, err := NewContributor(factory.Build)
-					Expect(err).ToNot(HaveOccurred())
+					m := newMigration(OSFileSystem{}, appRoot, Config{})
 					options, err := LoadOptionsJSON(appRoot)
 					Expect(err).ToNot(HaveOccurred())
-					contributor.MigrateAdditionalCommands(options)
+					m.MigrateAdditionalCommands(options)
 					pathToAdditionalCMDS := filepath.Join(appRoot, ".profile.d", "additional-cmds.sh")
 
 					Expect(pathToAdditionalCMDS).To(BeARegularFile())
@@ -133,237 +183,1654 @@ func testCompat(t *testing.T, when spec.G, it spec.S) {
 			})
 		})
 
-		when("options.json exists and there are specific version requirements", func() {
-			it("loads PHP_DEFAULT", func() {
-				json := `{"PHP_VERSION": "{PHP_DEFAULT}"}`
+		when("options.json does not match the schema", func() {
+			it.After(func() {
+				os.RemoveAll(filepath.Join(appRoot, ".bp-config"))
+			})
+
+			it("reports every problem with its line and column", func() {
+				json := `{
+  "PHP_EXTENSION": ["bz2"],
+  "WEBDIR ": "public",
+  "PHP_VERSION": 7.3,
+  "ZEND_EXTENSIONS": ["opcache", 1],
+  "SOMETHING_ELSE": true
+}`
 				err := writeOptionsJSON(appRoot, json)
 				Expect(err).ToNot(HaveOccurred())
-				defer os.RemoveAll(filepath.Join(appRoot, ".bp-config"))
+
+				_, err = LoadOptionsJSON(appRoot)
+				Expect(err).To(HaveOccurred())
+
+				optionsErr, ok := err.(OptionsError)
+				Expect(ok).To(BeTrue())
+				Expect(optionsErr.Problems).To(Equal([]OptionsProblem{
+					{Line: 2, Column: 3, Message: `unknown option "PHP_EXTENSION", did you mean "PHP_EXTENSIONS"?`},
+					{Line: 3, Column: 3, Message: `unknown option "WEBDIR ", did you mean "WEBDIR"?`},
+					{Line: 4, Column: 18, Message: "PHP_VERSION must be a string, found a number"},
+					{Line: 5, Column: 22, Message: "ZEND_EXTENSIONS must be a list of strings, found a non-string value at index 1"},
+					{Line: 6, Column: 3, Message: `unknown option "SOMETHING_ELSE"`},
+				}))
+				Expect(err.Error()).To(ContainSubstring("line 2, column 3: unknown option \"PHP_EXTENSION\""))
+			})
+
+			it("accepts every key the v2 buildpack defined", func() {
+				json := `{
+  "PHP_VERSION": "{PHP_71_LATEST}",
+  "PHP_71_LATEST": "7.1.33",
+  "PHP_DEFAULT": "7.3.20",
+  "HTTPD_24_LATEST": "2.4.46",
+  "NGINX_STABLE": "1.18.0",
+  "PHP_DOWNLOAD_URL": "{DOWNLOAD_URL}/php/{PHP_VERSION}/php-{PHP_VERSION}.tar.gz",
+  "COMPOSER_HASH_URL": "{DOWNLOAD_URL}/composer/{COMPOSER_VERSION}/composer.phar.sha1",
+  "NEWRELIC_LICENSE": "x",
+  "NEWRELIC_STRIP": true,
+  "PHP_FPM_LISTEN": "127.0.0.1:9000"
+}`
+				Expect(writeOptionsJSON(appRoot, json)).To(Succeed())
 
 				options, err := LoadOptionsJSON(appRoot)
 				Expect(err).ToNot(HaveOccurred())
-				Expect(options.PHP.Version).To(BeEmpty())
+				Expect(options.Keys).To(HaveLen(10))
 			})
-			it("loads PHP_72_LATEST", func() {
-				json := `{"PHP_VERSION": "{PHP_72_LATEST}"}`
+
+			it("still checks the type of the keys it matches by family", func() {
+				Expect(writeOptionsJSON(appRoot, `{"NEWRELIC_LICENSE": ["x"], "PHP_72_LATEST": false, "PHP_72_NEWEST": "7.2"}`)).To(Succeed())
+
+				_, err := LoadOptionsJSON(appRoot)
+				Expect(err).To(MatchError(ContainSubstring("NEWRELIC_LICENSE must be a string or a boolean, found a list")))
+				Expect(err).To(MatchError(ContainSubstring("PHP_72_LATEST must be a string, found a boolean")))
+				Expect(err).To(MatchError(ContainSubstring(`unknown option "PHP_72_NEWEST"`)))
+			})
+
+			it("reports duplicate options", func() {
+				err := writeOptionsJSON(appRoot, `{"WEBDIR": "public", "WEBDIR": "htdocs"}`)
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = LoadOptionsJSON(appRoot)
+				Expect(err).To(MatchError(ContainSubstring(`line 1, column 22: duplicate option "WEBDIR", first defined at line 1, column 2`)))
+			})
+
+			it("reports invalid JSON with its position", func() {
+				err := writeOptionsJSON(appRoot, "{\n  \"WEBDIR\": \"public\"\n  \"LIBDIR\": \"lib\"\n}")
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = LoadOptionsJSON(appRoot)
+				Expect(err).To(MatchError(ContainSubstring("line 3, column 3: invalid JSON")))
+			})
+
+			it("requires a JSON object", func() {
+				err := writeOptionsJSON(appRoot, `["WEBDIR"]`)
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = LoadOptionsJSON(appRoot)
+				Expect(err).To(MatchError(ContainSubstring("line 1, column 1: expected a JSON object containing options")))
+			})
+		})
+
+		when("options.json exists and there are specific version requirements", func() {
+			var placeholders VersionPlaceholders
+
+			it.Before(func() {
+				bp, err := libbuildpack.New("..", bplog.Logger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				placeholders, err = NewVersionPlaceholders(bp.Metadata)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			it.After(func() {
+				os.RemoveAll(filepath.Join(appRoot, ".bp-config"))
+			})
+
+			resolve := func(json string) (Options, error) {
 				err := writeOptionsJSON(appRoot, json)
 				Expect(err).ToNot(HaveOccurred())
-				defer os.RemoveAll(filepath.Join(appRoot, ".bp-config"))
 
 				options, err := LoadOptionsJSON(appRoot)
 				Expect(err).ToNot(HaveOccurred())
+
+				err = ResolveVersionPlaceholders(&options, placeholders)
+				return options, err
+			}
+
+			it("loads PHP_DEFAULT", func() {
+				options, err := resolve(`{"PHP_VERSION": "{PHP_DEFAULT}"}`)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(options.PHP.Version).To(BeEmpty())
+			})
+			it("loads PHP_71_LATEST", func() {
+				options, err := resolve(`{"PHP_VERSION": "{PHP_71_LATEST}"}`)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(options.PHP.Version).To(Equal("7.1.*"))
+			})
+			it("loads PHP_72_LATEST", func() {
+				options, err := resolve(`{"PHP_VERSION": "{PHP_72_LATEST}"}`)
+				Expect(err).ToNot(HaveOccurred())
 				Expect(options.PHP.Version).To(Equal("7.2.*"))
 			})
 			it("loads PHP_73_LATEST", func() {
-				json := `{"PHP_VERSION": "{PHP_73_LATEST}"}`
-				err := writeOptionsJSON(appRoot, json)
+				options, err := resolve(`{"PHP_VERSION": "{PHP_73_LATEST}"}`)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(options.PHP.Version).To(Equal("7.3.*"))
+			})
+			it("loads PHP_74_LATEST", func() {
+				options, err := resolve(`{"PHP_VERSION": "{PHP_74_LATEST}"}`)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(options.PHP.Version).To(Equal("7.4.*"))
+			})
+			it("loads PHP_80_LATEST", func() {
+				options, err := resolve(`{"PHP_VERSION": "{PHP_80_LATEST}"}`)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(options.PHP.Version).To(Equal("8.0.*"))
+			})
+			it("loads web server and Composer placeholders", func() {
+				options, err := resolve(`{"NGINX_VERSION": "{NGINX_MAINLINE}", "HTTPD_VERSION": "{HTTPD_24_LATEST}", "COMPOSER_VERSION": "{COMPOSER_DEFAULT}"}`)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(options.Nginx.Version).To(Equal("1.19.*"))
+				Expect(options.HTTPD.Version).To(Equal("2.4.*"))
+				Expect(options.Composer.Version).To(BeEmpty())
+			})
+			it("leaves plain versions alone", func() {
+				options, err := resolve(`{"PHP_VERSION": "7.3.10", "NGINX_VERSION": "1.18.*"}`)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(options.PHP.Version).To(Equal("7.3.10"))
+				Expect(options.Nginx.Version).To(Equal("1.18.*"))
+			})
+			it("fails on unknown or misplaced placeholders", func() {
+				_, err := resolve(`{"PHP_VERSION": "{PHP_99_LATEST}", "HTTPD_VERSION": "{NGINX_STABLE}", "NGINX_VERSION": "{NGINX_STABLE"}`)
+				Expect(err).To(MatchError(ContainSubstring(`PHP_VERSION has an unknown version placeholder "{PHP_99_LATEST}", expected one of {PHP_71_LATEST}, {PHP_72_LATEST}, {PHP_73_LATEST}, {PHP_74_LATEST}, {PHP_80_LATEST}, {PHP_DEFAULT}`)))
+				Expect(err).To(MatchError(ContainSubstring(`HTTPD_VERSION has an unknown version placeholder "{NGINX_STABLE}", expected one of {HTTPD_24_LATEST}, {HTTPD_DEFAULT}`)))
+				Expect(err).To(MatchError(ContainSubstring(`NGINX_VERSION has a malformed version placeholder "{NGINX_STABLE"`)))
+			})
+			it("rejects invalid constraints in the buildpack metadata", func() {
+				_, err := NewVersionPlaceholders(buildpack.Metadata{
+					VersionPlaceholdersMetadata: map[string]interface{}{
+						"php": map[string]interface{}{"PHP_72_LATEST": "seven"},
+					},
+				})
+				Expect(err).To(MatchError(ContainSubstring("version-placeholders.php.PHP_72_LATEST is not a valid version constraint")))
+			})
+		})
+
+		when("WEB_SERVER is migrated", func() {
+			it("maps the v2 aliases to the canonical web servers", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				options := Options{PHP: PHPOptions{WebServer: "HTTPD"}}
+
+				Expect(c.MigrateWebServer(&options)).To(Succeed())
+				Expect(options.PHP.WebServer).To(Equal("httpd"))
+				Expect(c.report.Findings).To(Equal([]Finding{{Rule: "web-server", Outcome: OutcomeMigrated, File: ".bp-config/options.json", Key: "WEB_SERVER", Action: "written as `httpd`"}}))
+			})
+
+			it("leaves the web server out for script applications", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				options := Options{PHP: PHPOptions{WebServer: "none"}}
+
+				Expect(c.MigrateWebServer(&options)).To(Succeed())
+				Expect(options.PHP.WebServer).To(BeEmpty())
+				Expect(c.report.Findings).To(Equal([]Finding{{Rule: "web-server", Outcome: OutcomeMigrated, File: ".bp-config/options.json", Key: "WEB_SERVER", Action: "no web server, the application runs as a script"}}))
+			})
+
+			it("fails on unknown web servers", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				options := Options{PHP: PHPOptions{WebServer: "lighttpd"}}
+
+				Expect(c.MigrateWebServer(&options)).To(MatchError(ContainSubstring("WEB_SERVER must be one of `httpd` (or `apache`), `nginx`, `php-server` or `none`")))
+			})
+		})
+
+		when("APP_START_CMD is migrated", func() {
+			it("keeps a PHP script under the application as the script", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, "bin", "worker.php"), 0644, "<?php")).To(Succeed())
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				options := Options{PHP: PHPOptions{AppStartCommand: "./bin/worker.php"}}
+
+				Expect(c.MigrateAppStartCommand(&options)).To(Succeed())
+				Expect(options.PHP.AppStartCommand).To(Equal("bin/worker.php"))
+				Expect(c.processes).To(BeEmpty())
+				Expect(c.report.Findings).To(Equal([]Finding{{Rule: "app-start-cmd", Outcome: OutcomeMigrated, File: ".bp-config/options.json", Key: "APP_START_CMD", Action: "written to `php.script` in buildpack.yml"}}))
+			})
+
+			it("runs any other command as the web process of an application without a web server", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, "bin", "worker.php"), 0644, "<?php")).To(Succeed())
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				options := Options{PHP: PHPOptions{WebServer: "", AppStartCommand: "php bin/worker.php --queue=default"}}
+
+				Expect(c.MigrateAppStartCommand(&options)).To(Succeed())
+				Expect(options.PHP.AppStartCommand).To(BeEmpty())
+				Expect(c.processes).To(Equal(layers.Processes{{Type: "web", Command: "php bin/worker.php --queue=default"}}))
+				Expect(c.report.Findings).To(Equal([]Finding{{Rule: "app-start-cmd", Outcome: OutcomeMigrated, File: ".bp-config/options.json", Key: "APP_START_CMD", Action: "runs as the `web` launch process"}}))
+			})
+
+			it("runs it as a worker beside the web server", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, "public", "index.php"), 0644, "<?php")).To(Succeed())
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				options := Options{PHP: PHPOptions{WebServer: "nginx", WebDir: "public", AppStartCommand: "../shared/run.php"}}
+
+				Expect(c.MigrateAppStartCommand(&options)).To(Succeed())
+				Expect(c.processes).To(Equal(layers.Processes{{Type: "worker", Command: "../shared/run.php"}}))
+			})
+		})
+
+		when("options need to be written", func() {
+			it("produces buildpack.yml", func() {
+				options := Options{
+					HTTPD: HTTPDOptions{
+						Version: "2.3.49",
+					},
+					PHP: PHPOptions{
+						Version:   "7.3.10",
+						WebServer: "standalone",
+					},
+					Nginx: NginxOptions{
+						Version: "1.14.9",
+					},
+					Composer: ComposerOptions{
+						Version:        "1.8.9",
+						GlobalOptions:  nil,
+						InstallOptions: nil,
+					},
+				}
+				conflicts, err := WriteOptionsToBuildpackYAML(appRoot, options, FailOnConflict)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conflicts).To(BeEmpty())
+
+				exists, err := helper.FileExists(filepath.Join(appRoot, "buildpack.yml"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(exists).To(BeTrue())
+
+				buildpackYMLOutput, err := ioutil.ReadFile(filepath.Join(appRoot, "buildpack.yml"))
+				Expect(err).ToNot(HaveOccurred())
+
+				actualOptions := Options{}
+				err = yaml.Unmarshal(buildpackYMLOutput, &actualOptions)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(options).To(Equal(actualOptions))
+			})
+		})
+
+		when("options need to be merged into an existing buildpack.yml", func() {
+			var options Options
+
+			it.Before(func() {
+				err := helper.WriteFile(filepath.Join(appRoot, "buildpack.yml"), 0644, `---
+php:
+  version: 7.2.*
+  redis:
+    session_store_service_name: my-redis
+composer:
+  json_path: app
+`)
+				Expect(err).ToNot(HaveOccurred())
+
+				options = Options{
+					PHP: PHPOptions{
+						Version:   "7.3.*",
+						WebServer: "nginx",
+					},
+					Composer: ComposerOptions{
+						VendorDirectory: "vendor",
+					},
+					Keys: []string{"PHP_VERSION", "WEB_SERVER", "COMPOSER_VENDOR_DIR"},
+				}
+			})
+
+			readBuildpackYAML := func() map[string]interface{} {
+				contents, err := ioutil.ReadFile(filepath.Join(appRoot, "buildpack.yml"))
+				Expect(err).ToNot(HaveOccurred())
+
+				actual := map[string]interface{}{}
+				err = yaml.Unmarshal(contents, &actual)
+				Expect(err).ToNot(HaveOccurred())
+				return actual
+			}
+
+			it("keeps hand written keys and fills in the rest when buildpack.yml wins", func() {
+				conflicts, err := WriteOptionsToBuildpackYAML(appRoot, options, PreferBuildpackYAML)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conflicts).To(Equal([]Conflict{{Key: "php.version", BuildpackYAML: "7.2.*", OptionsJSON: "7.3.*"}}))
+
+				Expect(readBuildpackYAML()).To(Equal(map[string]interface{}{
+					"php": map[interface{}]interface{}{
+						"version":   "7.2.*",
+						"webserver": "nginx",
+						"redis":     map[interface{}]interface{}{"session_store_service_name": "my-redis"},
+					},
+					"composer": map[interface{}]interface{}{
+						"json_path":        "app",
+						"vendor_directory": "vendor",
+					},
+				}))
+			})
+
+			it("overwrites conflicting keys when options.json wins", func() {
+				conflicts, err := WriteOptionsToBuildpackYAML(appRoot, options, PreferOptionsJSON)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conflicts).To(HaveLen(1))
+
+				php := readBuildpackYAML()["php"].(map[interface{}]interface{})
+				Expect(php["version"]).To(Equal("7.3.*"))
+				Expect(php["redis"]).To(Equal(map[interface{}]interface{}{"session_store_service_name": "my-redis"}))
+			})
+
+			it("fails on conflicts by default and leaves buildpack.yml alone", func() {
+				policy, err := ParseMergePolicy("")
+				Expect(err).ToNot(HaveOccurred())
+
+				conflicts, err := WriteOptionsToBuildpackYAML(appRoot, options, policy)
+				Expect(err).To(MatchError(ContainSubstring("buildpack.yml and `.bp-config/options.json` have 1 conflicting setting(s)")))
+				Expect(conflicts[0].String()).To(Equal("`php.version` is `7.2.*` in buildpack.yml but `7.3.*` in options.json"))
+
+				Expect(readBuildpackYAML()["php"]).To(HaveKeyWithValue("version", "7.2.*"))
+				Expect(readBuildpackYAML()["php"]).ToNot(HaveKey("webserver"))
+			})
+
+			it("merges without conflicts when the files agree", func() {
+				options.PHP.Version = "7.2.*"
+
+				conflicts, err := WriteOptionsToBuildpackYAML(appRoot, options, FailOnConflict)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conflicts).To(BeEmpty())
+				Expect(readBuildpackYAML()["php"]).To(HaveKeyWithValue("webserver", "nginx"))
+			})
+
+			it("keeps comments, order and sections for other buildpacks", func() {
+				err := helper.WriteFile(filepath.Join(appRoot, "buildpack.yml"), 0644, `---
+# settings for the whole buildpack group
+nginx:
+  version: 1.18.* # pinned by ops
+
+php:
+  # the PHP version we test against
+  version: 7.2.* # keep in sync with CI
+  redis:
+    session_store_service_name: my-redis
+
+# composer settings
+composer:
+  install_options:
+  - --no-dev
+  json_path: app
+
+other-buildpack:
+  enabled: true
+`)
+				Expect(err).ToNot(HaveOccurred())
+
+				options.Composer.InstallOptions = []string{"--no-interaction"}
+				options.HTTPD.Version = "2.4.*"
+				options.Keys = append(options.Keys, "COMPOSER_INSTALL_OPTIONS", "HTTPD_VERSION")
+
+				_, err = WriteOptionsToBuildpackYAML(appRoot, options, PreferOptionsJSON)
+				Expect(err).ToNot(HaveOccurred())
+
+				contents, err := ioutil.ReadFile(filepath.Join(appRoot, "buildpack.yml"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(contents)).To(Equal(`---
+# settings for the whole buildpack group
+nginx:
+  version: 1.18.* # pinned by ops
+
+php:
+  # the PHP version we test against
+  version: 7.3.* # keep in sync with CI
+  redis:
+    session_store_service_name: my-redis
+  webserver: nginx
+
+# composer settings
+composer:
+  install_options:
+  - --no-interaction
+  json_path: app
+  vendor_directory: vendor
+
+other-buildpack:
+  enabled: true
+httpd:
+  version: 2.4.*
+`))
+			})
+
+			it("rewrites only sections that are not block mappings", func() {
+				err := helper.WriteFile(filepath.Join(appRoot, "buildpack.yml"), 0644, `# flow style
+php: {version: 7.2.*}
+composer:
+  json_path: app # where composer.json lives
+`)
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = WriteOptionsToBuildpackYAML(appRoot, options, PreferBuildpackYAML)
+				Expect(err).ToNot(HaveOccurred())
+
+				contents, err := ioutil.ReadFile(filepath.Join(appRoot, "buildpack.yml"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(contents)).To(Equal(`# flow style
+php:
+  version: 7.2.*
+  webserver: nginx
+composer:
+  json_path: app # where composer.json lives
+  vendor_directory: vendor
+`))
+			})
+
+			it("lets buildpack.yml win over the v2 defaults that options.json does not set", func() {
+				err := helper.WriteFile(filepath.Join(appRoot, "buildpack.yml"), 0644, "php:\n  webserver: nginx\n")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(writeOptionsJSON(appRoot, `{"PHP_VERSION": "7.3.*"}`)).To(Succeed())
+				options, err := LoadOptionsJSON(appRoot)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(options.PHP.WebServer).To(Equal("httpd"))
+
+				conflicts, err := WriteOptionsToBuildpackYAML(appRoot, options, FailOnConflict)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conflicts).To(BeEmpty())
+				Expect(readBuildpackYAML()["php"]).To(Equal(map[interface{}]interface{}{"webserver": "nginx", "version": "7.3.*"}))
+			})
+
+			it("rejects unknown policies", func() {
+				_, err := ParseMergePolicy("newest")
+				Expect(err).To(MatchError("BP_PHP_COMPAT_MERGE_POLICY must be one of `buildpack.yml`, `options.json` or `fail`, found `newest`"))
+			})
+		})
+
+		when("PHP_MODULES needs to be migrated", func() {
+			it("maps modules with a v3 equivalent", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+				Expect(c.MigratePHPModules(Options{PHP: PHPOptions{Modules: []string{"cli", "fpm"}}})).To(Succeed())
+				Expect(findingKeys(c.report.Findings)).To(Equal([]string{"cli", "fpm"}))
+				Expect(c.report.Findings[0].Outcome).To(Equal(OutcomeMigrated))
+			})
+
+			it("fails on modules without one and explains what to use instead", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+				err := c.MigratePHPModules(Options{PHP: PHPOptions{Modules: []string{"fpm", "pear", "cgi", "gd"}}})
+				Expect(err).To(MatchError(ContainSubstring("PHP_MODULES `pear` has no v3 equivalent: PEAR is not installed, require the PEAR packages you use through Composer instead")))
+				Expect(err).To(MatchError(ContainSubstring("PHP_MODULES `cgi` has no v3 equivalent: `php-cgi` is not installed")))
+				Expect(err).To(MatchError(ContainSubstring("PHP_MODULES `gd` is not a PHP module, expected one of `cgi`, `cli`, `fpm`, `pear`")))
+			})
+
+			it("lists the build plan requirements that provide them", func() {
+				Expect(MergePHPModuleRequirements(nil, Options{PHP: PHPOptions{Version: "7.3.*", Modules: []string{"FPM", "pear"}}})).To(Equal([]buildplan.Required{
+					{Name: "php", Version: "7.3.*", Metadata: buildplan.Metadata{"launch": true}},
+				}))
+			})
+
+			it("merges them into the requirements that exist already", func() {
+				requires := []buildplan.Required{{Name: "php-compat"}, {Name: "php", Version: "7.3.*", Metadata: buildplan.Metadata{"launch": true}}}
+
+				Expect(MergePHPModuleRequirements(requires, Options{PHP: PHPOptions{Version: "7.3.*", Modules: []string{"fpm", "cli"}}})).To(Equal([]buildplan.Required{
+					{Name: "php-compat"},
+					{Name: "php", Version: "7.3.*", Metadata: buildplan.Metadata{"build": true, "launch": true}},
+				}))
+			})
+		})
+
+		when("extensions need to be migrated", func() {
+			it("migrates PHP_EXTENSIONS", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				options := Options{
+					PHP: PHPOptions{
+						Extensions: []string{"ext1", "ext2"},
+					},
+				}
+
+				err := c.MigrateExtensions(options)
+				Expect(err).ToNot(HaveOccurred())
+
+				extensionOutput, err := ioutil.ReadFile(filepath.Join(appRoot, ".php.ini.d", "compat-extensions.ini"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(string(extensionOutput)).To(ContainSubstring("extension=ext1.so"))
+				Expect(string(extensionOutput)).To(ContainSubstring("extension=ext2.so"))
+			})
+
+			it("migrates ZEND_EXTENSIONS", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				options := Options{
+					PHP: PHPOptions{
+						ZendExtensions: []string{"zext1", "zext2"},
+					},
+				}
+
+				err := c.MigrateExtensions(options)
+				Expect(err).ToNot(HaveOccurred())
+
+				extensionOutput, err := ioutil.ReadFile(filepath.Join(appRoot, ".php.ini.d", "compat-extensions.ini"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(string(extensionOutput)).To(ContainSubstring("zend_extension=zext1.so"))
+				Expect(string(extensionOutput)).To(ContainSubstring("zend_extension=zext2.so"))
+			})
+
+			when("the buildpack has an extension catalog", func() {
+				var catalog ExtensionCatalog
+
+				it.Before(func() {
+					bp, err := libbuildpack.New("..", bplog.Logger{})
+					Expect(err).ToNot(HaveOccurred())
+
+					catalog, err = NewExtensionCatalog(bp.Metadata)
+					Expect(err).ToNot(HaveOccurred())
+				})
+
+				it("accepts every extension of the all modules fixture on PHP 7.2", func() {
+					contents, err := ioutil.ReadFile(filepath.Join("..", "integration", "testdata", "php_all_modules", ".bp-config", "options.json"))
+					Expect(err).ToNot(HaveOccurred())
+
+					var fixture struct {
+						Extensions     []string `json:"PHP_EXTENSIONS"`
+						ZendExtensions []string `json:"ZEND_EXTENSIONS"`
+					}
+					Expect(json.Unmarshal(contents, &fixture)).To(Succeed())
+
+					Expect(catalog.Check("7.2.*", fixture.Extensions, fixture.ZendExtensions)).To(BeEmpty())
+				})
+
+				it("fails on removed, misspelled and misplaced extensions with suggestions", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog})
+
+					err := c.MigrateExtensions(Options{PHP: PHPOptions{Version: "7.4.*", Extensions: []string{"bz2", "mcrypt", "memcahced", "xdebug"}}})
+					Expect(err).To(MatchError(ContainSubstring("PHP_EXTENSIONS `mcrypt` is not available in PHP 7.4, use `sodium` or `openssl` instead")))
+					Expect(err).To(MatchError(ContainSubstring("PHP_EXTENSIONS `memcahced` is not available in PHP 7.4, did you mean `memcached`?")))
+					Expect(err).To(MatchError(ContainSubstring("PHP_EXTENSIONS `xdebug` is not available in PHP 7.4, list it in ZEND_EXTENSIONS instead")))
+					Expect(err).ToNot(MatchError(ContainSubstring("bz2")))
+
+					Expect(filepath.Join(appRoot, ".php.ini.d", "compat-extensions.ini")).ToNot(BeAnExistingFile())
+				})
+
+				it("suggests the replacement of mcrypt from PHP 7.2 on", func() {
+					Expect(catalog.Check("7.1.*", []string{"mcrypt"}, nil)).To(BeEmpty())
+					Expect(catalog.Check("7.2.*", []string{"mcrypt"}, nil)).To(Equal([]string{"PHP_EXTENSIONS `mcrypt` is not available in PHP 7.2, use `sodium` or `openssl` instead, or the phpseclib/mcrypt_compat Composer package"}))
+				})
+
+				it("checks every PHP version the constraint allows", func() {
+					Expect(catalog.Check(">= 7.3", []string{"wddx"}, nil)).To(Equal([]string{"PHP_EXTENSIONS `wddx` is not available in PHP 7.4, 8.0, serialize with `json_encode` or `igbinary` instead"}))
+					Expect(catalog.Check(">= 7.1, < 7.4", []string{"wddx"}, nil)).To(BeEmpty())
+					Expect(catalog.Check("8.0.1", nil, []string{"ioncube"})).To(HaveLen(1))
+					Expect(catalog.Check("9.1.*", []string{"anything"}, nil)).To(BeEmpty())
+				})
+
+				it("normalises names, drops built in extensions and loads dependencies first", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog})
+
+					err := c.MigrateExtensions(Options{PHP: PHPOptions{
+						Version:        "7.3.*",
+						Extensions:     []string{"Redis", "apcu_bc", "json", "redis.so", " igbinary ", "apcu", "bz2"},
+						ZendExtensions: []string{"xdebug", "ioncube"},
+					}})
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.ini.d", "compat-extensions.ini"))).To(Equal([]byte(`extension=igbinary.so
+extension=redis.so
+extension=apcu.so
+extension=apcu_bc.so
+extension=bz2.so
+zend_extension=ioncube.so
+zend_extension=xdebug.so
+`)))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "extensions", Outcome: OutcomeWarning, File: ".bp-config/options.json", Key: "PHP_EXTENSIONS", Action: "built in `json` dropped"}))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "extensions", Outcome: OutcomeWarning, File: ".bp-config/options.json", Key: "PHP_EXTENSIONS", Action: "duplicate `redis.so` dropped"}))
+				})
+
+				it("checks the default PHP version when PHP_VERSION is not set", func() {
+					Expect(catalog.Default).To(Equal("7.4"))
+					Expect(catalog.Check("", []string{"wddx"}, nil)).To(Equal([]string{"PHP_EXTENSIONS `wddx` is not available in PHP 7.4, serialize with `json_encode` or `igbinary` instead"}))
+					Expect(catalog.Check("", []string{"sodium"}, nil)).To(BeEmpty())
+
+					catalog.Default = ""
+					Expect(catalog.Check("", []string{"wddx"}, nil)).To(BeEmpty())
+				})
+
+				it("fails on a PHP_VERSION that is not a valid version constraint", func() {
+					_, err := catalog.Check("seven", []string{"bz2"}, nil)
+					Expect(err).To(MatchError(HavePrefix("PHP_VERSION `seven` is not a valid version constraint: ")))
+
+					c := newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog})
+					Expect(c.MigrateExtensions(Options{PHP: PHPOptions{Version: "seven", Extensions: []string{"bz2"}}})).To(MatchError(HavePrefix("PHP_VERSION `seven`")))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "extensions", Outcome: OutcomeFailed, File: ".bp-config/options.json", Key: "PHP_VERSION", Action: "build failed, not a valid version constraint"}))
+				})
+
+				it("rejects a malformed catalog", func() {
+					_, err := NewExtensionCatalog(buildpack.Metadata{ExtensionCatalogMetadata: map[string]interface{}{
+						"versions": map[string]interface{}{"7": map[string]interface{}{}},
+					}})
+					Expect(err).To(MatchError(ContainSubstring("must be named after a PHP minor version")))
+
+					_, err = NewExtensionCatalog(buildpack.Metadata{ExtensionCatalogMetadata: map[string]interface{}{
+						"default":  "7.2",
+						"versions": map[string]interface{}{"7.3": map[string]interface{}{}},
+					}})
+					Expect(err).To(MatchError("buildpack metadata php-extensions.default must be one of the versions in php-extensions.versions, found 7.2"))
+				})
+			})
+		})
+
+		when("a .bp-config/nginx configuration exists", func() {
+			writeNginx := func(name string, contents string) {
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "nginx", name), 0644, contents)).To(Succeed())
+			}
+
+			it("translates the directives nginx still needs into http and server level includes", func() {
+				writeNginx("nginx.conf", `daemon off;
+error_log stderr notice;
+pid @{HOME}/nginx/logs/nginx.pid;
+
+worker_processes auto;
+events {
+    worker_connections 1024;
+}
+
+http {
+    include nginx-defaults.conf;
+    include nginx-logging.conf;
+    include http-*.conf;
+
+    server {
+        listen @{PORT};
+        root @{HOME}/#{WEBDIR};
+
+        include server-*.conf;
+    }
+}
+`)
+				writeNginx("nginx-defaults.conf", "server_tokens off;\nclient_max_body_size 64m; # uploads\n")
+				writeNginx("server-locations.conf", `location / {
+    try_files $uri $uri/ /index.php?$query_string;
+}
+
+location ~ ^/legacy/(.*)$ {
+    rewrite ^/legacy/(.*)$ /$1 permanent;
+}
+`)
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				Expect(c.MigrateNginxConf(Options{})).To(Succeed())
+
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, ".nginx.conf.d", "00-compat-http.conf"))).To(Equal([]byte(`# Migrated from .bp-config/nginx, the http level directives that the PHP web buildpack does not already set
+
+# From .bp-config/nginx/nginx-defaults.conf
+client_max_body_size 64m;
+`)))
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, ".nginx.conf.d", "00-compat-server.conf"))).To(Equal([]byte(`# Migrated from .bp-config/nginx, the server level directives that the PHP web buildpack does not already set
+
+# From .bp-config/nginx/server-locations.conf
+location / {
+    try_files $uri $uri/ /index.php?$query_string;
+}
+location ~ ^/legacy/(.*)$ {
+    rewrite ^/legacy/(.*)$ /$1 permanent;
+}
+`)))
+
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "custom-nginx", Outcome: OutcomePassed, File: ".bp-config/nginx/nginx.conf", Action: "nothing to migrate, the PHP web buildpack already configures nginx the same way"}))
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "custom-nginx", Outcome: OutcomeMigrated, File: ".bp-config/nginx/server-locations.conf", Action: "2 directive(s) written to .nginx.conf.d"}))
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "custom-nginx", Outcome: OutcomeWarning, File: ".bp-config/nginx/nginx.conf", Key: "root", Action: "dropped, the PHP web buildpack already serves WEBDIR"}))
+				Expect(findingKeys(c.report.Findings)).To(ConsistOf("daemon", "error_log", "pid", "worker_processes", "events", "listen", "root"))
+				Expect(c.report.GeneratedFiles).To(Equal([]string{".nginx.conf.d/00-compat-http.conf", ".nginx.conf.d/00-compat-server.conf"}))
+			})
+
+			it("only translates the files nginx.conf includes, as v2 never loaded the others", func() {
+				writeNginx("server-custom.conf", "location /bar { return 410; }\n")
+				writeNginx("unused.conf", "location /foo { return 404; }\n")
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				Expect(c.MigrateNginxConf(Options{})).To(Succeed())
+				Expect(c.InventoryBPConfig()).To(Succeed())
+
+				contents, err := ioutil.ReadFile(filepath.Join(appRoot, ".nginx.conf.d", "00-compat-server.conf"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(contents)).To(ContainSubstring("location /bar"))
+				Expect(string(contents)).ToNot(ContainSubstring("location /foo"))
+				Expect(c.report.Inventory).To(ContainElement(InventoryItem{File: ".bp-config/nginx/unused.conf", Classification: ClassIgnored, Reason: "not included from the stock v2 nginx.conf, v2 never loaded it"}))
+			})
+
+			it("fails on the directives that clash with the PHP web buildpack, with their file and line", func() {
+				writeNginx("nginx.conf", "load_module modules/ngx_http_geoip_module.so;\nhttp {\n    include http-*.conf;\n    server {\n        include server-*.conf;\n    }\n}\n")
+				writeNginx("server-custom.conf", `listen 8080;
+root /srv/www;
+location ~ \.php$ {
+    fastcgi_pass php_fpm;
+}
+`)
+				writeNginx("http-php.conf", `upstream php_fpm {
+    server unix:#{PHP_FPM_LISTEN};
+    keepalive 8;
+}
+`)
+				writeNginx("http-broken.conf", "gzip on\n")
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				err := c.MigrateNginxConf(Options{})
+
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/nginx/nginx.conf line 1: `load_module` belongs outside of the `http` block, which the v3 includes cannot reach")))
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/nginx/server-custom.conf line 1: the PHP web buildpack listens on $PORT, where the platform sends requests")))
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/nginx/server-custom.conf line 2: the PHP web buildpack serves WEBDIR, set WEBDIR in options.json to change it")))
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/nginx/server-custom.conf line 4: the PHP web buildpack passes PHP requests to PHP-FPM itself")))
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/nginx/http-php.conf line 1: the PHP web buildpack passes PHP requests to PHP-FPM itself")))
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/nginx/http-broken.conf line 1: `gzip` is missing its closing `;`")))
+				Expect(err).To(MatchError(ContainSubstring("--- a/.bp-config/nginx/http-php.conf\n+++ b/.bp-config/nginx/http-php.conf\n@@ -1,3 +1,4 @@\n upstream php_fpm {\n server unix:#{PHP_FPM_LISTEN};\n+keepalive 8;\n }\n")))
+				Expect(err).ToNot(MatchError(ContainSubstring("+++ b/.bp-config/nginx/http-broken.conf")))
+				Expect(filepath.Join(appRoot, ".nginx.conf.d")).ToNot(BeAnExistingFile())
+			})
+
+			it("drops the stock v2 blocks that point at PHP-FPM from changed files", func() {
+				writeNginx("server-locations.conf", `location ~ .*\.php$ {
+    try_files $uri =404;
+    include fastcgi_params;
+    fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+    fastcgi_pass php_fpm;
+}
+
+location /status {
+    return 200;
+}
+`)
+				writeNginx("http-php.conf", `upstream php_fpm {
+    server unix:#{PHP_FPM_LISTEN};
+}
+
+client_max_body_size 20m;
+`)
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				Expect(c.MigrateNginxConf(Options{})).To(Succeed())
+
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, ".nginx.conf.d", "00-compat-server.conf"))).ToNot(ContainSubstring("php_fpm"))
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, ".nginx.conf.d", "00-compat-http.conf"))).To(ContainSubstring("client_max_body_size 20m;"))
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "custom-nginx", Outcome: OutcomeWarning, File: ".bp-config/nginx/http-php.conf", Key: "upstream", Action: "dropped, the PHP web buildpack passes PHP requests to PHP-FPM itself, as the stock v2 configuration did"}))
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "custom-nginx", Outcome: OutcomeWarning, File: ".bp-config/nginx/server-locations.conf", Key: "location", Action: "dropped, the PHP web buildpack passes PHP requests to PHP-FPM itself, as the stock v2 configuration did"}))
+			})
+
+			it("only warns about unchanged copies of the stock v2 files", func() {
+				writeNginx("http-php.conf", `# php-fpm upstream
+upstream   php_fpm {
+
+  server unix:#{PHP_FPM_LISTEN};
+}
+`)
+				writeNginx("nginx-gzip.conf", "gzip on;\n")
+				// as shipped before the access log had the request id of the router
+				writeNginx("nginx-logging.conf", `log_format common '$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent';
+access_log /dev/stdout common;
+`)
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				Expect(c.MigrateNginxConf(Options{})).To(Succeed())
+
+				Expect(c.report.Findings).To(ConsistOf(
+					Finding{Rule: "custom-nginx", Outcome: OutcomeWarning, File: ".bp-config/nginx/http-php.conf", Action: "unchanged stock v2 file, can be deleted"},
+					Finding{Rule: "custom-nginx", Outcome: OutcomeWarning, File: ".bp-config/nginx/nginx-gzip.conf", Action: "unchanged stock v2 file, can be deleted"},
+					Finding{Rule: "custom-nginx", Outcome: OutcomeWarning, File: ".bp-config/nginx/nginx-logging.conf", Action: "unchanged stock v2 file, can be deleted"},
+				))
+				Expect(filepath.Join(appRoot, ".nginx.conf.d")).ToNot(BeAnExistingFile())
+			})
+
+			it("passes when there is no configuration", func() {
+				writeNginx("mime.types", "types {}")
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				Expect(c.MigrateNginxConf(Options{})).To(Succeed())
+				Expect(c.report.Findings).To(Equal([]Finding{{Rule: "custom-nginx", Outcome: OutcomePassed, Action: "no Nginx configuration under .bp-config/nginx"}}))
+			})
+		})
+
+		when("a .bp-config/httpd configuration exists", func() {
+			writeHTTPD := func(name string, contents string) {
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "httpd", name), 0644, contents)).To(Succeed())
+			}
+
+			it("translates the directives httpd still needs into the user include", func() {
+				writeHTTPD("httpd.conf", `ServerRoot "${HOME}/httpd"
+Listen ${PORT}
+ServerAdmin "${HTTPD_SERVER_ADMIN}"
+ServerName "0.0.0.0"
+DocumentRoot "${HOME}/#{WEBDIR}"
+Include conf/extra/httpd-modules.conf
+Include conf/extra/httpd-directories.conf
+Include conf/extra/httpd-mime.conf
+Include conf/extra/httpd-headers.conf
+Include conf/extra/httpd-php.conf
+
+RewriteEngine On
+RewriteRule ^/old$ /new [R=301,L]
+`)
+				writeHTTPD("extra/httpd-modules.conf", `LoadModule authz_core_module modules/mod_authz_core.so
+LoadModule expires_module modules/mod_expires.so
+#LoadModule status_module modules/mod_status.so
+`)
+				writeHTTPD("extra/httpd-directories.conf", `<Directory />
+    AllowOverride none
+    Require all denied
+</Directory>
+`)
+				writeHTTPD("extra/httpd-headers.conf", `<IfModule headers_module>
+    Header always set X-Frame-Options "SAMEORIGIN"
+</IfModule>
+DirectoryIndex index.php index.html
+`)
+				writeHTTPD("extra/httpd-php.conf", `DirectoryIndex index.php index.html index.htm
+
+Define fcgi-listener fcgi://#{PHP_FPM_LISTEN}${HOME}/#{WEBDIR}
+
+<Proxy "${fcgi-listener}">
+    ProxySet disablereuse=On retry=0
+</Proxy>
+
+<Directory "${HOME}/#{WEBDIR}">
+  <Files *.php>
+      <If "-f %{REQUEST_FILENAME}">
+          SetHandler proxy:fcgi://#{PHP_FPM_LISTEN}
+      </If>
+  </Files>
+</Directory>
+`)
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				Expect(c.MigrateHTTPDConf(Options{})).To(Succeed())
+
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, ".httpd.conf.d", "00-compat-httpd.conf"))).To(Equal([]byte(`# Migrated from .bp-config/httpd, only the directives that the PHP web buildpack does not already set
+
+# From .bp-config/httpd/extra/httpd-modules.conf
+LoadModule expires_module modules/mod_expires.so
+
+# From .bp-config/httpd/extra/httpd-headers.conf
+<IfModule headers_module>
+    Header always set X-Frame-Options "SAMEORIGIN"
+</IfModule>
+DirectoryIndex index.php index.html
+
+# From .bp-config/httpd/httpd.conf
+RewriteEngine On
+RewriteRule ^/old$ /new [R=301,L]
+`)))
+
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "custom-httpd", Outcome: OutcomeMigrated, File: ".bp-config/httpd/httpd.conf", Action: "2 directive(s) written to .httpd.conf.d/00-compat-httpd.conf"}))
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "custom-httpd", Outcome: OutcomePassed, File: ".bp-config/httpd/extra/httpd-directories.conf", Action: "nothing to migrate, the PHP web buildpack already configures httpd the same way"}))
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "custom-httpd", Outcome: OutcomeWarning, File: ".bp-config/httpd/extra/httpd-php.conf", Key: "SetHandler", Action: "dropped, the PHP web buildpack connects httpd to PHP-FPM"}))
+				Expect(findingKeys(c.report.Findings)).To(ConsistOf("ServerRoot", "ServerAdmin", "Define", "Proxy", "SetHandler"))
+				Expect(c.report.GeneratedFiles).To(Equal([]string{".httpd.conf.d/00-compat-httpd.conf"}))
+			})
+
+			it("only translates the files httpd.conf includes, as v2 never loaded the others", func() {
+				writeHTTPD("extra/httpd-default.conf", "Timeout 120\n")
+				writeHTTPD("extra/unused.conf", "Header set X-Unused yes\n")
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				Expect(c.MigrateHTTPDConf(Options{})).To(Succeed())
+				Expect(c.InventoryBPConfig()).To(Succeed())
+
+				contents, err := ioutil.ReadFile(filepath.Join(appRoot, ".httpd.conf.d", "00-compat-httpd.conf"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(contents)).To(ContainSubstring("Timeout 120"))
+				Expect(string(contents)).ToNot(ContainSubstring("X-Unused"))
+				Expect(c.report.Inventory).To(ContainElement(InventoryItem{File: ".bp-config/httpd/extra/unused.conf", Classification: ClassIgnored, Reason: "not included from the stock v2 httpd.conf, v2 never loaded it"}))
+
+				writeHTTPD("httpd.conf", "Include conf/extra/unused.conf\n")
+
+				c = newMigration(OSFileSystem{}, appRoot, Config{})
+				Expect(c.MigrateHTTPDConf(Options{})).To(Succeed())
+				Expect(c.InventoryBPConfig()).To(Succeed())
+
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, ".httpd.conf.d", "00-compat-httpd.conf"))).To(ContainSubstring("Header set X-Unused yes"))
+				Expect(c.report.Inventory).To(ContainElement(InventoryItem{File: ".bp-config/httpd/extra/httpd-default.conf", Classification: ClassIgnored, Reason: "not included from httpd.conf, v2 never loaded it"}))
+			})
+
+			it("fails on the directives that cannot work with v3, with their file and line", func() {
+				writeHTTPD("httpd.conf", `Listen 8080
+LoadModule mpm_prefork_module modules/mod_mpm_prefork.so
+LoadModule custom_module /home/vcap/app/mod_custom.so
+Header set X-Tmp "@{TMP}"
+Include conf/extra/httpd-broken.conf
+`)
+				writeHTTPD("extra/httpd-broken.conf", "<IfModule headers_module>\n")
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				err := c.MigrateHTTPDConf(Options{})
+
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/httpd/httpd.conf line 1: httpd must listen on $PORT, where the platform sends requests")))
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/httpd/httpd.conf line 2: httpd-cnb runs the event MPM, `mpm_prefork_module` cannot be loaded alongside it")))
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/httpd/httpd.conf line 3: `/home/vcap/app/mod_custom.so` is not bundled with httpd-cnb")))
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/httpd/httpd.conf line 4: `@{TMP}` is not a known placeholder")))
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/httpd/extra/httpd-broken.conf line 1: `<IfModule>` is never closed")))
+				Expect(filepath.Join(appRoot, ".httpd.conf.d")).ToNot(BeAnExistingFile())
+			})
+
+			it("recognizes unchanged copies of the files older v2 releases shipped", func() {
+				writeHTTPD("httpd.conf", `ServerRoot "${HOME}/httpd"
+Listen ${PORT}
+ServerAdmin "${HTTPD_SERVER_ADMIN}"
+ServerName "0.0.0.0"
+DocumentRoot "${HOME}/#{WEBDIR}"
+Include conf/extra/httpd-modules.conf
+Include conf/extra/httpd-directories.conf
+Include conf/extra/httpd-mime.conf
+Include conf/extra/httpd-deflate.conf
+Include conf/extra/httpd-logging.conf
+Include conf/extra/httpd-mpm.conf
+Include conf/extra/httpd-default.conf
+Include conf/extra/httpd-remoteip.conf
+Include conf/extra/httpd-php.conf
+`)
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				Expect(c.MigrateHTTPDConf(Options{})).To(Succeed())
+
+				Expect(c.report.Findings).To(ConsistOf(
+					Finding{Rule: "custom-httpd", Outcome: OutcomeWarning, File: ".bp-config/httpd/httpd.conf", Action: "unchanged stock v2 file, can be deleted"},
+				))
+				Expect(filepath.Join(appRoot, ".httpd.conf.d")).ToNot(BeAnExistingFile())
+			})
+
+			it("only warns about unchanged copies of the stock v2 files and diffs the changed ones that fail", func() {
+				writeHTTPD("extra/httpd-remoteip.conf", `# Trust the platform's routers
+RemoteIpHeader   x-forwarded-for
+RemoteIpInternalProxy 10.0.0.0/8 172.16.0.0/12 192.168.0.0/16
+
+SetEnvIf x-forwarded-proto https HTTPS=on
+`)
+				writeHTTPD("extra/httpd-mpm.conf", `<IfModule mpm_event_module>
+    StartServers             3
+    MinSpareThreads         75
+    MaxSpareThreads        250
+    ThreadsPerChild         25
+    MaxRequestWorkers      400
+    MaxConnectionsPerChild   0
+</IfModule>
+LoadModule mpm_worker_module modules/mod_mpm_worker.so
+`)
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				err := c.MigrateHTTPDConf(Options{})
+
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/httpd/extra/httpd-mpm.conf line 9: httpd-cnb runs the event MPM")))
+				Expect(err).To(MatchError(ContainSubstring("+++ b/.bp-config/httpd/extra/httpd-mpm.conf\n@@ -6,3 +6,4 @@\n MaxRequestWorkers 400\n MaxConnectionsPerChild 0\n </IfModule>\n+LoadModule mpm_worker_module modules/mod_mpm_worker.so\n")))
+				Expect(err).ToNot(MatchError(ContainSubstring("httpd-remoteip.conf")))
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "custom-httpd", Outcome: OutcomeWarning, File: ".bp-config/httpd/extra/httpd-remoteip.conf", Action: "unchanged stock v2 file, can be deleted"}))
+			})
+
+			it("passes when there is no configuration", func() {
+				writeHTTPD("README.md", "notes")
+
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+				Expect(c.MigrateHTTPDConf(Options{})).To(Succeed())
+				Expect(c.report.Findings).To(Equal([]Finding{{Rule: "custom-httpd", Outcome: OutcomePassed, Action: "no HTTPD configuration under .bp-config/httpd"}}))
+			})
+		})
+
+		when(".bp-config/php/ exists", func() {
+			it("subfolder php.ini.d contains *.ini files", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+				err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "test.ini"), 0644, "contents")
+				Expect(err).ToNot(HaveOccurred())
+				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "another.ini"), 0644, "more contents")
+				Expect(err).ToNot(HaveOccurred())
+
+				err = c.MigratePHPSnippets(Options{}, "PHP INI", "php.ini.d", ".php.ini.d", "ini")
+
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(filepath.Join(appRoot, ".php.ini.d", "00-v2-test.ini")).To(BeARegularFile())
+				Expect(filepath.Join(appRoot, ".php.ini.d", "00-v2-another.ini")).To(BeARegularFile())
+			})
+
+			it("subfolder fpm.d contains *.conf files", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+				err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "fpm.d", "test.conf"), 0644, "contents")
+				Expect(err).ToNot(HaveOccurred())
+				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "fpm.d", "another.conf"), 0644, "more contents")
+				Expect(err).ToNot(HaveOccurred())
+
+				err = c.MigratePHPSnippets(Options{}, "PHP-FPM", "fpm.d", ".php.fpm.d", "conf")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(filepath.Join(appRoot, ".php.fpm.d", "00-v2-test.conf")).To(BeARegularFile())
+				Expect(filepath.Join(appRoot, ".php.fpm.d", "00-v2-another.conf")).To(BeARegularFile())
+			})
+
+			it("leaves snippets in subdirectories and identical files alone", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "extra", "tuning.ini"), 0644, "memory_limit = 1G\n")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "custom.ini"), 0644, "expose_php = On\n")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".php.ini.d", "00-v2-custom.ini"), 0644, "expose_php = On\n")).To(Succeed())
+
+				Expect(c.MigratePHPSnippets(Options{}, "PHP INI", "php.ini.d", ".php.ini.d", "ini")).To(Succeed())
+
+				Expect(filepath.Join(appRoot, ".php.ini.d", "00-v2-extra-tuning.ini")).ToNot(BeAnExistingFile())
+				Expect(filepath.Join(appRoot, ".php.ini.d", "extra")).ToNot(BeAnExistingFile())
+				Expect(findingKeys(c.report.Findings)).To(BeEmpty())
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "php-ini-snippets", Outcome: OutcomePassed, File: ".bp-config/php/php.ini.d/custom.ini", Action: "already migrated to .php.ini.d/00-v2-custom.ini"}))
+				Expect(c.report.GeneratedFiles).To(BeEmpty())
+			})
+
+			when("a snippet would replace a different file", func() {
+				it.Before(func() {
+					Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "fpm.d", "pool.conf"), 0644, "[www]\npm.max_children = 20\n")).To(Succeed())
+					Expect(helper.WriteFile(filepath.Join(appRoot, ".php.fpm.d", "00-v2-pool.conf"), 0644, "[www]\npm.max_children = 10\n")).To(Succeed())
+				})
+
+				it("fails by default and leaves the existing file alone", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := c.MigratePHPSnippets(Options{}, "PHP-FPM", "fpm.d", ".php.fpm.d", "conf")
+					Expect(err).To(MatchError(ContainSubstring(".bp-config/php/fpm.d/pool.conf would replace .php.fpm.d/00-v2-pool.conf, which has different contents")))
+					Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.fpm.d", "00-v2-pool.conf"))).To(ContainSubstring("= 10"))
+				})
+
+				it("keeps or replaces the existing file as the snippet conflict policy says", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{SnippetConflicts: KeepExistingSnippets})
+					Expect(c.MigratePHPSnippets(Options{}, "PHP-FPM", "fpm.d", ".php.fpm.d", "conf")).To(Succeed())
+					Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.fpm.d", "00-v2-pool.conf"))).To(ContainSubstring("= 10"))
+
+					c = newMigration(OSFileSystem{}, appRoot, Config{SnippetConflicts: ReplaceExistingSnippets})
+					Expect(c.MigratePHPSnippets(Options{}, "PHP-FPM", "fpm.d", ".php.fpm.d", "conf")).To(Succeed())
+					Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.fpm.d", "00-v2-pool.conf"))).To(ContainSubstring("= 20"))
+				})
+			})
+
+			it("expands v2 placeholders in snippets", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{ApplicationPath: "/workspace"})
+
+				err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "paths.ini"), 0644, `; @{HOME} is the application
+include_path = "@{HOME}/{LIBDIR}:#{HOME}/vendor"
+session.save_path = "{TMPDIR}/sessions"
+open_basedir = "@{HOME}/#{WEBDIR}:${HOME}"
+error_log = "#{LOG_DIR}/php.log"
+`)
+				Expect(err).ToNot(HaveOccurred())
+
+				err = c.MigratePHPSnippets(Options{PHP: PHPOptions{WebDir: "public"}}, "PHP INI", "php.ini.d", ".php.ini.d", "ini")
 				Expect(err).ToNot(HaveOccurred())
-				defer os.RemoveAll(filepath.Join(appRoot, ".bp-config"))
 
-				options, err := LoadOptionsJSON(appRoot)
-				Expect(err).ToNot(HaveOccurred())
-				Expect(options.PHP.Version).To(Equal("7.3.*"))
-			})
-			it("loads PHP_74_LATEST", func() {
-				json := `{"PHP_VERSION": "{PHP_74_LATEST}"}`
-				err := writeOptionsJSON(appRoot, json)
-				Expect(err).ToNot(HaveOccurred())
-				defer os.RemoveAll(filepath.Join(appRoot, ".bp-config"))
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.ini.d", "00-v2-paths.ini"))).To(Equal([]byte(`; @{HOME} is the application
+include_path = "/workspace/lib:/workspace/vendor"
+session.save_path = "/tmp/sessions"
+open_basedir = "/workspace/public:${HOME}"
+error_log = "${LOG_DIR}/php.log"
+`)))
+				Expect(c.report.Findings).To(ContainElement(Finding{Rule: "php-ini-snippets", Outcome: OutcomeMigrated, File: ".bp-config/php/php.ini.d/paths.ini", Action: "copied to .php.ini.d/00-v2-paths.ini, expanding 7 placeholder(s)"}))
+			})
+
+			it("fails on placeholders it cannot translate, with the file and line", func() {
+				c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+				err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "fpm.d", "www.conf"), 0644, "[www]\nlisten = #{PHP_FPM_LISTEN}\nchdir = @{APP_ROOT}\n")
+				Expect(err).ToNot(HaveOccurred())
+
+				err = c.MigratePHPSnippets(Options{}, "PHP-FPM", "fpm.d", ".php.fpm.d", "conf")
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/php/fpm.d/www.conf line 2: `#{PHP_FPM_LISTEN}` cannot be translated")))
+				Expect(err).To(MatchError(ContainSubstring(".bp-config/php/fpm.d/www.conf line 3: `@{APP_ROOT}` is not a known placeholder")))
+
+				Expect(filepath.Join(appRoot, ".php.fpm.d", "www.conf")).ToNot(BeAnExistingFile())
+			})
+
+			when("and contains a full php.ini", func() {
+				it("keeps only the settings that differ from the stock php.ini", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{ApplicationPath: "/workspace"})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini"), 0644, `[PHP]
+; Quick Reference
+short_open_tag = Off
+memory_limit = 128M
+memory_limit = 512M ; raised for imports
+display_errors = off
+expose_php = On
+include_path = ".:/usr/share/php:@{HOME}/lib"
+extension_dir = "@{HOME}/php/lib/php/extensions/no-debug-non-zts-20170718"
+#{PHP_EXTENSIONS}
+extension=bz2.so
+extension=imagick.so
+upload_max_filesize = 2M
+
+[Date]
+date.timezone = "Europe/Paris"
+
+[PATH=@{HOME}/htdocs/admin]
+upload_max_filesize = 64M
+`)
+					Expect(err).ToNot(HaveOccurred())
+
+					err = c.MigratePHPIni(Options{PHP: PHPOptions{Version: "7.3.*", Extensions: []string{"bz2"}}})
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.ini.d", "00-compat-php-ini.ini"))).To(Equal([]byte(`; Migrated from .bp-config/php/php.ini, only the settings that differ from the stock php.ini
+memory_limit = 512M
+expose_php = On
+extension = imagick.so
+date.timezone = "Europe/Paris"
+[PATH=/workspace/htdocs/admin]
+upload_max_filesize = 64M
+`)))
+
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "php-ini", Outcome: OutcomeWarning, File: ".bp-config/php/php.ini", Key: "extension_dir", Action: "not migrated, extensions are installed and found by the PHP buildpack"}))
+					Expect(findingKeys(c.report.Findings)).To(ContainElement("include_path"))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "php-ini", Outcome: OutcomeMigrated, File: ".bp-config/php/php.ini", Action: "changed settings written to .php.ini.d/00-compat-php-ini.ini"}))
+					Expect(c.report.GeneratedFiles).To(Equal([]string{".php.ini.d/00-compat-php-ini.ini"}))
+				})
+
+				it("reports directives the selected PHP version removed", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini"), 0644, "track_errors = On\nmbstring.func_overload = 2\nasp_tags = On\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(c.MigratePHPIni(Options{PHP: PHPOptions{Version: "7.4.*"}})).To(Succeed())
+					Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.ini.d", "00-compat-php-ini.ini"))).To(HaveSuffix("\ntrack_errors = On\nmbstring.func_overload = 2\n"))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "php-ini", Outcome: OutcomeWarning, File: ".bp-config/php/php.ini", Key: "asp_tags", Action: "not migrated, removed in PHP 7.0"}))
+
+					c = newMigration(OSFileSystem{}, appRoot, Config{})
+					Expect(c.MigratePHPIni(Options{PHP: PHPOptions{Version: "8.0.*"}})).To(Succeed())
+					Expect(findingKeys(c.report.Findings)).To(ConsistOf("track_errors", "mbstring.func_overload", "asp_tags"))
+
+					c = newMigration(OSFileSystem{}, appRoot, Config{Extensions: ExtensionCatalog{Default: "8.0"}})
+					Expect(c.MigratePHPIni(Options{})).To(Succeed())
+					Expect(findingKeys(c.report.Findings)).To(ConsistOf("track_errors", "mbstring.func_overload", "asp_tags"))
+				})
+
+				it("writes nothing when the php.ini matches the stock one", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini"), 0644, "[PHP]\nmemory_limit = 128M\nshort_open_tag = 0\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(c.MigratePHPIni(Options{})).To(Succeed())
+					Expect(filepath.Join(appRoot, ".php.ini.d")).ToNot(BeAnExistingFile())
+					Expect(c.report.Findings).To(Equal([]Finding{{Rule: "php-ini", Outcome: OutcomePassed, File: ".bp-config/php/php.ini", Action: "matches the stock php.ini, nothing to migrate"}}))
+				})
+
+				it("only fails on placeholders in the directives it migrates", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini"), 0644, "extension_dir = #{PHP_FPM_LISTEN}\n[PATH=@{APP_ROOT}]\nmemory_limit = 512M\nupload_max_filesize = 8M\nerror_log = @{APP_ROOT}/php.log\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					err = c.MigratePHPIni(Options{})
+					Expect(err).To(MatchError("unable to migrate `.bp-config/php/php.ini`:\n  section `[PATH=@{APP_ROOT}]`: `@{APP_ROOT}` is not a known placeholder, expected one of `{HOME}`, `{WEBDIR}`, `{LIBDIR}` or `{TMPDIR}`\n  line 5: `@{APP_ROOT}` is not a known placeholder, expected one of `{HOME}`, `{WEBDIR}`, `{LIBDIR}` or `{TMPDIR}`"))
+					Expect(filepath.Join(appRoot, ".php.ini.d")).ToNot(BeAnExistingFile())
+				})
+
+				it("fails on lines it cannot read, with the line", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini"), 0644, "[PHP\nmemory_limit 512M\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					err = c.MigratePHPIni(Options{})
+					Expect(err).To(MatchError(ContainSubstring("line 1: section `[PHP` is missing its closing `]`")))
+					Expect(err).To(MatchError(ContainSubstring("line 2: expected `key = value`, found `memory_limit 512M`")))
+				})
+			})
+
+			when("the migrated snippets are validated", func() {
+				it("reports duplicated directives with their files and fails on conflicting values", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "a.ini"), 0644, "memory_limit = 256M\nextension=bz2.so\n[PATH=/workspace/htdocs]\nupload_max_filesize = 8M\n")
+					Expect(err).ToNot(HaveOccurred())
+					err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "b.ini"), 0644, "[PHP]\nmemory_limit = 512M\nupload_max_filesize = 2M\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(c.MigratePHPSnippets(Options{}, "PHP INI", "php.ini.d", ".php.ini.d", "ini")).To(Succeed())
+					Expect(c.MigrateExtensions(Options{PHP: PHPOptions{Extensions: []string{"bz2"}}})).To(Succeed())
+
+					err = c.ValidateSnippets(Options{})
+					Expect(err).To(MatchError(ContainSubstring("`memory_limit` has conflicting values in .php.ini.d/00-v2-a.ini line 1, .php.ini.d/00-v2-b.ini line 2")))
+					Expect(err).ToNot(MatchError(ContainSubstring("upload_max_filesize")))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "snippet-validation", Outcome: OutcomeWarning, File: ".php.ini.d/00-v2-a.ini", Key: "extension=bz2", Action: "duplicated in .php.ini.d/00-v2-a.ini line 2, .php.ini.d/compat-extensions.ini line 1"}))
+				})
+
+				it("fails on syntax errors with the file and line", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "fpm.d", "pool.conf"), 0644, "[www\npm.max_children = \"20\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(c.MigratePHPSnippets(Options{}, "PHP-FPM", "fpm.d", ".php.fpm.d", "conf")).To(Succeed())
+
+					err = c.ValidateSnippets(Options{})
+					Expect(err).To(MatchError(ContainSubstring(".php.fpm.d/00-v2-pool.conf line 1: section `[www` is missing its closing `]`")))
+					Expect(err).To(MatchError(ContainSubstring(".php.fpm.d/00-v2-pool.conf line 2: value `\"20` is missing its closing \"")))
+				})
+
+				it("leaves out the snippets in subdirectories, which v2 did not load", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "a.ini"), 0644, "memory_limit = 256M\n")
+					Expect(err).ToNot(HaveOccurred())
+					err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "sub", "b.ini"), 0644, "memory_limit = 1G\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(c.MigratePHPSnippets(Options{}, "PHP INI", "php.ini.d", ".php.ini.d", "ini")).To(Succeed())
+
+					Expect(c.ValidateSnippets(Options{})).To(Succeed())
+					Expect(c.report.GeneratedFiles).To(Equal([]string{".php.ini.d/00-v2-a.ini"}))
+				})
+
+				it("includes the snippets the application already had for v3", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "a.ini"), 0644, "memory_limit = 256M\nmax_execution_time = 60\n")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(helper.WriteFile(filepath.Join(appRoot, ".php.ini.d", "app.ini"), 0644, "memory_limit = 512M\n")).To(Succeed())
+					Expect(helper.WriteFile(filepath.Join(appRoot, ".php.ini.d", "00-app.ini"), 0644, "max_execution_time = 30\n")).To(Succeed())
+					Expect(helper.WriteFile(filepath.Join(appRoot, ".php.ini.d", "README.md"), 0644, "memory_limit 1G\n")).To(Succeed())
+
+					Expect(c.MigratePHPSnippets(Options{}, "PHP INI", "php.ini.d", ".php.ini.d", "ini")).To(Succeed())
+
+					err = c.ValidateSnippets(Options{})
+					Expect(err).To(MatchError("migrated snippets are invalid:\n  `max_execution_time` has conflicting values in .php.ini.d/00-app.ini line 1, .php.ini.d/00-v2-a.ini line 2"))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "snippet-validation", Outcome: OutcomeWarning, File: ".php.ini.d/00-v2-a.ini", Key: "memory_limit", Action: "overridden by .php.ini.d/app.ini line 1"}))
+				})
+
+				it("fails on extensions the selected PHP version does not provide", func() {
+					catalog := ExtensionCatalog{Versions: map[string]PHPExtensions{
+						"7.3": {Extensions: []string{"bz2", "redis"}, ZendExtensions: []string{"opcache"}},
+					}}
+					c := newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "a.ini"), 0644, "extension=bz2.so\nextension = \"opcache.so\"\nextension=@{HOME}/lib/custom.so\nzend_extension=rediss\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(c.MigratePHPSnippets(Options{}, "PHP INI", "php.ini.d", ".php.ini.d", "ini")).To(Succeed())
+
+					err = c.ValidateSnippets(Options{PHP: PHPOptions{Version: "7.3.*"}})
+					Expect(err).To(MatchError("migrated snippets are invalid:\n" +
+						"  .php.ini.d/00-v2-a.ini line 2: extension `opcache` is not available in PHP 7.3, load it with `zend_extension` instead\n" +
+						"  .php.ini.d/00-v2-a.ini line 4: zend_extension `rediss` is not available in PHP 7.3"))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "snippet-validation", Outcome: OutcomeFailed, File: ".php.ini.d/00-v2-a.ini", Key: "extension", Action: "build failed, .php.ini.d/00-v2-a.ini line 2: extension `opcache` is not available in PHP 7.3, load it with `zend_extension` instead"}))
+				})
+
+				it("passes snippets that set each directive once", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "fpm.d", "pool.conf"), 0644, "[global]\nemergency_restart_threshold = 10\n[www]\nemergency_restart_threshold = 10\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(c.MigratePHPSnippets(Options{}, "PHP-FPM", "fpm.d", ".php.fpm.d", "conf")).To(Succeed())
+					Expect(c.ValidateSnippets(Options{})).To(Succeed())
+				})
+			})
+
+			when("and contains a full php-fpm.conf", func() {
+				it("maps the changed [global] and [www] settings onto a snippet", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{ApplicationPath: "/workspace"})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php-fpm.conf"), 0644, `[global]
+pid = #{DEPS_DIR}/php/var/run/php-fpm.pid
+error_log = #{HOME}/php/var/log/php-fpm.log
+daemonize = no
+emergency_restart_threshold = 10
+include=#{DEPS_DIR}/php/etc/fpm.d/*.conf
+
+[www]
+listen = #{PHP_FPM_LISTEN}
+pm = dynamic
+pm.max_requests = 200
+pm.max_requests = 500
+php_value[include_path] = "@{HOME}/{LIBDIR}"
+env[APP_HOME] = @{HOME}
+
+[admin]
+listen = 127.0.0.1:9001
+`)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(c.MigratePHPFpmConf(Options{})).To(Succeed())
+
+					Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.fpm.d", "00-compat-php-fpm.conf"))).To(Equal([]byte(`; Migrated from .bp-config/php/php-fpm.conf, only the settings that differ from the stock php-fpm.conf
+[global]
+emergency_restart_threshold = 10
+[www]
+pm.max_requests = 500
+php_value[include_path] = "/workspace/lib"
+env[APP_HOME] = /workspace
+`)))
+
+					Expect(findingKeys(c.report.Findings)).To(ConsistOf("pid", "error_log", "daemonize", "include", "listen", "[admin]"))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "php-fpm-conf", Outcome: OutcomeWarning, File: ".bp-config/php/php-fpm.conf", Key: "listen", Action: "dropped, the PHP web buildpack chooses where PHP-FPM listens for the web server"}))
+					Expect(c.report.GeneratedFiles).To(Equal([]string{".php.fpm.d/00-compat-php-fpm.conf"}))
+				})
+
+				it("fails on the [www] settings the stock pool sets, as they cannot take effect", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php-fpm.conf"), 0644, "[global]\nemergency_restart_threshold = 10\n[www]\npm = dynamic\npm.max_children = 20\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					err = c.MigratePHPFpmConf(Options{})
+					Expect(err).To(MatchError(ContainSubstring("line 5: `pm.max_children = 20` cannot be migrated, the PHP web buildpack sets it in its own `[www]` pool")))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "php-fpm-conf", Outcome: OutcomeFailed, File: ".bp-config/php/php-fpm.conf", Key: "pm.max_children", Action: "build failed, not migrated, the PHP web buildpack sets it in its own `[www]` pool after including `.php.fpm.d/`, so a snippet cannot change it"}))
+					Expect(filepath.Join(appRoot, ".php.fpm.d", "00-compat-php-fpm.conf")).ToNot(BeAnExistingFile())
 
-				options, err := LoadOptionsJSON(appRoot)
-				Expect(err).ToNot(HaveOccurred())
-				Expect(options.PHP.Version).To(Equal("7.4.*"))
+					c = newMigration(OSFileSystem{}, appRoot, Config{Rules: RuleSeverities{"php-fpm-conf": SeverityWarn}})
+					Expect(c.MigratePHPFpmConf(Options{})).To(Succeed())
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "php-fpm-conf", Outcome: OutcomeWarning, File: ".bp-config/php/php-fpm.conf", Key: "pm.max_children", Action: "not migrated, the PHP web buildpack sets it in its own `[www]` pool after including `.php.fpm.d/`, so a snippet cannot change it"}))
+					Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.fpm.d", "00-compat-php-fpm.conf"))).To(HaveSuffix("[global]\nemergency_restart_threshold = 10\n"))
+				})
+
+				it("fails on placeholders it cannot translate, with the line", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{})
+
+					err := helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php-fpm.conf"), 0644, "[www]\nchdir = @{APP_ROOT}\n")
+					Expect(err).ToNot(HaveOccurred())
+
+					err = c.MigratePHPFpmConf(Options{})
+					Expect(err).To(MatchError(ContainSubstring("line 2: `@{APP_ROOT}` is not a known placeholder")))
+					Expect(filepath.Join(appRoot, ".php.fpm.d")).ToNot(BeAnExistingFile())
+				})
 			})
 		})
 
-		when("options need to be written", func() {
-			it("produces buildpack.yml", func() {
-				options := Options{
-					HTTPD: HTTPDOptions{
-						Version: "2.3.49",
-					},
-					PHP: PHPOptions{
-						Version:   "7.3.10",
-						WebServer: "standalone",
-					},
-					Nginx: NginxOptions{
-						Version: "1.14.9",
-					},
-					Composer: ComposerOptions{
-						Version:        "1.8.9",
-						GlobalOptions:  nil,
-						InstallOptions: nil,
-					},
+		when("a composer.json file exists", func() {
+			it("logs a warning that we no longer move vendor", func() {
+				buf := bytes.Buffer{}
+				info := logger.Logger{
+					Logger: bplog.NewLogger(&buf, &buf),
 				}
-				err := WriteOptionsToBuildpackYAML(appRoot, options)
-				Expect(err).ToNot(HaveOccurred())
+				factory.Build.Logger = info
 
-				exists, err := helper.FileExists(filepath.Join(appRoot, "buildpack.yml"))
+				c, _, err := NewContributor(factory.Build)
 				Expect(err).ToNot(HaveOccurred())
-				Expect(exists).To(BeTrue())
 
-				buildpackYMLOutput, err := ioutil.ReadFile(filepath.Join(appRoot, "buildpack.yml"))
+				err = helper.WriteFile(filepath.Join(appRoot, "composer.json"), 0644, "contents")
 				Expect(err).ToNot(HaveOccurred())
 
-				actualOptions := Options{}
-				err = yaml.Unmarshal(buildpackYMLOutput, &actualOptions)
+				err = c.Contribute()
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(options).To(Equal(actualOptions))
+				Expect(buf.String()).To(ContainSubstring("The vendor directory is no longer migrated to LIBDIR."))
 			})
-		})
 
-		when("extensions need to be migrated", func() {
-			it("migrates PHP_EXTENSIONS", func() {
-				c, _, err := NewContributor(factory.Build)
-				Expect(err).ToNot(HaveOccurred())
-				options := Options{
-					PHP: PHPOptions{
-						Extensions: []string{"ext1", "ext2"},
-					},
-				}
+			when("it requires extensions", func() {
+				var catalog ExtensionCatalog
 
-				err = c.MigrateExtensions(options)
-				Expect(err).ToNot(HaveOccurred())
+				it.Before(func() {
+					catalog = ExtensionCatalog{Versions: map[string]PHPExtensions{
+						"7.3": {Extensions: []string{"bz2", "intl", "redis"}, ZendExtensions: []string{"opcache"}},
+					}}
 
-				extensionOutput, err := ioutil.ReadFile(filepath.Join(appRoot, ".php.ini.d", "compat-extensions.ini"))
-				Expect(err).ToNot(HaveOccurred())
+					Expect(helper.WriteFile(filepath.Join(appRoot, "app", "composer.json"), 0644, `{"require": {"php": "^7.3", "ext-intl": "*", "ext-json": "*", "ext-BZ2": "*"}}`)).To(Succeed())
+					Expect(helper.WriteFile(filepath.Join(appRoot, "app", "composer.lock"), 0644, `{"packages": [{"name": "predis/cache", "require": {"ext-redis": "^5.0", "ext-zend-opcache": "*"}}]}`)).To(Succeed())
+				})
 
-				Expect(string(extensionOutput)).To(ContainSubstring("extension=ext1.so"))
-				Expect(string(extensionOutput)).To(ContainSubstring("extension=ext2.so"))
-			})
+				it("reads them through the migration's file system", func() {
+					c := newMigration(movedFileSystem{from: "/virtual/app", to: appRoot}, "/virtual/app", Config{Extensions: catalog, ComposerPath: "app"})
+					options := Options{PHP: PHPOptions{Version: "7.3.*", Extensions: []string{"bz2"}}}
 
-			it("migrates ZEND_EXTENSIONS", func() {
-				c, _, err := NewContributor(factory.Build)
-				Expect(err).ToNot(HaveOccurred())
-				options := Options{
-					PHP: PHPOptions{
-						ZendExtensions: []string{"zext1", "zext2"},
-					},
-				}
+					Expect(c.ReconcileComposerExtensions(&options)).To(Succeed())
 
-				err = c.MigrateExtensions(options)
-				Expect(err).ToNot(HaveOccurred())
+					Expect(options.PHP.Extensions).To(Equal([]string{"bz2", "intl", "redis"}))
+				})
 
-				extensionOutput, err := ioutil.ReadFile(filepath.Join(appRoot, ".php.ini.d", "compat-extensions.ini"))
-				Expect(err).ToNot(HaveOccurred())
+				it("adds the missing ones by default", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog, ComposerPath: "app"})
+					options := Options{PHP: PHPOptions{Version: "7.3.*", Extensions: []string{"bz2"}}}
 
-				Expect(string(extensionOutput)).To(ContainSubstring("zend_extension=zext1.so"))
-				Expect(string(extensionOutput)).To(ContainSubstring("zend_extension=zext2.so"))
+					Expect(c.ReconcileComposerExtensions(&options)).To(Succeed())
+
+					Expect(options.PHP.Extensions).To(Equal([]string{"bz2", "intl", "redis"}))
+					Expect(options.PHP.ZendExtensions).To(Equal([]string{"opcache"}))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "composer-extensions", Outcome: OutcomeMigrated, File: "app/composer.lock (predis/cache)", Key: "ext-redis", Action: "added to PHP_EXTENSIONS"}))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "composer-extensions", Outcome: OutcomePassed, File: "app/composer.json", Key: "ext-json", Action: "not a loadable extension, assumed to be compiled into PHP"}))
+				})
+
+				it("only reports the missing ones when asked to", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog, ComposerPath: "app", ComposerExtensions: WarnComposerExtensions})
+					options := Options{PHP: PHPOptions{Version: "7.3.*"}}
+
+					Expect(c.ReconcileComposerExtensions(&options)).To(Succeed())
+
+					Expect(options.PHP.Extensions).To(BeEmpty())
+					Expect(findingKeys(c.report.Findings)).To(ConsistOf("ext-bz2", "ext-intl", "ext-json", "ext-redis", "ext-opcache"))
+				})
+
+				it("fails on the missing ones when asked to", func() {
+					c := newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog, ComposerPath: "app", ComposerExtensions: FailComposerExtensions})
+					options := Options{PHP: PHPOptions{Version: "7.3.*", Extensions: []string{"bz2", "intl", "redis"}}}
+
+					err := c.ReconcileComposerExtensions(&options)
+					Expect(err).To(MatchError(ContainSubstring("app/composer.lock (predis/cache) requires `ext-opcache`, which is missing from ZEND_EXTENSIONS")))
+				})
+
+				it("checks them against the selected PHP version", func() {
+					catalog.Versions["7.1"] = PHPExtensions{Extensions: []string{"bz2", "intl", "mcrypt", "redis", "json"}, ZendExtensions: []string{"opcache"}}
+					catalog.Versions["7.3"] = PHPExtensions{Extensions: []string{"bz2", "intl", "redis"}, ZendExtensions: []string{"opcache"}, Builtin: []string{"json"}}
+					catalog.Default = "7.3"
+					Expect(helper.WriteFile(filepath.Join(appRoot, "app", "composer.json"), 0644, `{"require": {"ext-json": "*", "ext-mcrypt": "*"}}`)).To(Succeed())
+
+					c := newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog, ComposerPath: "app"})
+					options := Options{PHP: PHPOptions{Extensions: []string{"redis"}, ZendExtensions: []string{"opcache"}}}
+
+					Expect(c.ReconcileComposerExtensions(&options)).To(Succeed())
+
+					Expect(options.PHP.Extensions).To(Equal([]string{"redis"}))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "composer-extensions", Outcome: OutcomePassed, File: "app/composer.json", Key: "ext-json", Action: "not a loadable extension, assumed to be compiled into PHP"}))
+					Expect(c.report.Findings).To(ContainElement(Finding{Rule: "composer-extensions", Outcome: OutcomeWarning, File: "app/composer.json", Key: "ext-mcrypt", Action: "not available in the selected PHP version"}))
+
+					c = newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog, ComposerPath: "app", ComposerExtensions: FailComposerExtensions})
+					err := c.ReconcileComposerExtensions(&options)
+					Expect(err).To(MatchError("composer requires extensions that the selected PHP version does not provide:\n  app/composer.json requires `ext-mcrypt`, which is not available in PHP 7.3"))
+
+					c = newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog, ComposerPath: "app"})
+					options = Options{PHP: PHPOptions{Version: "7.1.*"}}
+					Expect(c.ReconcileComposerExtensions(&options)).To(Succeed())
+					Expect(options.PHP.Extensions).To(Equal([]string{"json", "mcrypt", "redis"}))
+				})
+
+				it("only checks the development packages when they are installed", func() {
+					Expect(helper.WriteFile(filepath.Join(appRoot, "app", "composer.lock"), 0644, `{"packages-dev": [{"name": "phpunit/phpunit", "require": {"ext-intl": "*"}}], "platform-dev": {"ext-redis": "*"}}`)).To(Succeed())
+					Expect(helper.WriteFile(filepath.Join(appRoot, "app", "composer.json"), 0644, `{}`)).To(Succeed())
+
+					c := newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog, ComposerPath: "app"})
+					options := Options{PHP: PHPOptions{Version: "7.3.*"}}
+
+					Expect(c.ReconcileComposerExtensions(&options)).To(Succeed())
+					Expect(options.PHP.Extensions).To(BeEmpty())
+					Expect(c.report.Findings).To(Equal([]Finding{{Rule: "composer-extensions", Outcome: OutcomePassed, File: "app/composer.lock", Key: "packages-dev", Action: "not checked, `composer install --no-dev` does not install the development packages"}}))
+
+					c = newMigration(OSFileSystem{}, appRoot, Config{Extensions: catalog, ComposerPath: "app"})
+					options = Options{PHP: PHPOptions{Version: "7.3.*"}, Composer: ComposerOptions{InstallOptions: []string{"--prefer-dist"}}}
+
+					Expect(c.ReconcileComposerExtensions(&options)).To(Succeed())
+					Expect(options.PHP.Extensions).To(Equal([]string{"redis", "intl"}))
+				})
+
+				it("rejects unknown policies", func() {
+					_, err := ParseComposerExtensionsPolicy("sometimes")
+					Expect(err).To(MatchError(ContainSubstring("BP_PHP_COMPAT_COMPOSER_EXTENSIONS must be one of `add`, `warn` or `fail`")))
+				})
 			})
 		})
 
-		when(".bp-config/httpd or `.bp-config/nginx` exists", func() {
-			it("contains *.conf files", func() {
-				c, _, err := NewContributor(factory.Build)
-				Expect(err).ToNot(HaveOccurred())
+		when("the migration is reported", func() {
+			var buf bytes.Buffer
 
-				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "httpd", "test.conf"), 0644, "contents")
-				Expect(err).ToNot(HaveOccurred())
-				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "httpd", "anoter.conf"), 0644, "more contents")
-				Expect(err).ToNot(HaveOccurred())
+			it.Before(func() {
+				buf = bytes.Buffer{}
+				factory.Build.Logger = logger.Logger{Logger: bplog.NewLogger(&buf, &buf)}
 
-				err = c.ErrorOnCustomServerConfig("HTTPD", "httpd", ".conf")
-				Expect(err).To(HaveOccurred())
-				Expect(err.Error()).To(Equal("migration failure"))
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"PHP_EXTENSIONS": ["bz2"], "PHP_STRIP": true}`)).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "custom.ini"), 0644, "memory_limit=1G")).To(Succeed())
 			})
 
-			it("contains *.conf files", func() {
-				c, _, err := NewContributor(factory.Build)
+			readReport := func() Report {
+				contents, err := ioutil.ReadFile(filepath.Join(factory.Build.Layers.Root, Layer, "report.json"))
 				Expect(err).ToNot(HaveOccurred())
 
-				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "nginx", "test.conf"), 0644, "contents")
-				Expect(err).ToNot(HaveOccurred())
-				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "nginx", "anoter.conf"), 0644, "more contents")
+				var r Report
+				Expect(json.Unmarshal(contents, &r)).To(Succeed())
+				return r
+			}
+
+			it("writes a launch process for an APP_START_CMD that is not a PHP script", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"APP_START_CMD": "vendor/bin/rr serve"}`)).To(Succeed())
+
+				c, _, err := NewContributor(factory.Build)
 				Expect(err).ToNot(HaveOccurred())
+				Expect(c.Contribute()).To(Succeed())
 
-				err = c.ErrorOnCustomServerConfig("Nginx", "nginx", ".conf")
-				Expect(err).To(HaveOccurred())
-				Expect(err.Error()).To(Equal("migration failure"))
+				Expect(factory.Build.Layers).To(test.HaveApplicationMetadata(layers.Metadata{Processes: layers.Processes{{Type: "web", Command: "vendor/bin/rr serve"}}}))
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, "buildpack.yml"))).ToNot(ContainSubstring("script"))
 			})
 
-			it("doesn't contain *.conf files", func() {
+			it("writes every finding and generated file to the launch layer", func() {
 				c, _, err := NewContributor(factory.Build)
 				Expect(err).ToNot(HaveOccurred())
+				Expect(c.Contribute()).To(Succeed())
+
+				layer := factory.Build.Layers.Layer(Layer)
+				Expect(layer).To(test.HaveLayerMetadata(false, false, true))
+				Expect(layer).To(test.HaveOverrideLaunchEnvironment(ReportEnv, filepath.Join(layer.Root, "report.json")))
+
+				r := readReport()
+				Expect(r.Findings).To(ContainElement(Finding{Rule: "legacy-option", Outcome: OutcomeMigrated, File: ".bp-config/options.json", Key: "PHP_EXTENSIONS", Action: "Migrated to `.php.ini.d/compat-extensions.ini`."}))
+				Expect(r.Findings).To(ContainElement(Finding{Rule: "legacy-option", Outcome: OutcomeDropped, File: ".bp-config/options.json", Key: "PHP_STRIP", Action: "PHP files are no longer stripped. Remove this setting from options.json."}))
+				Expect(r.Findings).To(ContainElement(Finding{Rule: "php-ini-snippets", Outcome: OutcomeMigrated, File: ".bp-config/php/php.ini.d/custom.ini", Action: "copied to .php.ini.d/00-v2-custom.ini"}))
+				Expect(r.Findings).To(ContainElement(Finding{Rule: "custom-httpd", Outcome: OutcomePassed, Action: "no HTTPD configuration under .bp-config/httpd"}))
+				Expect(r.GeneratedFiles).To(Equal([]string{".php.ini.d/00-v2-custom.ini", ".php.ini.d/compat-extensions.ini", "buildpack.yml"}))
+
+				Expect(buf.String()).To(ContainSubstring("PHP Compat migration report"))
+				Expect(buf.String()).To(ContainSubstring("| Rule | Outcome | Source | Action |"))
+				Expect(buf.String()).To(ContainSubstring("| php-ini-snippets | migrated | .bp-config/php/php.ini.d/custom.ini | copied to .php.ini.d/00-v2-custom.ini |"))
+			})
 
-				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "httpd", "test.txt"), 0644, "contents")
-				Expect(err).ToNot(HaveOccurred())
+			it("writes the report when the migration fails", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "nginx", "server-custom.conf"), 0644, "listen 8080;")).To(Succeed())
 
-				err = c.ErrorOnCustomServerConfig("HTTPD", "httpd", ".conf")
+				c, _, err := NewContributor(factory.Build)
 				Expect(err).ToNot(HaveOccurred())
+				Expect(c.Contribute()).To(MatchError(ContainSubstring("unable to migrate the Nginx configuration")))
+
+				r := readReport()
+				Expect(r.Findings).To(ContainElement(Finding{Rule: "custom-nginx", Outcome: OutcomeFailed, File: ".bp-config/nginx/server-custom.conf", Key: "listen", Action: "build failed, line 1: the PHP web buildpack listens on $PORT, where the platform sends requests"}))
+				Expect(r.Inventory).To(ConsistOf(
+					InventoryItem{File: ".bp-config/nginx/server-custom.conf", Classification: ClassUnsupported, Reason: "build failed, line 1: the PHP web buildpack listens on $PORT, where the platform sends requests"},
+					InventoryItem{File: ".bp-config/options.json", Classification: ClassNotReached, Reason: "an earlier step failed, otherwise settings moved to buildpack.yml and .php.ini.d/compat-extensions.ini"},
+					InventoryItem{File: ".bp-config/php/php.ini.d/custom.ini", Classification: ClassNotReached, Reason: "an earlier step failed, otherwise moved to .php.ini.d/"},
+				))
 			})
 		})
 
-		when(".bp-config/php/ exists", func() {
-			it("subfolder php.ini.d contains *.ini files", func() {
-				c, _, err := NewContributor(factory.Build)
-				Expect(err).ToNot(HaveOccurred())
+		when("the .bp-config folder is inventoried", func() {
+			it.Before(func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{}`)).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "custom.ini"), 0644, "memory_limit=1G")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "README.md"), 0644, "notes")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "old", "custom.ini"), 0644, "memory_limit=2G")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "fpm.d", "pool.conf"), 0644, "[www]\npm.max_children = 10\n")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini"), 0644, "[PHP]\n")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php-cli.ini"), 0644, "")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "newrelic", "newrelic.ini"), 0644, "")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "httpd", "README"), 0644, "")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "notes.txt"), 0644, "")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".php.fpm.d", "00-v2-pool.conf"), 0644, "[www]\npm.max_children = 10\n")).To(Succeed())
+			})
 
-				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "test.ini"), 0644, "contents")
-				Expect(err).ToNot(HaveOccurred())
-				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "another.ini"), 0644, "more contents")
+			it("classifies every file with a reason", func() {
+				sink := &recordingSink{}
+				result, err := Migrate(OSFileSystem{}, appRoot, Config{Sink: sink})
 				Expect(err).ToNot(HaveOccurred())
 
-				err = c.MigratePHPSnippets("PHP INI", "php.ini.d", ".php.ini.d", "ini")
+				Expect(result.Report.Inventory).To(Equal([]InventoryItem{
+					{File: ".bp-config/httpd/README", Classification: ClassIgnored, Reason: "v2 only read *.conf files from the web server configuration"},
+					{File: ".bp-config/newrelic/newrelic.ini", Classification: ClassUnsupported, Reason: "the PHP buildpacks do not install the New Relic agent, use a New Relic buildpack instead"},
+					{File: ".bp-config/notes.txt", Classification: ClassIgnored, Reason: "not part of the v2 PHP buildpack configuration"},
+					{File: ".bp-config/options.json", Classification: ClassMigrated, Reason: "settings written to buildpack.yml"},
+					{File: ".bp-config/php/fpm.d/pool.conf", Classification: ClassSuperseded, Reason: "already migrated to .php.fpm.d/00-v2-pool.conf"},
+					{File: ".bp-config/php/php-cli.ini", Classification: ClassUnsupported, Reason: "only php.ini, php-fpm.conf, php.ini.d/ and fpm.d/ are migrated from .bp-config/php"},
+					{File: ".bp-config/php/php.ini", Classification: ClassSuperseded, Reason: "matches the stock php.ini, nothing to migrate"},
+					{File: ".bp-config/php/php.ini.d/README.md", Classification: ClassIgnored, Reason: "v2 only loaded *.ini files from php.ini.d"},
+					{File: ".bp-config/php/php.ini.d/custom.ini", Classification: ClassMigrated, Reason: "copied to .php.ini.d/00-v2-custom.ini"},
+					{File: ".bp-config/php/php.ini.d/old/custom.ini", Classification: ClassIgnored, Reason: "v2 did not load snippets in subdirectories"},
+				}))
+				Expect(sink.messages).To(ContainElement("info: .bp-config/notes.txt is ignored: not part of the v2 PHP buildpack configuration"))
+				Expect(result.Report.Markdown()).To(ContainSubstring("| .bp-config/php/php.ini | superseded | matches the stock php.ini, nothing to migrate |"))
+			})
+
+			it("is empty without a .bp-config folder", func() {
+				Expect(os.RemoveAll(filepath.Join(appRoot, ".bp-config"))).To(Succeed())
 
+				result, err := Migrate(OSFileSystem{}, appRoot, Config{})
 				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Report.Inventory).To(BeEmpty())
+			})
+		})
+
+		when("a dry run is requested", func() {
+			var buf bytes.Buffer
+
+			it.Before(func() {
+				buf = bytes.Buffer{}
+				factory.Build.Logger = logger.Logger{Logger: bplog.NewLogger(&buf, &buf)}
 
-				Expect(filepath.Join(appRoot, ".php.ini.d", "test.ini")).To(BeARegularFile())
-				Expect(filepath.Join(appRoot, ".php.ini.d", "another.ini")).To(BeARegularFile())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"PHP_EXTENSIONS": ["bz2"], "WEBDIR": "public"}`)).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, "buildpack.yml"), 0644, "php:\n  version: 7.3.*\n")).To(Succeed())
 			})
 
-			it("subfolder fpm.d contains *.conf files", func() {
+			it.After(func() {
+				Expect(os.Unsetenv(DryRunEnv)).To(Succeed())
+			})
+
+			it("shows what would change without touching the application", func() {
+				Expect(os.Setenv(DryRunEnv, "true")).To(Succeed())
+
 				c, _, err := NewContributor(factory.Build)
 				Expect(err).ToNot(HaveOccurred())
+				Expect(c.Contribute()).To(Succeed())
 
-				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "fpm.d", "test.conf"), 0644, "contents")
-				Expect(err).ToNot(HaveOccurred())
-				err = helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "fpm.d", "another.conf"), 0644, "more contents")
-				Expect(err).ToNot(HaveOccurred())
+				Expect(filepath.Join(appRoot, ".php.ini.d", "compat-extensions.ini")).ToNot(BeAnExistingFile())
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, "buildpack.yml"))).To(Equal([]byte("php:\n  version: 7.3.*\n")))
 
-				err = c.MigratePHPSnippets("PHP-FPM", "fpm.d", ".php.fpm.d", "conf")
+				Expect(buf.String()).To(ContainSubstring("Dry run, the application has not been modified"))
+				Expect(buf.String()).To(ContainSubstring("+++ b/.php.ini.d/compat-extensions.ini"))
+
+				result, err := Migrate(OSFileSystem{}, appRoot, Config{DryRun: DryRunPass})
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(filepath.Join(appRoot, ".php.fpm.d", "test.conf")).To(BeARegularFile())
-				Expect(filepath.Join(appRoot, ".php.fpm.d", "another.conf")).To(BeARegularFile())
+				changes := result.Changes
+				Expect(changes).To(HaveLen(2))
+				Expect(changes[0].Diff()).To(Equal("--- /dev/null\n+++ b/.php.ini.d/compat-extensions.ini\n@@ -0,0 +1,1 @@\n+extension=bz2.so\n"))
+				Expect(changes[1].Diff()).To(Equal("--- a/buildpack.yml\n+++ b/buildpack.yml\n@@ -1,2 +1,4 @@\n php:\n   version: 7.3.*\n+  webserver: httpd\n+  webdirectory: public\n"))
 			})
-		})
 
-		when("a composer.json file exists", func() {
-			it("logs a warning that we no longer move vendor", func() {
-				buf := bytes.Buffer{}
-				info := logger.Logger{
-					Logger: bplog.NewLogger(&buf, &buf),
-				}
-				factory.Build.Logger = info
+			it("fails when the policy does not allow changes", func() {
+				Expect(os.Setenv(DryRunEnv, "fail")).To(Succeed())
 
 				c, _, err := NewContributor(factory.Build)
 				Expect(err).ToNot(HaveOccurred())
+				Expect(c.Contribute()).To(MatchError(DryRunError{Changes: 2}))
 
-				err = helper.WriteFile(filepath.Join(appRoot, "composer.json"), 0644, "contents")
-				Expect(err).ToNot(HaveOccurred())
+				Expect(filepath.Join(appRoot, ".php.ini.d", "compat-extensions.ini")).ToNot(BeAnExistingFile())
+			})
 
-				err = c.Contribute()
-				Expect(err).ToNot(HaveOccurred())
+			it("rejects unknown policies", func() {
+				Expect(os.Setenv(DryRunEnv, "maybe")).To(Succeed())
 
-				Expect(buf.String()).To(ContainSubstring("The vendor directory is no longer migrated to LIBDIR."))
+				_, _, err := NewContributor(factory.Build)
+				Expect(err).To(MatchError(ContainSubstring("BP_PHP_COMPAT_DRY_RUN must be one of")))
 			})
 		})
 	})
 
 	when("building and", func() {
-		var contributor Contributor
+		var contributor *migration
 		var appRoot string
 
 		it.Before(func() {
 			factory := test.NewBuildFactory(t)
 			factory.AddPlan(buildpackplan.Plan{Name: Layer})
 
-			var err error
-			contributor, _, err = NewContributor(factory.Build)
-			Expect(err).ToNot(HaveOccurred())
-
 			appRoot = factory.Build.Application.Root
+			contributor = newMigration(OSFileSystem{}, appRoot, Config{})
 		})
 
 		when("we have a web app", func() {
@@ -504,6 +1971,212 @@ func testCompat(t *testing.T, when spec.G, it spec.S) {
 			})
 		})
 	})
+
+	when("migrating through the API", func() {
+		var appRoot string
+
+		it.Before(func() {
+			var err error
+			appRoot, err = ioutil.TempDir("", "compat-api")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"PHP_EXTENSIONS": ["bz2"], "PHP_STRIP": true}`)).To(Succeed())
+		})
+
+		it.After(func() {
+			Expect(os.RemoveAll(appRoot)).To(Succeed())
+		})
+
+		it("passes findings and messages to the sink and returns the result", func() {
+			sink := &recordingSink{}
+
+			result, err := Migrate(OSFileSystem{}, appRoot, Config{ComposerPath: "app", Sink: sink})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(sink.findings).To(Equal(result.Report.Findings))
+			Expect(sink.messages).To(ContainElement("warning: PHP_STRIP is ignored: PHP files are no longer stripped. Remove this setting from options.json."))
+			Expect(result.Changes).To(HaveLen(2))
+			Expect(result.Changes[1].Path).To(Equal("buildpack.yml"))
+			Expect(result.Changes[1].After).To(ContainSubstring("json_path: app"))
+		})
+
+		it("returns the report so far when the migration fails", func() {
+			Expect(helper.WriteFile(filepath.Join(appRoot, ".extensions", "extension.py"), 0644, "")).To(Succeed())
+
+			result, err := Migrate(OSFileSystem{}, appRoot, Config{})
+			Expect(err).To(HaveOccurred())
+			Expect(result.Report.Findings).To(Equal([]Finding{{Rule: "extensions-folder", Outcome: OutcomeFailed, File: ".extensions", Action: "build failed, remove the folder"}}))
+		})
+
+		when("rule severities are changed", func() {
+			it("carries on past the rules set to warn and logs the decision", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".extensions", "extension.py"), 0644, "")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "httpd", "httpd.conf"), 0644, "Listen 8080\nHeader set X-Frame-Options DENY\n")).To(Succeed())
+				sink := &recordingSink{}
+
+				rules, err := ParseRuleSeverities("extensions-folder=warn, custom-httpd=WARN")
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := Migrate(OSFileSystem{}, appRoot, Config{Rules: rules, Sink: sink})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(sink.messages).To(ContainElement("info: BP_PHP_COMPAT_RULES sets `custom-httpd` to `warn` instead of `error`: directives under `.bp-config/httpd` that cannot be migrated"))
+				Expect(sink.messages).To(ContainElement("warning: Use of .extensions folder has been removed. Please remove this folder from your application."))
+				Expect(sink.messages).To(ContainElement("warning: .bp-config/httpd/httpd.conf line 1: httpd must listen on $PORT, where the platform sends requests, it is left out"))
+				Expect(result.Report.Findings).To(ContainElement(Finding{Rule: "extensions-folder", Outcome: OutcomeWarning, File: ".extensions", Action: "remove the folder"}))
+				Expect(result.Report.Findings).To(ContainElement(Finding{Rule: "custom-httpd", Outcome: OutcomeWarning, File: ".bp-config/httpd/httpd.conf", Key: "Listen", Action: "left out, line 1: httpd must listen on $PORT, where the platform sends requests"}))
+				Expect(result.Report.Inventory).To(ContainElement(InventoryItem{File: ".bp-config/httpd/httpd.conf", Classification: ClassUnsupported, Reason: "left out, line 1: httpd must listen on $PORT, where the platform sends requests"}))
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, HTTPDSnippet))).To(ContainSubstring("Header set X-Frame-Options DENY"))
+			})
+
+			it("skips the rules that are turned off", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, "index.php"), 0644, "")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "nginx", "server-custom.conf"), 0644, "listen 8080;\n")).To(Succeed())
+				sink := &recordingSink{}
+
+				result, err := Migrate(OSFileSystem{}, appRoot, Config{Rules: RuleSeverities{"webdir-move": SeverityOff, "custom-nginx": SeverityOff}, Sink: sink})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(sink.messages).To(ContainElement("info: Skipping `webdir-move`, it is turned off through BP_PHP_COMPAT_RULES"))
+				Expect(sink.messages).To(ContainElement("info: Skipping `custom-nginx`, it is turned off through BP_PHP_COMPAT_RULES"))
+				for _, finding := range result.Report.Findings {
+					Expect(finding.Rule).ToNot(BeElementOf("webdir-move", "custom-nginx"))
+				}
+				Expect(result.Report.Inventory).To(ContainElement(InventoryItem{File: ".bp-config/nginx/server-custom.conf", Classification: ClassIgnored, Reason: "not migrated, `custom-nginx` is turned off through BP_PHP_COMPAT_RULES"}))
+				Expect(filepath.Join(appRoot, ".nginx.conf.d")).ToNot(BeAnExistingFile())
+			})
+
+			it("fails on the rules raised to errors", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, "composer.json"), 0644, "{}")).To(Succeed())
+
+				result, err := Migrate(OSFileSystem{}, appRoot, Config{Rules: RuleSeverities{"composer-notes": SeverityError}})
+				Expect(err).To(MatchError("the vendor directory and Composer files are no longer moved"))
+				Expect(result.Report.Findings).To(ContainElement(Finding{Rule: "composer-notes", Outcome: OutcomeFailed, File: "composer.json", Action: "build failed, vendor directory and composer files are no longer moved"}))
+			})
+
+			it("fails on legacy options when `legacy-option` is an error", func() {
+				sink := &recordingSink{}
+
+				result, err := Migrate(OSFileSystem{}, appRoot, Config{Rules: RuleSeverities{"legacy-option": SeverityError}, Sink: sink})
+				Expect(err).To(MatchError("options.json sets options that are not migrated, remove them:\n  PHP_STRIP is ignored: PHP files are no longer stripped. Remove this setting from options.json."))
+				Expect(sink.messages).To(ContainElement("error: PHP_STRIP is ignored: PHP files are no longer stripped. Remove this setting from options.json."))
+				Expect(result.Report.Findings).To(ContainElement(Finding{Rule: "legacy-option", Outcome: OutcomeFailed, File: ".bp-config/options.json", Key: "PHP_STRIP", Action: "build failed, PHP files are no longer stripped. Remove this setting from options.json."}))
+				Expect(filepath.Join(appRoot, "buildpack.yml")).ToNot(BeAnExistingFile())
+			})
+
+			it("fails on an APP_START_CMD that is not a PHP script when `app-start-cmd` is an error", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"APP_START_CMD": "bin/worker"}`)).To(Succeed())
+
+				result, err := Migrate(OSFileSystem{}, appRoot, Config{Rules: RuleSeverities{"app-start-cmd": SeverityError}})
+				Expect(err).To(MatchError("APP_START_CMD `bin/worker` is not a PHP script under the application, v3 can only run it as the `web` launch process"))
+				Expect(result.Report.Findings).To(ContainElement(Finding{Rule: "app-start-cmd", Outcome: OutcomeFailed, File: ".bp-config/options.json", Key: "APP_START_CMD", Action: "build failed, not a PHP script under the application"}))
+				Expect(result.Processes).To(BeEmpty())
+			})
+
+			it("leaves out what the rules that are warnings cannot migrate", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"PHP_MODULES": ["cli", "gd"], "PHP_EXTENSIONS": ["bz2", "mcrypt"]}`)).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini"), 0644, "[PHP\nmemory_limit = 1G\n")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "listen.ini"), 0644, "listen = {PHP_FPM_LISTEN}\n")).To(Succeed())
+				sink := &recordingSink{}
+
+				rules := RuleSeverities{"php-modules": SeverityWarn, "php-ini": SeverityWarn, "snippet-placeholders": SeverityWarn, "extensions": SeverityWarn}
+				catalog := ExtensionCatalog{Default: "7.4", Versions: map[string]PHPExtensions{"7.4": {Extensions: []string{"bz2"}}}}
+				result, err := Migrate(OSFileSystem{}, appRoot, Config{Rules: rules, Extensions: catalog, Sink: sink})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(sink.messages).To(ContainElement(ContainSubstring("warning: PHP_MODULES `gd` is not a PHP module")))
+				Expect(sink.messages).To(ContainElement("warning: PHP_EXTENSIONS `mcrypt` is not available in PHP 7.4, it is left out"))
+				Expect(result.Report.Findings).To(ContainElement(Finding{Rule: "php-ini", Outcome: OutcomeWarning, File: ".bp-config/php/php.ini", Action: "not migrated, line 1: section `[PHP` is missing its closing `]`"}))
+				Expect(result.Report.Findings).To(ContainElement(Finding{Rule: "snippet-placeholders", Outcome: OutcomeWarning, File: ".bp-config/php/php.ini.d/listen.ini", Action: "not migrated, line 1: `{PHP_FPM_LISTEN}` cannot be translated, the PHP-FPM listen address is managed by the PHP web buildpack, remove the setting that uses it"}))
+				Expect(result.Report.Inventory).To(ContainElement(InventoryItem{File: ".bp-config/php/php.ini", Classification: ClassUnsupported, Reason: "not migrated, line 1: section `[PHP` is missing its closing `]`"}))
+
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, ".php.ini.d", "compat-extensions.ini"))).To(Equal([]byte("extension=bz2.so\n")))
+				Expect(filepath.Join(appRoot, PHPIniSnippet)).ToNot(BeAnExistingFile())
+				Expect(filepath.Join(appRoot, ".php.ini.d", "00-v2-listen.ini")).ToNot(BeAnExistingFile())
+			})
+
+			it("keeps the buildpack.yml values on conflicts when `buildpack-yml` is a warning", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"WEBDIR": "public"}`)).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, "buildpack.yml"), 0644, "php:\n  webdirectory: web\n")).To(Succeed())
+
+				result, err := Migrate(OSFileSystem{}, appRoot, Config{Rules: RuleSeverities{"buildpack-yml": SeverityWarn}})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Report.Findings).To(ContainElement(Finding{Rule: "buildpack-yml", Outcome: OutcomeWarning, File: "buildpack.yml", Key: "php.webdirectory", Action: "kept the value from buildpack.yml"}))
+				Expect(ioutil.ReadFile(filepath.Join(appRoot, "buildpack.yml"))).To(ContainSubstring("webdirectory: web"))
+			})
+
+			it("rejects unknown rules and severities", func() {
+				_, err := ParseRuleSeverities("custom-apache=warn")
+				Expect(err).To(MatchError("BP_PHP_COMPAT_RULES names the unknown rule `custom-apache`, it must be one of `extensions-folder`, `legacy-option`, `version-placeholders`, `web-server`, `webdir-move`, `app-start-cmd`, `php-modules`, `composer-latest`, `composer-notes`, `custom-httpd`, `custom-nginx`, `php-ini-snippets`, `snippet-placeholders`, `php-fpm-snippets`, `php-ini`, `php-fpm-conf`, `composer-extensions`, `extensions`, `snippet-validation`, `buildpack-yml`, `dry-run`"))
+
+				_, err = ParseRuleSeverities("webdir-move=ignore")
+				Expect(err).To(MatchError("BP_PHP_COMPAT_RULES must set `webdir-move` to `error`, `warn` or `off`, found `ignore`"))
+
+				_, err = ParseRuleSeverities("webdir-move")
+				Expect(err).To(MatchError("BP_PHP_COMPAT_RULES expects `rule=severity` pairs, found `webdir-move`"))
+			})
+
+			it("accepts every rule the findings name, but only the default severity of the fixed ones", func() {
+				var ids []string
+				for _, rule := range Rules {
+					ids = append(ids, rule.ID)
+				}
+				Expect(ids).To(ContainElement(snippetRule("PHP INI")))
+				Expect(ids).To(ContainElement(snippetRule("PHP-FPM")))
+
+				rules, err := ParseRuleSeverities("extensions=warn, php-ini=off, legacy-option=error, web-server=error")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(rules).To(Equal(RuleSeverities{"extensions": SeverityWarn, "php-ini": SeverityOff, "legacy-option": SeverityError, "web-server": SeverityError}))
+
+				_, err = ParseRuleSeverities("dry-run=off")
+				Expect(err).To(MatchError("BP_PHP_COMPAT_RULES cannot set `dry-run` to `off`, it is always `error`"))
+
+				_, err = ParseRuleSeverities("version-placeholders=warn")
+				Expect(err).To(MatchError("BP_PHP_COMPAT_RULES cannot set `version-placeholders` to `warn`, it is always `error`"))
+			})
+
+			it("registers the rule of every finding", func() {
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "options.json"), 0644, `{"WEB_SERVER": "nginx", "APP_START_CMD": "bin/worker", "ADMIN_EMAIL": "admin@example.com"}`)).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, ".bp-config", "php", "php.ini.d", "custom.ini"), 0644, "memory_limit = 1G\n")).To(Succeed())
+				Expect(helper.WriteFile(filepath.Join(appRoot, "composer.json"), 0644, "{}")).To(Succeed())
+
+				result, _ := Migrate(OSFileSystem{}, appRoot, Config{DryRun: DryRunPass})
+				Expect(result.Report.Findings).ToNot(BeEmpty())
+				for _, finding := range result.Report.Findings {
+					_, ok := findRule(finding.Rule)
+					Expect(ok).To(BeTrue(), finding.Rule)
+				}
+			})
+		})
+	})
+
+	when("diffing files", func() {
+		it("shows separate hunks for changes far apart", func() {
+			before := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+			after := "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n12\n13\n"
+
+			Expect(FileChange{Path: "numbers", Before: before, After: after}.Diff()).To(Equal(`--- a/numbers
++++ b/numbers
+@@ -1,4 +1,4 @@
+-1
++one
+ 2
+ 3
+ 4
+@@ -8,5 +8,5 @@
+ 8
+ 9
+ 10
+-11
+ 12
++13
+`))
+		})
+
+		it("has nothing to show for identical files", func() {
+			Expect(FileChange{Path: "same", Before: "a\n", After: "a\n"}.Diff()).To(BeEmpty())
+		})
+	})
 }
 
 func writeOptionsJSON(appRoot, jsonBody string) error {
@@ -514,3 +2187,55 @@ func writeOptionsJSON(appRoot, jsonBody string) error {
 	}
 	return nil
 }
+
+// movedFileSystem serves the files under `to` as if they were under `from`
+type movedFileSystem struct {
+	from string
+	to   string
+}
+
+func (f movedFileSystem) path(path string) string {
+	return strings.Replace(path, f.from, f.to, 1)
+}
+
+func (f movedFileSystem) ReadFile(path string) ([]byte, error) {
+	return OSFileSystem{}.ReadFile(f.path(path))
+}
+
+func (f movedFileSystem) WriteFile(path string, mode os.FileMode, contents []byte) error {
+	return OSFileSystem{}.WriteFile(f.path(path), mode, contents)
+}
+
+func (f movedFileSystem) Stat(path string) (os.FileInfo, error) {
+	return OSFileSystem{}.Stat(f.path(path))
+}
+
+func (f movedFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	return OSFileSystem{}.Walk(f.path(root), func(path string, info os.FileInfo, err error) error {
+		return walkFn(strings.Replace(path, f.to, f.from, 1), info, err)
+	})
+}
+
+type recordingSink struct {
+	findings []Finding
+	messages []string
+}
+
+func (r *recordingSink) Finding(finding Finding) {
+	r.findings = append(r.findings, finding)
+}
+
+func (r *recordingSink) Message(level Level, message string) {
+	r.messages = append(r.messages, fmt.Sprintf("%s: %s", level, message))
+}
+
+// findingKeys lists the keys of the findings that have one
+func findingKeys(findings []Finding) []string {
+	var keys []string
+	for _, finding := range findings {
+		if finding.Key != "" {
+			keys = append(keys, finding.Key)
+		}
+	}
+	return keys
+}
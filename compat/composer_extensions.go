@@ -0,0 +1,247 @@
+package compat
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ComposerExtensionsEnv selects the ComposerExtensionsPolicy
+const ComposerExtensionsEnv = "BP_PHP_COMPAT_COMPOSER_EXTENSIONS"
+
+// ComposerExtensionsPolicy decides what happens to the `ext-*` requirements of composer.json and composer.lock that
+// are missing from PHP_EXTENSIONS and ZEND_EXTENSIONS
+type ComposerExtensionsPolicy string
+
+const (
+	// AddComposerExtensions loads the missing extensions along with the ones from options.json
+	AddComposerExtensions ComposerExtensionsPolicy = "add"
+	// WarnComposerExtensions reports the missing extensions and leaves them out
+	WarnComposerExtensions ComposerExtensionsPolicy = "warn"
+	// FailComposerExtensions fails the build while any extensions are missing
+	FailComposerExtensions ComposerExtensionsPolicy = "fail"
+)
+
+// ParseComposerExtensionsPolicy validates a Composer extensions policy, defaulting to AddComposerExtensions
+func ParseComposerExtensionsPolicy(value string) (ComposerExtensionsPolicy, error) {
+	switch policy := ComposerExtensionsPolicy(strings.ToLower(value)); policy {
+	case "":
+		return AddComposerExtensions, nil
+	case AddComposerExtensions, WarnComposerExtensions, FailComposerExtensions:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%s must be one of `%s`, `%s` or `%s`, found `%s`", ComposerExtensionsEnv, AddComposerExtensions, WarnComposerExtensions, FailComposerExtensions, value)
+	}
+}
+
+// composerRequirement is an `ext-*` requirement and the file that asked for it
+type composerRequirement struct {
+	Extension string
+	Source    string
+}
+
+// composerExtensionName turns a Composer platform package, such as `ext-zend-opcache`, into an extension name
+func composerExtensionName(pkg string) (string, bool) {
+	pkg = strings.ToLower(pkg)
+	if !strings.HasPrefix(pkg, "ext-") {
+		return "", false
+	}
+
+	name := strings.TrimPrefix(pkg, "ext-")
+	if name == "zend-opcache" {
+		name = "opcache"
+	}
+	return name, true
+}
+
+// readComposerRequirements lists the `ext-*` requirements of composer.json and of the packages in composer.lock, in
+// the order they are found.  The development packages are only included when dev is set, as `composer install
+// --no-dev` leaves them out.
+func (m *migration) readComposerRequirements(composerJSON string, dev bool) ([]composerRequirement, error) {
+	var requirements []composerRequirement
+	seen := map[string]bool{}
+
+	add := func(source string, require map[string]string) {
+		var packages []string
+		for pkg := range require {
+			packages = append(packages, pkg)
+		}
+		sort.Strings(packages)
+
+		for _, pkg := range packages {
+			name, ok := composerExtensionName(pkg)
+			if !ok || seen[name] {
+				continue
+			}
+			seen[name] = true
+			requirements = append(requirements, composerRequirement{Extension: name, Source: source})
+		}
+	}
+
+	contents, err := m.fs.ReadFile(composerJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest struct {
+		Require map[string]string `json:"require"`
+	}
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to read `%s`: %s", m.relative(composerJSON), err)
+	}
+	add(m.relative(composerJSON), manifest.Require)
+
+	composerLock := filepath.Join(filepath.Dir(composerJSON), "composer.lock")
+	exists, err := fileExists(m.fs, composerLock)
+	if err != nil || !exists {
+		return requirements, err
+	}
+
+	contents, err = m.fs.ReadFile(composerLock)
+	if err != nil {
+		return nil, err
+	}
+
+	type lockedPackage struct {
+		Name    string            `json:"name"`
+		Require map[string]string `json:"require"`
+	}
+	var lock struct {
+		Packages    []lockedPackage   `json:"packages"`
+		PackagesDev []lockedPackage   `json:"packages-dev"`
+		Platform    map[string]string `json:"platform"`
+		PlatformDev map[string]string `json:"platform-dev"`
+	}
+	if err := json.Unmarshal(contents, &lock); err != nil {
+		return nil, fmt.Errorf("unable to read `%s`: %s", m.relative(composerLock), err)
+	}
+
+	add(m.relative(composerLock), lock.Platform)
+	for _, pkg := range lock.Packages {
+		add(fmt.Sprintf("%s (%s)", m.relative(composerLock), pkg.Name), pkg.Require)
+	}
+
+	switch {
+	case dev:
+		add(m.relative(composerLock), lock.PlatformDev)
+		for _, pkg := range lock.PackagesDev {
+			add(fmt.Sprintf("%s (%s)", m.relative(composerLock), pkg.Name), pkg.Require)
+		}
+	case len(lock.PackagesDev) > 0 || len(lock.PlatformDev) > 0:
+		m.add(Finding{Rule: "composer-extensions", Outcome: OutcomePassed, File: m.relative(composerLock), Key: "packages-dev", Action: "not checked, `composer install --no-dev` does not install the development packages"})
+	}
+
+	return requirements, nil
+}
+
+// ReconcileComposerExtensions compares the `ext-*` requirements of composer.json and composer.lock with
+// PHP_EXTENSIONS and ZEND_EXTENSIONS, and handles the missing ones as the policy says.  Requirements are checked
+// against the PHP versions that PHP_VERSION allows: those compiled into them, or that no PHP version in the extension
+// catalog lists, are assumed to be compiled into PHP, and those only other PHP versions provide are reported.
+func (m *migration) ReconcileComposerExtensions(options *Options) error {
+	composerJSON, err := m.findComposerJSON(*options)
+	if err != nil || composerJSON == "" || !m.enabled("composer-extensions") {
+		return err
+	}
+
+	// a warning only reports what the fail policy would have failed on
+	policy := m.config.ComposerExtensions
+	if policy == FailComposerExtensions && m.config.Rules.Severity("composer-extensions") == SeverityWarn {
+		policy = WarnComposerExtensions
+	}
+
+	// without a catalog there is no telling a loadable extension from one compiled into PHP
+	if len(m.config.Extensions.Versions) == 0 {
+		m.add(Finding{Rule: "composer-extensions", Outcome: OutcomePassed, File: m.relative(composerJSON), Action: "not checked, the buildpack has no extension catalog"})
+		return nil
+	}
+
+	versions, err := m.config.Extensions.versions(options.PHP.Version)
+	if err != nil {
+		return m.failPHPVersion(err)
+	}
+	// without a default PHP version in the catalog, any of them could be selected
+	if len(versions) == 0 {
+		versions = m.config.Extensions.allVersions()
+	}
+
+	// v2 and v3 both install without the development packages unless the install options say otherwise
+	dev := len(options.Composer.InstallOptions) > 0 && !containsString(options.Composer.InstallOptions, "--no-dev")
+
+	requirements, err := m.readComposerRequirements(composerJSON, dev)
+	if err != nil {
+		return err
+	}
+
+	loaded := map[string]bool{}
+	for _, name := range append(append([]string{}, options.PHP.Extensions...), options.PHP.ZendExtensions...) {
+		loaded[normalizeExtensionName(name)] = true
+	}
+
+	var missing, unavailable []string
+	for _, requirement := range requirements {
+		if loaded[requirement.Extension] {
+			continue
+		}
+
+		key := "ext-" + requirement.Extension
+		available, zend := m.config.Extensions.provides(versions, requirement.Extension)
+		if !available {
+			if listed, _ := m.config.Extensions.Lists(requirement.Extension); !listed || m.config.Extensions.builtinIn(versions, requirement.Extension) {
+				m.add(Finding{Rule: "composer-extensions", Outcome: OutcomePassed, File: requirement.Source, Key: key, Action: "not a loadable extension, assumed to be compiled into PHP"})
+				continue
+			}
+
+			problem := fmt.Sprintf("%s requires `%s`, which is not available in PHP %s", requirement.Source, key, strings.Join(versions, ", "))
+			if policy == FailComposerExtensions {
+				unavailable = append(unavailable, problem)
+				m.add(Finding{Rule: "composer-extensions", Outcome: OutcomeFailed, File: requirement.Source, Key: key, Action: "build failed, not available in the selected PHP version"})
+			} else {
+				m.warning("%s. `composer install` may fail", problem)
+				m.add(Finding{Rule: "composer-extensions", Outcome: OutcomeWarning, File: requirement.Source, Key: key, Action: "not available in the selected PHP version"})
+			}
+			continue
+		}
+
+		option := "PHP_EXTENSIONS"
+		if zend {
+			option = "ZEND_EXTENSIONS"
+		}
+
+		switch policy {
+		case AddComposerExtensions:
+			if zend {
+				options.PHP.ZendExtensions = append(options.PHP.ZendExtensions, requirement.Extension)
+			} else {
+				options.PHP.Extensions = append(options.PHP.Extensions, requirement.Extension)
+			}
+			m.warning("%s requires `%s`, which is missing from %s. Loading it as well", requirement.Source, key, option)
+			m.add(Finding{Rule: "composer-extensions", Outcome: OutcomeMigrated, File: requirement.Source, Key: key, Action: fmt.Sprintf("added to %s", option)})
+		case WarnComposerExtensions:
+			m.warning("%s requires `%s`, which is missing from %s. `composer install` may fail", requirement.Source, key, option)
+			m.add(Finding{Rule: "composer-extensions", Outcome: OutcomeWarning, File: requirement.Source, Key: key, Action: fmt.Sprintf("missing from %s", option)})
+		default:
+			missing = append(missing, fmt.Sprintf("%s requires `%s`, which is missing from %s", requirement.Source, key, option))
+			m.add(Finding{Rule: "composer-extensions", Outcome: OutcomeFailed, File: requirement.Source, Key: key, Action: fmt.Sprintf("build failed, missing from %s", option)})
+		}
+		loaded[requirement.Extension] = true
+	}
+
+	if len(missing) > 0 {
+		for _, problem := range missing {
+			m.error("%s", problem)
+		}
+		return fmt.Errorf("composer requires extensions that are not loaded, add them to options.json or set %s to `%s`:\n  %s", ComposerExtensionsEnv, AddComposerExtensions, strings.Join(append(missing, unavailable...), "\n  "))
+	}
+
+	if len(unavailable) > 0 {
+		for _, problem := range unavailable {
+			m.error("%s", problem)
+		}
+		return fmt.Errorf("composer requires extensions that the selected PHP version does not provide:\n  %s", strings.Join(unavailable, "\n  "))
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package compat
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffOp struct {
+	kind byte
+	text string
+}
+
+// unifiedDiff renders the changes between two versions of a file in unified diff format.  An empty before, for a
+// file that does not exist yet, is shown as a diff against /dev/null.
+func unifiedDiff(path string, before string, after string, created bool) string {
+	if before == after {
+		return ""
+	}
+
+	from := "a/" + path
+	if created {
+		from = "/dev/null"
+	}
+
+	ops := diffLines(splitLines(before), splitLines(after))
+
+	lines := []string{fmt.Sprintf("--- %s", from), fmt.Sprintf("+++ b/%s", path)}
+	for start := 0; start < len(ops); {
+		first := nextChange(ops, start)
+		if first == len(ops) {
+			break
+		}
+
+		// extend the hunk while the next change is close enough that the context would overlap
+		last := first
+		for next := nextChange(ops, last+1); next < len(ops) && next-last-1 <= 2*diffContext; next = nextChange(ops, last+1) {
+			last = next
+		}
+
+		hunkStart, hunkEnd := maxInt(first-diffContext, 0), minInt(last+diffContext+1, len(ops))
+		lines = append(lines, hunkHeader(ops, hunkStart, hunkEnd))
+		for _, op := range ops[hunkStart:hunkEnd] {
+			lines = append(lines, string(op.kind)+op.text)
+		}
+
+		start = hunkEnd
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// diffLines finds the longest common subsequence of lines and describes the edits around it
+func diffLines(a []string, b []string) []diffOp {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = maxInt(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+
+	return ops
+}
+
+func nextChange(ops []diffOp, start int) int {
+	for i := start; i < len(ops); i++ {
+		if ops[i].kind != ' ' {
+			return i
+		}
+	}
+	return len(ops)
+}
+
+func hunkHeader(ops []diffOp, from int, to int) string {
+	beforeStart, afterStart := 1, 1
+	for _, op := range ops[:from] {
+		if op.kind != '+' {
+			beforeStart++
+		}
+		if op.kind != '-' {
+			afterStart++
+		}
+	}
+
+	beforeLength, afterLength := 0, 0
+	for _, op := range ops[from:to] {
+		if op.kind != '+' {
+			beforeLength++
+		}
+		if op.kind != '-' {
+			afterLength++
+		}
+	}
+
+	// an empty range is numbered by the line before it
+	if beforeLength == 0 {
+		beforeStart--
+	}
+	if afterLength == 0 {
+		afterStart--
+	}
+
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", beforeStart, beforeLength, afterStart, afterLength)
+}
+
+func splitLines(contents string) []string {
+	if contents == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(contents, "\n"), "\n")
+}
+
+func maxInt(values ...int) int {
+	result := values[0]
+	for _, value := range values[1:] {
+		if value > result {
+			result = value
+		}
+	}
+	return result
+}
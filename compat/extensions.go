@@ -0,0 +1,396 @@
+package compat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/cloudfoundry/libcfbuildpack/buildpack"
+)
+
+// ExtensionCatalogMetadata is the buildpack.toml metadata table listing the extensions available for each PHP version
+const ExtensionCatalogMetadata = "php-extensions"
+
+// PHPExtensions are the extensions available for a single PHP minor version
+type PHPExtensions struct {
+	Extensions     []string
+	ZendExtensions []string
+	// Builtin are compiled into PHP, loading them again only produces "already loaded" warnings
+	Builtin []string
+}
+
+// ExtensionCatalog lists the extensions the PHP dist buildpack provides for each PHP minor version, such as `7.3`, and
+// suggests what to use instead of the extensions that were removed
+type ExtensionCatalog struct {
+	// Default is the minor version the PHP dist buildpack installs when PHP_VERSION is not set
+	Default      string
+	Versions     map[string]PHPExtensions
+	Replacements map[string]string
+}
+
+// NewExtensionCatalog reads the extension catalog out of the buildpack metadata.  A buildpack without a catalog does
+// not check extensions.
+func NewExtensionCatalog(metadata buildpack.Metadata) (ExtensionCatalog, error) {
+	catalog := ExtensionCatalog{Versions: map[string]PHPExtensions{}, Replacements: map[string]string{}}
+
+	raw, ok := metadata[ExtensionCatalogMetadata]
+	if !ok {
+		return catalog, nil
+	}
+
+	table, ok := raw.(map[string]interface{})
+	if !ok {
+		return ExtensionCatalog{}, fmt.Errorf("buildpack metadata %s must be a table", ExtensionCatalogMetadata)
+	}
+
+	if rawVersions, ok := table["versions"]; ok {
+		versions, ok := rawVersions.(map[string]interface{})
+		if !ok {
+			return ExtensionCatalog{}, fmt.Errorf("buildpack metadata %s.versions must be a table", ExtensionCatalogMetadata)
+		}
+
+		for version, rawExtensions := range versions {
+			if phpMinorVersionPattern.FindString(version) != version {
+				return ExtensionCatalog{}, fmt.Errorf("buildpack metadata %s.versions.%s must be named after a PHP minor version, such as 7.3", ExtensionCatalogMetadata, version)
+			}
+
+			lists, ok := rawExtensions.(map[string]interface{})
+			if !ok {
+				return ExtensionCatalog{}, fmt.Errorf("buildpack metadata %s.versions.%s must be a table", ExtensionCatalogMetadata, version)
+			}
+
+			extensions, err := metadataStrings(lists, fmt.Sprintf("%s.versions.%s", ExtensionCatalogMetadata, version), "extensions")
+			if err != nil {
+				return ExtensionCatalog{}, err
+			}
+
+			zendExtensions, err := metadataStrings(lists, fmt.Sprintf("%s.versions.%s", ExtensionCatalogMetadata, version), "zend_extensions")
+			if err != nil {
+				return ExtensionCatalog{}, err
+			}
+
+			builtin, err := metadataStrings(lists, fmt.Sprintf("%s.versions.%s", ExtensionCatalogMetadata, version), "builtin")
+			if err != nil {
+				return ExtensionCatalog{}, err
+			}
+
+			catalog.Versions[version] = PHPExtensions{Extensions: extensions, ZendExtensions: zendExtensions, Builtin: builtin}
+		}
+	}
+
+	if rawDefault, ok := table["default"]; ok {
+		version, ok := rawDefault.(string)
+		if !ok || phpMinorVersionPattern.FindString(version) != version {
+			return ExtensionCatalog{}, fmt.Errorf("buildpack metadata %s.default must be a PHP minor version, such as 7.4", ExtensionCatalogMetadata)
+		}
+		if _, ok := catalog.Versions[version]; !ok {
+			return ExtensionCatalog{}, fmt.Errorf("buildpack metadata %s.default must be one of the versions in %s.versions, found %s", ExtensionCatalogMetadata, ExtensionCatalogMetadata, version)
+		}
+		catalog.Default = version
+	}
+
+	if rawReplacements, ok := table["replacements"]; ok {
+		replacements, ok := rawReplacements.(map[string]interface{})
+		if !ok {
+			return ExtensionCatalog{}, fmt.Errorf("buildpack metadata %s.replacements must be a table", ExtensionCatalogMetadata)
+		}
+
+		for extension, rawReplacement := range replacements {
+			replacement, ok := rawReplacement.(string)
+			if !ok {
+				return ExtensionCatalog{}, fmt.Errorf("buildpack metadata %s.replacements.%s must be a string", ExtensionCatalogMetadata, extension)
+			}
+			catalog.Replacements[extension] = replacement
+		}
+	}
+
+	return catalog, nil
+}
+
+func metadataStrings(table map[string]interface{}, name string, key string) ([]string, error) {
+	raw, ok := table[key]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("buildpack metadata %s.%s must be a list of strings", name, key)
+	}
+
+	var values []string
+	for _, item := range list {
+		value, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("buildpack metadata %s.%s must be a list of strings", name, key)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// versions finds the catalogued PHP minor versions that a PHP_VERSION constraint allows.  An empty constraint is the
+// default PHP version, which is not checked when the catalog does not name it.
+func (c ExtensionCatalog) versions(phpVersion string) ([]string, error) {
+	if len(c.Versions) == 0 {
+		return nil, nil
+	}
+
+	if strings.TrimSpace(phpVersion) == "" {
+		if c.Default == "" {
+			return nil, nil
+		}
+		return []string{c.Default}, nil
+	}
+
+	var versions []string
+
+	if minor := phpMinorVersionPattern.FindString(phpVersion); minor != "" && !strings.ContainsAny(phpVersion, "<>=~^|, ") {
+		if _, ok := c.Versions[minor]; ok {
+			versions = append(versions, minor)
+		}
+		return versions, nil
+	}
+
+	constraint, err := semver.NewConstraint(phpVersion)
+	if err != nil {
+		return nil, fmt.Errorf("PHP_VERSION `%s` is not a valid version constraint: %s", phpVersion, err)
+	}
+
+	for version := range c.Versions {
+		// a minor version is allowed if any of its patch releases are
+		if constraint.Check(semver.MustParse(version+".0")) || constraint.Check(semver.MustParse(version+".999")) {
+			versions = append(versions, version)
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return compareMinorVersions(versions[i], versions[j]) < 0 })
+	return versions, nil
+}
+
+// Check explains each extension that is not available in every PHP version that phpVersion allows.  It fails if
+// phpVersion is not a valid version constraint.
+func (c ExtensionCatalog) Check(phpVersion string, extensions []string, zendExtensions []string) ([]string, error) {
+	versions, err := c.versions(phpVersion)
+	if err != nil || len(versions) == 0 {
+		return nil, err
+	}
+
+	problems := c.check(versions, "PHP_EXTENSIONS", extensions, false, "list it in ZEND_EXTENSIONS instead")
+	return append(problems, c.check(versions, "ZEND_EXTENSIONS", zendExtensions, true, "list it in PHP_EXTENSIONS instead")...), nil
+}
+
+// available keeps the extensions, or Zend extensions, that every PHP version that phpVersion allows provides
+func (c ExtensionCatalog) available(phpVersion string, names []string, zend bool) ([]string, error) {
+	versions, err := c.versions(phpVersion)
+	if err != nil || len(versions) == 0 {
+		return names, err
+	}
+
+	var available []string
+	for _, name := range names {
+		if len(c.check(versions, "", []string{name}, zend, "")) == 0 {
+			available = append(available, name)
+		}
+	}
+	return available, nil
+}
+
+// check explains each of the extensions or Zend extensions loaded through option that is not available in every one of
+// versions.  misplaced is the advice given for an extension of the other kind.
+func (c ExtensionCatalog) check(versions []string, option string, names []string, zend bool, misplaced string) []string {
+	kind := func(e PHPExtensions) []string { return e.Extensions }
+	other := func(e PHPExtensions) []string { return e.ZendExtensions }
+	if zend {
+		kind, other = other, kind
+	}
+
+	var problems []string
+	for _, name := range names {
+		var (
+			missing     []string
+			isMisplaced bool
+		)
+		for _, version := range versions {
+			if !containsString(kind(c.Versions[version]), name) {
+				missing = append(missing, version)
+				isMisplaced = isMisplaced || containsString(other(c.Versions[version]), name)
+			}
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+
+		problem := fmt.Sprintf("%s `%s` is not available in PHP %s", option, name, strings.Join(missing, ", "))
+		switch {
+		case isMisplaced:
+			problem += ", " + misplaced
+		case c.Replacements[name] != "":
+			problem += ", " + c.Replacements[name]
+		default:
+			if suggestion := c.suggest(name, kind(c.Versions[missing[0]])); suggestion != "" {
+				problem += fmt.Sprintf(", did you mean `%s`?", suggestion)
+			}
+		}
+		problems = append(problems, problem)
+	}
+
+	return problems
+}
+
+// suggest finds the available extension closest to a misspelled one
+func (c ExtensionCatalog) suggest(name string, available []string) string {
+	normalized := strings.ToLower(strings.TrimSpace(name))
+
+	suggestion, best := "", 3
+	for _, extension := range available {
+		if extension == normalized {
+			return extension
+		}
+
+		if distance := levenshtein(normalized, extension); distance < best {
+			suggestion, best = extension, distance
+		}
+	}
+
+	return suggestion
+}
+
+// allVersions lists every PHP minor version in the catalog, oldest first
+func (c ExtensionCatalog) allVersions() []string {
+	var versions []string
+	for version := range c.Versions {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return compareMinorVersions(versions[i], versions[j]) < 0 })
+	return versions
+}
+
+// provides reports whether any of versions can load an extension, and whether it is a Zend extension
+func (c ExtensionCatalog) provides(versions []string, name string) (bool, bool) {
+	for _, version := range versions {
+		if containsString(c.Versions[version].ZendExtensions, name) {
+			return true, true
+		}
+		if containsString(c.Versions[version].Extensions, name) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// builtinIn reports whether an extension is compiled into every one of versions
+func (c ExtensionCatalog) builtinIn(versions []string, name string) bool {
+	for _, version := range versions {
+		if !containsString(c.Versions[version].Builtin, name) {
+			return false
+		}
+	}
+	return len(versions) > 0
+}
+
+// Lists reports whether any PHP version in the catalog lists an extension, and whether it is a Zend extension
+func (c ExtensionCatalog) Lists(name string) (bool, bool) {
+	for _, extensions := range c.Versions {
+		if containsString(extensions.ZendExtensions, name) {
+			return true, true
+		}
+		if containsString(extensions.Extensions, name) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// Builtin reports whether an extension is compiled into every PHP version that phpVersion allows.  Nothing is built
+// into an invalid constraint, which Check reports.
+func (c ExtensionCatalog) Builtin(phpVersion string, name string) bool {
+	versions, _ := c.versions(phpVersion)
+	return c.builtinIn(versions, name)
+}
+
+// extensionDependencies lists the extensions that must be loaded before an extension, for the ones whose load order
+// matters
+var extensionDependencies = map[string][]string{
+	"apcu_bc":      {"apcu"},
+	"memcached":    {"igbinary", "msgpack"},
+	"opcache":      {"ioncube"},
+	"pdo_firebird": {"pdo"},
+	"pdo_mysql":    {"pdo"},
+	"pdo_odbc":     {"pdo"},
+	"pdo_pgsql":    {"pdo"},
+	"pdo_sqlite":   {"pdo"},
+	"pdo_sqlsrv":   {"pdo"},
+	"phalcon":      {"psr"},
+	"redis":        {"igbinary", "msgpack"},
+	"xdebug":       {"ioncube"},
+}
+
+// normalizeExtensionName turns the ways v2 accepted an extension, such as `Redis` or `redis.so`, into its name
+func normalizeExtensionName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".so")
+}
+
+// orderExtensions moves the extensions that others depend on ahead of them, otherwise keeping the order they were
+// listed in
+func orderExtensions(names []string) []string {
+	listed := map[string]bool{}
+	for _, name := range names {
+		listed[name] = true
+	}
+
+	var (
+		ordered []string
+		visited = map[string]bool{}
+		visit   func(name string)
+	)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+
+		for _, dependency := range extensionDependencies[name] {
+			if listed[dependency] {
+				visit(dependency)
+			}
+		}
+		ordered = append(ordered, name)
+	}
+
+	for _, name := range names {
+		visit(name)
+	}
+	return ordered
+}
+
+// normalizeExtensions normalises the names in an extension option, dropping duplicates and the extensions compiled
+// into PHP, and orders them so that dependencies load first
+func (m *migration) normalizeExtensions(option string, phpVersion string, names []string) []string {
+	var (
+		normalized []string
+		seen       = map[string]bool{}
+	)
+	for _, name := range names {
+		extension := normalizeExtensionName(name)
+
+		if seen[extension] {
+			m.warning("%s lists `%s` more than once, loading it once", option, extension)
+			m.add(Finding{Rule: "extensions", Outcome: OutcomeWarning, File: optionsJSONPath, Key: option, Action: fmt.Sprintf("duplicate `%s` dropped", name)})
+			continue
+		}
+		seen[extension] = true
+
+		if m.config.Extensions.Builtin(phpVersion, extension) {
+			m.warning("%s lists `%s`, which is compiled into PHP and does not need to be loaded", option, extension)
+			m.add(Finding{Rule: "extensions", Outcome: OutcomeWarning, File: optionsJSONPath, Key: option, Action: fmt.Sprintf("built in `%s` dropped", extension)})
+			continue
+		}
+
+		normalized = append(normalized, extension)
+	}
+
+	return orderExtensions(normalized)
+}
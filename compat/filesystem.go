@@ -0,0 +1,65 @@
+package compat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+)
+
+// FileSystem is where the migration reads the application from and writes the migrated files to.  Paths are
+// absolute.  Implementations must return errors that satisfy os.IsNotExist for files that do not exist.
+type FileSystem interface {
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, mode os.FileMode, contents []byte) error
+	Stat(path string) (os.FileInfo, error)
+	Walk(root string, walkFn filepath.WalkFunc) error
+}
+
+// OSFileSystem is the FileSystem of the machine the migration runs on
+type OSFileSystem struct{}
+
+func (OSFileSystem) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func (OSFileSystem) WriteFile(path string, mode os.FileMode, contents []byte) error {
+	return helper.WriteFile(path, mode, "%s", contents)
+}
+
+func (OSFileSystem) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (OSFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(root, walkFn)
+}
+
+func fileExists(fs FileSystem, path string) (bool, error) {
+	_, err := fs.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// findFiles lists the files under root whose path matches pattern, like helper.FindFiles
+func findFiles(fs FileSystem, root string, pattern *regexp.Regexp) ([]string, error) {
+	var files []string
+	err := fs.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && pattern.MatchString(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+
+	return files, err
+}
@@ -0,0 +1,572 @@
+package compat
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/paketo-buildpacks/php-web/config"
+)
+
+// HTTPDSnippet is the user include holding the configuration migrated from `.bp-config/httpd`.  The PHP web buildpack
+// includes `.httpd.conf.d/*.conf` at the end of its httpd.conf.
+const HTTPDSnippet = ".httpd.conf.d/00-compat-httpd.conf"
+
+// legacyHTTPDConfigDir held the v2 httpd configuration, copied over the stock `conf/` folder of httpd
+var legacyHTTPDConfigDir = filepath.Join(".bp-config", "httpd")
+
+// ownedHTTPDDirectives are set by httpd-cnb or the PHP web buildpack, v2 values for them are dropped
+var ownedHTTPDDirectives = map[string]string{
+	"documentroot": "the PHP web buildpack serves WEBDIR, set WEBDIR in options.json to change it",
+	"errorlog":     "httpd logs to standard error so the platform collects its logs",
+	"group":        "httpd runs as the user of the image",
+	"pidfile":      "the PHP web buildpack manages the httpd process",
+	"serveradmin":  "set `php.serveradmin` in buildpack.yml instead",
+	"servername":   "the PHP web buildpack sets the server name",
+	"serverroot":   "httpd-cnb installs httpd and sets its server root",
+	"user":         "httpd runs as the user of the image",
+}
+
+// bundledHTTPDModules are the modules built with the httpd that httpd-cnb installs, under its `modules/` folder
+var bundledHTTPDModules = []string{
+	"access_compat", "actions", "alias", "allowmethods", "asis", "auth_basic", "auth_digest", "auth_form",
+	"authn_anon", "authn_core", "authn_dbd", "authn_dbm", "authn_file", "authn_socache", "authnz_fcgi", "authnz_ldap",
+	"authz_core", "authz_dbd", "authz_dbm", "authz_groupfile", "authz_host", "authz_owner", "authz_user", "autoindex",
+	"buffer", "cache", "cache_disk", "cache_socache", "cgid", "charset_lite", "data", "dbd", "deflate", "dir",
+	"dumpio", "echo", "env", "expires", "ext_filter", "file_cache", "filter", "headers", "heartbeat", "heartmonitor",
+	"include", "info", "lbmethod_bybusyness", "lbmethod_byrequests", "lbmethod_bytraffic", "lbmethod_heartbeat",
+	"ldap", "log_config", "log_debug", "log_forensic", "logio", "lua", "macro", "mime", "mime_magic", "mpm_event",
+	"negotiation", "proxy", "proxy_ajp", "proxy_balancer", "proxy_connect", "proxy_express", "proxy_fcgi",
+	"proxy_fdpass", "proxy_ftp", "proxy_hcheck", "proxy_html", "proxy_http", "proxy_scgi", "proxy_uwsgi",
+	"proxy_wstunnel", "ratelimit", "reflector", "remoteip", "reqtimeout", "request", "rewrite", "sed", "session",
+	"session_cookie", "session_crypto", "session_dbd", "setenvif", "slotmem_plain", "slotmem_shm", "socache_dbm",
+	"socache_memcache", "socache_shmcb", "speling", "ssl", "status", "substitute", "unique_id", "unixd", "userdir",
+	"usertrack", "version", "vhost_alias", "watchdog", "xml2enc",
+}
+
+// httpdFPMMarkers show that a directive connects httpd to PHP-FPM, which the PHP web buildpack does itself
+var httpdFPMMarkers = []string{"PHP_FPM_LISTEN", "fcgi-listener", "proxy:fcgi"}
+
+// httpdDirective is a directive, or a section and the directives inside it, from an Apache configuration file
+type httpdDirective struct {
+	Name string
+	Args string
+	Line int
+	// Raw is the directive, or the opening tag of a section, as written
+	Raw string
+	// Close is the closing tag of a section, empty for a directive
+	Close    string
+	Children []httpdDirective
+}
+
+func (d httpdDirective) section() bool {
+	return d.Close != ""
+}
+
+// normalized ignores case, whitespace and comments, to compare directives by what they do
+func (d httpdDirective) normalized() string {
+	parts := []string{strings.ToLower(d.Name) + " " + strings.Join(strings.Fields(d.Args), " ")}
+	if d.section() {
+		parts[0] = "<" + parts[0]
+	}
+	for _, child := range d.Children {
+		parts = append(parts, child.normalized())
+	}
+	return strings.Join(parts, "\n")
+}
+
+// lines is the number of lines the directive, or the opening tag of a section, spans
+func (d httpdDirective) lines() int {
+	return strings.Count(d.Raw, "\n") + 1
+}
+
+// parseHTTPDConf reads the directives and sections of an Apache configuration file, returning a problem, prefixed with
+// its line number, for each section that is not properly opened or closed
+func parseHTTPDConf(contents []byte) ([]httpdDirective, []string) {
+	var (
+		problems []string
+		stack    = []httpdDirective{{}}
+	)
+
+	lines := strings.Split(string(contents), "\n")
+	for i := 0; i < len(lines); i++ {
+		number := i + 1
+		raw := strings.TrimRight(lines[i], "\r")
+		logical := raw
+		for strings.HasSuffix(logical, `\`) && i+1 < len(lines) {
+			i++
+			next := strings.TrimRight(lines[i], "\r")
+			raw += "\n" + next
+			logical = strings.TrimSuffix(logical, `\`) + " " + next
+		}
+
+		trimmed := strings.TrimSpace(logical)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			continue
+
+		case strings.HasPrefix(trimmed, "</"):
+			name := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(trimmed, "</"), ">"))
+			if len(stack) == 1 {
+				problems = append(problems, fmt.Sprintf("line %d: `%s` closes a section that was never opened", number, trimmed))
+				continue
+			}
+
+			section := stack[len(stack)-1]
+			if !strings.EqualFold(name, section.Name) {
+				problems = append(problems, fmt.Sprintf("line %d: `%s` does not close `<%s>` from line %d", number, trimmed, section.Name, section.Line))
+				continue
+			}
+
+			section.Close = raw
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1].Children = append(stack[len(stack)-1].Children, section)
+
+		case strings.HasPrefix(trimmed, "<"):
+			end := strings.LastIndex(trimmed, ">")
+			if end < 0 {
+				problems = append(problems, fmt.Sprintf("line %d: `%s` is missing its closing `>`", number, trimmed))
+				continue
+			}
+
+			name, args := splitHTTPDDirective(trimmed[1:end])
+			stack = append(stack, httpdDirective{Name: name, Args: args, Line: number, Raw: raw})
+
+		default:
+			name, args := splitHTTPDDirective(trimmed)
+			top := &stack[len(stack)-1]
+			top.Children = append(top.Children, httpdDirective{Name: name, Args: args, Line: number, Raw: raw})
+		}
+	}
+
+	for _, section := range stack[1:] {
+		problems = append(problems, fmt.Sprintf("line %d: `<%s>` is never closed", section.Line, section.Name))
+	}
+
+	return stack[0].Children, problems
+}
+
+func splitHTTPDDirective(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	return fields[0], strings.TrimSpace(text[len(fields[0]):])
+}
+
+// stockHTTPDConf reads the top level directives and the modules of the httpd.conf that the PHP web buildpack generates.
+// The HTTPS redirect can be disabled, so its directives are left out.
+func stockHTTPDConf(applicationPath string, webDir string) (map[string]bool, map[string]bool, error) {
+	tmpl, err := template.New("httpd.conf").Parse(config.HttpdConfTemplate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, config.HttpdConfig{AppRoot: applicationPath, WebDirectory: webDir, ServerAdmin: "admin@localhost", DisableHTTPSRedirect: true}); err != nil {
+		return nil, nil, err
+	}
+
+	directives, problems := parseHTTPDConf(buf.Bytes())
+	if len(problems) > 0 {
+		return nil, nil, fmt.Errorf("unable to read the stock httpd.conf:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	stock, modules := map[string]bool{}, map[string]bool{}
+	for _, directive := range directives {
+		stock[directive.normalized()] = true
+		if strings.EqualFold(directive.Name, "LoadModule") {
+			modules[strings.Fields(directive.Args)[0]] = true
+		}
+	}
+	return stock, modules, nil
+}
+
+// stockHTTPDIncludes are the includes of the stock v2 httpd.conf, which v2 started from when the application did not
+// have its own
+func stockHTTPDIncludes() []httpdDirective {
+	versions := stockServerConfigs["httpd/httpd.conf"]
+	directives, _ := parseHTTPDConf([]byte(versions[len(versions)-1]))
+
+	var includes []httpdDirective
+	for _, directive := range directives {
+		if strings.EqualFold(directive.Name, "Include") {
+			includes = append(includes, directive)
+		}
+	}
+	return includes
+}
+
+// httpdTranslator translates the v2 httpd configuration, following its includes, into a single user include
+type httpdTranslator struct {
+	m            *migration
+	placeholders snippetPlaceholders
+	stock        map[string]bool
+	stockModules map[string]bool
+	// files are the `.conf` files under `.bp-config/httpd`, relative to it with forward slashes
+	files   []string
+	visited map[string]bool
+	out     []string
+	// header is the source of the last `# From` comment written to out
+	header   string
+	problems []string
+	// diffs show how the failing files differ from their stock v2 versions
+	diffs []string
+}
+
+// httpdSource is a file being translated, with the problems found expanding its placeholders by line
+type httpdSource struct {
+	File     string
+	Problems map[int][]string
+	Failed   bool
+	// LeftOut is set when a directive that cannot be migrated was only reported, as the rule is a warning
+	LeftOut bool
+}
+
+// MigrateHTTPDConf translates the v2 httpd configuration under `.bp-config/httpd` into HTTPDSnippet.  Directives that
+// httpd-cnb or the PHP web buildpack already set are dropped, and the build only fails for the ones that cannot work
+// with v3 at all.  Only the files included from httpd.conf, the application's or the stock v2 one, are translated.
+func (m *migration) MigrateHTTPDConf(options Options) error {
+	if !m.enabled("custom-httpd") {
+		return nil
+	}
+
+	root := filepath.Join(m.appRoot, legacyHTTPDConfigDir)
+
+	exists, err := fileExists(m.fs, root)
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	if exists {
+		found, err := findFiles(m.fs, root, regexp.MustCompile(`\.conf$`))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range found {
+			relative, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(relative))
+		}
+	}
+
+	if len(files) == 0 {
+		m.add(Finding{Rule: "custom-httpd", Outcome: OutcomePassed, Action: "no HTTPD configuration under .bp-config/httpd"})
+		return nil
+	}
+
+	placeholders := newSnippetPlaceholders(m.config.ApplicationPath, options)
+
+	stock, stockModules, err := stockHTTPDConf(m.config.ApplicationPath, placeholders.webDir)
+	if err != nil {
+		return err
+	}
+
+	t := &httpdTranslator{m: m, placeholders: placeholders, stock: stock, stockModules: stockModules, files: files, visited: map[string]bool{}}
+
+	// v2 started from httpd.conf, the other files only took effect when it included them
+	start := "httpd.conf"
+	if containsString(files, "httpd.conf") {
+		if err := t.file("httpd.conf"); err != nil {
+			return err
+		}
+	} else {
+		start = "the stock v2 httpd.conf"
+		for _, include := range stockHTTPDIncludes() {
+			if _, err := t.reach(strings.TrimPrefix(include.Args, "conf/")); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, file := range files {
+		if !t.visited[file] {
+			m.skipUnreached(path.Join(filepath.ToSlash(legacyHTTPDConfigDir), file), fmt.Sprintf("not included from %s, v2 never loaded it", start))
+		}
+	}
+
+	if len(t.problems) > 0 {
+		for _, problem := range t.problems {
+			m.error("%s", problem)
+		}
+		for _, diff := range t.diffs {
+			m.error("%s", diff)
+		}
+		return fmt.Errorf("unable to migrate the HTTPD configuration under `.bp-config/httpd`:\n  %s%s", strings.Join(t.problems, "\n  "), strings.Join(append([]string{""}, t.diffs...), "\n"))
+	}
+
+	if len(t.out) == 0 {
+		return nil
+	}
+
+	contents := fmt.Sprintf("# Migrated from .bp-config/httpd, only the directives that the PHP web buildpack does not already set\n%s\n", strings.Join(t.out, "\n"))
+	err = m.workspace.WriteFile(HTTPDSnippet, 0644, []byte(contents))
+	if err != nil {
+		return err
+	}
+
+	m.warning("Found HTTPD configuration under `.bp-config/httpd`. This is no longer supported. Moving the directives httpd still needs to `%s`", HTTPDSnippet)
+	m.report.Generated(HTTPDSnippet)
+	return nil
+}
+
+// file translates a file under `.bp-config/httpd` the first time it is reached
+func (t *httpdTranslator) file(name string) error {
+	if t.visited[name] {
+		return nil
+	}
+	t.visited[name] = true
+
+	source := &httpdSource{File: filepath.ToSlash(filepath.Join(legacyHTTPDConfigDir, name)), Problems: map[int][]string{}}
+
+	contents, err := t.m.fs.ReadFile(filepath.Join(t.m.appRoot, legacyHTTPDConfigDir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+
+	if isStockServerConfig(path.Join("httpd", name), contents) {
+		t.m.warning("%s is an unchanged copy of the stock v2 file and can be deleted", source.File)
+		t.m.add(Finding{Rule: "custom-httpd", Outcome: OutcomeWarning, File: source.File, Action: "unchanged stock v2 file, can be deleted"})
+		return nil
+	}
+	defer t.diff(source, name, contents)
+
+	directives, problems := parseHTTPDConf(t.expand(source, contents))
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			t.fail(source, httpdDirective{}, problem)
+		}
+		return nil
+	}
+
+	var migrated int
+	for _, directive := range directives {
+		lines, err := t.directive(source, directive, true)
+		if err != nil {
+			return err
+		}
+
+		if len(lines) == 0 {
+			continue
+		}
+
+		if t.header != source.File {
+			t.out = append(t.out, "", "# From "+source.File)
+			t.header = source.File
+		}
+		t.out = append(t.out, lines...)
+		migrated++
+	}
+
+	switch {
+	case source.Failed, source.LeftOut && migrated == 0:
+	case migrated == 0:
+		t.m.add(Finding{Rule: "custom-httpd", Outcome: OutcomePassed, File: source.File, Action: "nothing to migrate, the PHP web buildpack already configures httpd the same way"})
+	default:
+		t.m.add(Finding{Rule: "custom-httpd", Outcome: OutcomeMigrated, File: source.File, Action: fmt.Sprintf("%d directive(s) written to %s", migrated, HTTPDSnippet)})
+	}
+	return nil
+}
+
+// diff keeps the difference between a failing file and its stock v2 version, so that only what was changed has to be
+// reviewed
+func (t *httpdTranslator) diff(source *httpdSource, name string, contents []byte) {
+	if !source.Failed {
+		return
+	}
+	if diff := stockServerConfigDiff(path.Join("httpd", name), source.File, contents); diff != "" {
+		t.diffs = append(t.diffs, diff)
+	}
+}
+
+// expand replaces the v2 placeholders, and `${HOME}` which no longer points at the application, outside of comments.
+// Placeholders that cannot be translated are left in place and only fail the build if their directive is migrated.
+func (t *httpdTranslator) expand(source *httpdSource, contents []byte) []byte {
+	lines := strings.Split(string(contents), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		line = strings.Replace(line, "${HOME}", t.placeholders.home, -1)
+		line, _, problems := t.placeholders.expandLine(line)
+		if len(problems) > 0 {
+			source.Problems[i+1] = problems
+		}
+		lines[i] = line
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// directive translates a directive, or a section and the directives inside it, into the lines to migrate
+func (t *httpdTranslator) directive(source *httpdSource, d httpdDirective, top bool) ([]string, error) {
+	for _, marker := range httpdFPMMarkers {
+		if strings.Contains(d.Raw, marker) {
+			t.drop(source, d, "the PHP web buildpack connects httpd to PHP-FPM")
+			return nil, nil
+		}
+	}
+
+	if top && t.stock[d.normalized()] {
+		return nil, nil
+	}
+
+	if d.section() {
+		var children []string
+		for _, child := range d.Children {
+			lines, err := t.directive(source, child, false)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, lines...)
+		}
+
+		// sections left empty only held directives that were dropped
+		if len(children) == 0 || !t.expanded(source, d) {
+			return nil, nil
+		}
+		return append(append([]string{d.Raw}, children...), d.Close), nil
+	}
+
+	switch name := strings.ToLower(d.Name); name {
+	case "include", "includeoptional":
+		if top {
+			handled, err := t.include(source, d)
+			if handled || err != nil {
+				return nil, err
+			}
+		}
+
+	case "listen":
+		if !strings.Contains(d.Args, "${PORT}") {
+			t.fail(source, d, "httpd must listen on $PORT, where the platform sends requests")
+			return nil, nil
+		}
+		t.drop(source, d, "httpd-cnb listens on $PORT")
+		return nil, nil
+
+	case "loadmodule":
+		return t.loadModule(source, d), nil
+
+	default:
+		if reason, owned := ownedHTTPDDirectives[name]; owned {
+			t.drop(source, d, reason)
+			return nil, nil
+		}
+	}
+
+	if !t.expanded(source, d) {
+		return nil, nil
+	}
+	return []string{d.Raw}, nil
+}
+
+// include translates the files from `.bp-config/httpd` that an include of the v2 `conf/` folder reached in place.  It
+// reports whether the include was handled, includes of anything else are migrated as they are.
+func (t *httpdTranslator) include(source *httpdSource, d httpdDirective) (bool, error) {
+	pattern := strings.Trim(d.Args, `"'`)
+	if !strings.HasPrefix(pattern, "conf/") {
+		return false, nil
+	}
+
+	matched, err := t.reach(strings.TrimPrefix(pattern, "conf/"))
+	if err != nil {
+		return true, err
+	}
+
+	if !matched {
+		t.m.info("%s line %d: `%s` is dropped, the PHP web buildpack configures httpd in place of the stock v2 file", source.File, d.Line, d.Args)
+	}
+	return true, nil
+}
+
+// reach translates the files from `.bp-config/httpd` that match a pattern relative to the v2 `conf/` folder, reporting
+// whether there were any
+func (t *httpdTranslator) reach(pattern string) (bool, error) {
+	var matched bool
+	for _, file := range t.files {
+		if ok, _ := path.Match(pattern, file); ok {
+			matched = true
+			if err := t.file(file); err != nil {
+				return true, err
+			}
+		}
+	}
+	return matched, nil
+}
+
+// loadModule keeps the modules bundled with httpd-cnb that the PHP web buildpack does not load already
+func (t *httpdTranslator) loadModule(source *httpdSource, d httpdDirective) []string {
+	fields := strings.Fields(d.Args)
+	if len(fields) != 2 {
+		t.fail(source, d, "`LoadModule` expects a module name and a file")
+		return nil
+	}
+
+	if t.stockModules[fields[0]] {
+		return nil
+	}
+
+	file := strings.Trim(fields[1], `"'`)
+	module := strings.TrimSuffix(strings.TrimPrefix(path.Base(file), "mod_"), ".so")
+
+	switch {
+	case strings.HasPrefix(module, "mpm_"):
+		t.fail(source, d, fmt.Sprintf("httpd-cnb runs the event MPM, `%s` cannot be loaded alongside it", fields[0]))
+		return nil
+	case !strings.HasPrefix(file, "modules/") || !containsString(bundledHTTPDModules, module):
+		t.fail(source, d, fmt.Sprintf("`%s` is not bundled with httpd-cnb, only the modules under `modules/` can be loaded", file))
+		return nil
+	}
+
+	if !t.expanded(source, d) {
+		return nil
+	}
+	return []string{d.Raw}
+}
+
+// expanded fails a directive that is migrated with placeholders that could not be translated
+func (t *httpdTranslator) expanded(source *httpdSource, d httpdDirective) bool {
+	ok := true
+	for line := d.Line; line < d.Line+d.lines(); line++ {
+		for _, problem := range source.Problems[line] {
+			t.fail(source, httpdDirective{Name: d.Name, Line: line}, problem)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func (t *httpdTranslator) drop(source *httpdSource, d httpdDirective, reason string) {
+	t.m.warning("%s line %d: `%s` is dropped, %s", source.File, d.Line, d.Name, reason)
+	t.m.add(Finding{Rule: "custom-httpd", Outcome: OutcomeWarning, File: source.File, Key: d.Name, Action: "dropped, " + reason})
+}
+
+// fail records a directive that cannot be migrated, which fails the build unless the rule is a warning.  Without a
+// directive the problem carries its own line number.
+func (t *httpdTranslator) fail(source *httpdSource, d httpdDirective, problem string) {
+	if d.Line > 0 {
+		problem = fmt.Sprintf("line %d: %s", d.Line, problem)
+	}
+
+	if t.m.config.Rules.Severity("custom-httpd") == SeverityWarn {
+		source.LeftOut = true
+		t.m.warning("%s %s, it is left out", source.File, problem)
+		t.m.add(Finding{Rule: "custom-httpd", Outcome: OutcomeWarning, File: source.File, Key: d.Name, Action: "left out, " + problem})
+		t.m.leaveOut(source.File, "left out, "+problem)
+		return
+	}
+
+	source.Failed = true
+	t.problems = append(t.problems, fmt.Sprintf("%s %s", source.File, problem))
+	t.m.add(Finding{Rule: "custom-httpd", Outcome: OutcomeFailed, File: source.File, Key: d.Name, Action: "build failed, " + problem})
+}
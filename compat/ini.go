@@ -0,0 +1,314 @@
+package compat
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// iniEntry is a single `key = value` directive in a php.ini or php-fpm file
+type iniEntry struct {
+	Section string
+	Key     string
+	// Value is the directive's value with quotes and trailing comments removed, Raw is the value as written
+	Value string
+	Raw   string
+	Line  int
+}
+
+// parseINI reads the directives in the ini dialect shared by php.ini and php-fpm.conf.  Comments, blank lines and
+// lines holding only a v2 placeholder, such as `#{PHP_EXTENSIONS}`, are skipped.  It returns a problem, prefixed with
+// its line number, for each line it cannot read.
+func parseINI(contents []byte) ([]iniEntry, []string) {
+	var (
+		entries  []iniEntry
+		problems []string
+		section  string
+	)
+
+	for i, line := range strings.Split(string(contents), "\n") {
+		number := i + 1
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "", strings.HasPrefix(trimmed, ";"), strings.HasPrefix(trimmed, "#"):
+			continue
+		case snippetPlaceholderPattern.FindString(trimmed) == trimmed:
+			continue
+		case strings.HasPrefix(trimmed, "["):
+			end := strings.Index(trimmed, "]")
+			if end < 0 {
+				problems = append(problems, fmt.Sprintf("line %d: section `%s` is missing its closing `]`", number, trimmed))
+				continue
+			}
+			section = strings.TrimSpace(trimmed[1:end])
+			continue
+		}
+
+		separator := strings.Index(trimmed, "=")
+		if separator < 0 {
+			problems = append(problems, fmt.Sprintf("line %d: expected `key = value`, found `%s`", number, trimmed))
+			continue
+		}
+
+		key := strings.TrimSpace(trimmed[:separator])
+		if key == "" {
+			problems = append(problems, fmt.Sprintf("line %d: `%s` has no key", number, trimmed))
+			continue
+		}
+
+		value, raw, err := parseINIValue(trimmed[separator+1:])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: %s", number, err))
+			continue
+		}
+
+		entries = append(entries, iniEntry{Section: section, Key: key, Value: value, Raw: raw, Line: number})
+	}
+
+	return entries, problems
+}
+
+// parseINIValue removes the quotes and trailing comment from a value
+func parseINIValue(text string) (string, string, error) {
+	text = strings.TrimSpace(text)
+
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+		quote := text[:1]
+		end := strings.Index(text[1:], quote)
+		if end < 0 {
+			return "", "", fmt.Errorf("value `%s` is missing its closing %s", text, quote)
+		}
+
+		rest := strings.TrimSpace(text[end+2:])
+		if rest != "" && !strings.HasPrefix(rest, ";") {
+			return "", "", fmt.Errorf("unexpected `%s` after the quoted value", rest)
+		}
+
+		return text[1 : end+1], text[:end+2], nil
+	}
+
+	if comment := strings.Index(text, ";"); comment >= 0 {
+		text = strings.TrimSpace(text[:comment])
+	}
+
+	return text, text, nil
+}
+
+// isScopedPHPIniSection reports whether a php.ini section applies its directives only to some paths or hosts, the other
+// sections are just headings
+func isScopedPHPIniSection(section string) bool {
+	upper := strings.ToUpper(section)
+	return strings.HasPrefix(upper, "PATH=") || strings.HasPrefix(upper, "HOST=")
+}
+
+// normalizeINIValue lets values that PHP treats the same compare equal, such as `On`, `1` and `true`
+func normalizeINIValue(value string) string {
+	switch strings.ToLower(value) {
+	case "on", "yes", "true", "1":
+		return "1"
+	case "off", "no", "false", "none", "0", "":
+		return "0"
+	}
+	return value
+}
+
+// snippetDirective is where a directive is set among the snippets
+type snippetDirective struct {
+	entry iniEntry
+	file  string
+	// migrated is false for the snippets written for v3 that were in the application already
+	migrated bool
+}
+
+func (d snippetDirective) String() string {
+	return fmt.Sprintf("%s line %d", d.file, d.entry.Line)
+}
+
+// snippetFiles lists the snippets in dir, relative to the application: the ones the migration generated and the ones
+// ending in ext that the application already had.  The PHP web buildpack does not look into subdirectories, so the
+// snippets in them are left out.
+func (m *migration) snippetFiles(dir string, ext string) ([]string, map[string]bool, error) {
+	var (
+		files    []string
+		migrated = map[string]bool{}
+	)
+	for _, file := range m.report.GeneratedFiles {
+		if filepath.Dir(file) == dir {
+			files = append(files, file)
+			migrated[file] = true
+		}
+	}
+
+	exists, err := fileExists(m.fs, filepath.Join(m.appRoot, dir))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if exists {
+		existing, err := findFiles(m.fs, filepath.Join(m.appRoot, dir), regexp.MustCompile(regexp.QuoteMeta("."+ext)+"$"))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, path := range existing {
+			if file := m.relative(path); filepath.Dir(file) == dir && !migrated[file] {
+				files = append(files, file)
+			}
+		}
+	}
+
+	// snippets are loaded in alphabetical order
+	sort.Strings(files)
+	return files, migrated, nil
+}
+
+// ValidateSnippets parses the php.ini and php-fpm snippets the migration generated, together with the ones the
+// application already had.  Syntax errors, extensions the selected PHP version does not provide and a directive set
+// to different values in more than one migrated snippet fail the migration, unless the `snippet-validation` rule is a
+// warning.  The same value set twice, or a value that a snippet written for v3 overrides, is a warning.
+func (m *migration) ValidateSnippets(options Options) error {
+	if !m.enabled("snippet-validation") {
+		return nil
+	}
+
+	var problems []string
+
+	outcome, action := OutcomeFailed, "build failed, "
+	if m.config.Rules.Severity("snippet-validation") == SeverityWarn {
+		outcome, action = OutcomeWarning, ""
+	}
+
+	for _, dir := range []struct{ path, ext string }{{phpIniSnippetDir, "ini"}, {phpFpmSnippetDir, "conf"}} {
+		files, migrated, err := m.snippetFiles(dir.path, dir.ext)
+		if err != nil {
+			return err
+		}
+
+		var (
+			keys       []string
+			directives = map[string][]snippetDirective{}
+		)
+		for _, file := range files {
+			contents, _, err := m.workspace.ReadFile(file)
+			if err != nil {
+				return err
+			}
+
+			entries, fileProblems := parseINI(contents)
+			for _, problem := range fileProblems {
+				problems = append(problems, fmt.Sprintf("%s %s", file, problem))
+			}
+
+			for _, entry := range entries {
+				if dir.path == phpIniSnippetDir {
+					for _, problem := range m.checkSnippetExtension(options.PHP.Version, entry) {
+						problem = fmt.Sprintf("%s line %d: %s", file, entry.Line, problem)
+						problems = append(problems, problem)
+						m.add(Finding{Rule: "snippet-validation", Outcome: outcome, File: file, Key: entry.Key, Action: action + problem})
+					}
+				}
+
+				key := snippetDirectiveKey(dir.path, entry)
+				if _, ok := directives[key]; !ok {
+					keys = append(keys, key)
+				}
+				directives[key] = append(directives[key], snippetDirective{entry: entry, file: file, migrated: migrated[file]})
+			}
+		}
+
+		for _, key := range keys {
+			set := directives[key]
+			if len(set) < 2 {
+				continue
+			}
+
+			name := strings.SplitN(key, "\x00", 2)[1]
+			if set[0].entry.Section != "" && dir.path == phpFpmSnippetDir {
+				name = fmt.Sprintf("[%s] %s", set[0].entry.Section, name)
+			}
+
+			var (
+				places []string
+				values []string
+			)
+			for _, directive := range set {
+				places = append(places, directive.String())
+				if !containsString(values, normalizeINIValue(directive.entry.Value)) {
+					values = append(values, normalizeINIValue(directive.entry.Value))
+				}
+			}
+
+			// the snippet loaded last wins, which is intended when it was written for v3
+			if last := set[len(set)-1]; len(values) > 1 && !last.migrated {
+				m.warning("`%s` has different values in %s, the one in %s wins", name, strings.Join(places, ", "), last)
+				m.add(Finding{Rule: "snippet-validation", Outcome: OutcomeWarning, File: set[0].file, Key: name, Action: fmt.Sprintf("overridden by %s", last)})
+				continue
+			}
+
+			if len(values) > 1 {
+				problem := fmt.Sprintf("`%s` has conflicting values in %s", name, strings.Join(places, ", "))
+				problems = append(problems, problem)
+				m.add(Finding{Rule: "snippet-validation", Outcome: outcome, File: set[0].file, Key: name, Action: action + problem})
+				continue
+			}
+
+			m.warning("`%s` is set to the same value more than once, in %s", name, strings.Join(places, ", "))
+			m.add(Finding{Rule: "snippet-validation", Outcome: OutcomeWarning, File: set[0].file, Key: name, Action: "duplicated in " + strings.Join(places, ", ")})
+		}
+	}
+
+	if len(problems) > 0 && outcome == OutcomeWarning {
+		for _, problem := range problems {
+			m.warning("%s", problem)
+		}
+		return nil
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			m.error("%s", problem)
+		}
+		return fmt.Errorf("migrated snippets are invalid:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	m.add(Finding{Rule: "snippet-validation", Outcome: OutcomePassed, Action: "migrated snippets parsed"})
+	return nil
+}
+
+// checkSnippetExtension explains why an `extension` or `zend_extension` directive loads an extension that the selected
+// PHP version does not provide.  Extensions loaded by path are shipped with the application and are not checked.
+func (m *migration) checkSnippetExtension(phpVersion string, entry iniEntry) []string {
+	if (entry.Key != "extension" && entry.Key != "zend_extension") || strings.Contains(entry.Value, "/") {
+		return nil
+	}
+
+	// an invalid PHP_VERSION has failed the migration of the extensions already
+	versions, _ := m.config.Extensions.versions(phpVersion)
+	if len(versions) == 0 {
+		return nil
+	}
+
+	name := normalizeExtensionName(entry.Value)
+	if entry.Key == "zend_extension" {
+		return m.config.Extensions.check(versions, "zend_extension", []string{name}, true, "load it with `extension` instead")
+	}
+	return m.config.Extensions.check(versions, "extension", []string{name}, false, "load it with `zend_extension` instead")
+}
+
+// snippetDirectiveKey identifies the setting a directive changes.  Extensions are identified by the extension they
+// load, php.ini sections only matter for paths and hosts, and php-fpm sections name the pool.
+func snippetDirectiveKey(dir string, entry iniEntry) string {
+	section := entry.Section
+	if dir == phpIniSnippetDir && !isScopedPHPIniSection(section) {
+		section = ""
+	}
+
+	key := entry.Key
+	if key == "extension" || key == "zend_extension" {
+		key = fmt.Sprintf("%s=%s", key, strings.TrimSuffix(filepath.Base(entry.Value), ".so"))
+	}
+
+	return section + "\x00" + key
+}
@@ -0,0 +1,153 @@
+package compat
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Classification is what became of a file under `.bp-config`
+type Classification string
+
+const (
+	// ClassMigrated files were translated to their v3 equivalent
+	ClassMigrated Classification = "migrated"
+	// ClassSuperseded files need no migration, because v3 already does the same
+	ClassSuperseded Classification = "superseded"
+	// ClassIgnored files were not read by v2 either
+	ClassIgnored Classification = "ignored"
+	// ClassUnsupported files configure something v3 does not offer
+	ClassUnsupported Classification = "unsupported"
+	// ClassNotReached files were not looked at, because the migration failed before it got to them
+	ClassNotReached Classification = "not-reached"
+)
+
+// InventoryItem classifies a single file under `.bp-config`
+type InventoryItem struct {
+	File           string         `json:"file"`
+	Classification Classification `json:"classification"`
+	Reason         string         `json:"reason"`
+}
+
+// classifyBPConfigFile classifies a file, relative to the application root, by what v2 did with it.  It also returns
+// the rule whose findings show what the migration did with the file, if any.
+func classifyBPConfigFile(file string) (Classification, string, string) {
+	file = filepath.ToSlash(file)
+	within := func(dir string) bool { return strings.HasPrefix(file, dir+"/") }
+
+	switch {
+	case file == ".bp-config/options.json":
+		return ClassMigrated, "buildpack-yml", "settings moved to buildpack.yml and .php.ini.d/compat-extensions.ini"
+	case file == ".bp-config/php/php.ini":
+		return ClassMigrated, "php-ini", fmt.Sprintf("changed settings moved to %s", PHPIniSnippet)
+	case file == ".bp-config/php/php-fpm.conf":
+		return ClassMigrated, "php-fpm-conf", fmt.Sprintf("changed settings moved to %s", PHPFpmSnippet)
+	case within(".bp-config/php/php.ini.d") && path.Dir(file) != ".bp-config/php/php.ini.d",
+		within(".bp-config/php/fpm.d") && path.Dir(file) != ".bp-config/php/fpm.d":
+		return ClassIgnored, "", "v2 did not load snippets in subdirectories"
+	case within(".bp-config/php/php.ini.d") && path.Ext(file) == ".ini":
+		return ClassMigrated, "php-ini-snippets", fmt.Sprintf("moved to %s/", phpIniSnippetDir)
+	case within(".bp-config/php/php.ini.d"):
+		return ClassIgnored, "", "v2 only loaded *.ini files from php.ini.d"
+	case within(".bp-config/php/fpm.d") && path.Ext(file) == ".conf":
+		return ClassMigrated, "php-fpm-snippets", fmt.Sprintf("moved to %s/", phpFpmSnippetDir)
+	case within(".bp-config/php/fpm.d"):
+		return ClassIgnored, "", "v2 only loaded *.conf files from fpm.d"
+	case within(".bp-config/php"):
+		return ClassUnsupported, "", "only php.ini, php-fpm.conf, php.ini.d/ and fpm.d/ are migrated from .bp-config/php"
+	case within(".bp-config/httpd") && path.Ext(file) == ".conf":
+		return ClassMigrated, "custom-httpd", fmt.Sprintf("translated to %s", HTTPDSnippet)
+	case within(".bp-config/nginx") && path.Ext(file) == ".conf":
+		return ClassMigrated, "custom-nginx", "translated to the include snippets under .nginx.conf.d"
+	case within(".bp-config/httpd"), within(".bp-config/nginx"):
+		return ClassIgnored, "", "v2 only read *.conf files from the web server configuration"
+	case within(".bp-config/newrelic"):
+		return ClassUnsupported, "", "the PHP buildpacks do not install the New Relic agent, use a New Relic buildpack instead"
+	default:
+		return ClassIgnored, "", "not part of the v2 PHP buildpack configuration"
+	}
+}
+
+// InventoryBPConfig classifies every file under `.bp-config`, so that nothing from the v2 configuration is dropped
+// unnoticed.  Files the migration found already covered by v3 are superseded.
+func (m *migration) InventoryBPConfig() error {
+	root := filepath.Join(m.appRoot, ".bp-config")
+
+	exists, err := fileExists(m.fs, root)
+	if err != nil || !exists {
+		return err
+	}
+
+	return m.fs.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relative := m.relative(file)
+		classification, rule, reason := classifyBPConfigFile(relative)
+
+		if rule != "" {
+			classification, reason = m.refineClassification(rule, relative, classification, reason)
+		}
+
+		m.report.Inventory = append(m.report.Inventory, InventoryItem{File: relative, Classification: classification, Reason: reason})
+		m.info("%s is %s: %s", relative, classification, reason)
+		return nil
+	})
+}
+
+// refineClassification uses the findings of the rule that handled a file to say what actually became of it.  A file
+// that only passed was already covered by v3, a file with directives that were left out is unsupported, a file without
+// findings was never reached because an earlier step failed or was left alone because its rule is turned off, and a
+// file that v2 never loaded was left alone.
+func (m *migration) refineClassification(rule string, file string, classification Classification, reason string) (Classification, string) {
+	if reason, ok := m.unreached[filepath.ToSlash(file)]; ok {
+		return ClassIgnored, reason
+	}
+
+	if problem, ok := m.leftOut[filepath.ToSlash(file)]; ok {
+		return ClassUnsupported, problem
+	}
+
+	var (
+		migrated, passed, warning string
+		found                     bool
+	)
+	for _, finding := range m.report.Findings {
+		if finding.Rule != rule || filepath.ToSlash(finding.File) != filepath.ToSlash(file) {
+			continue
+		}
+		found = true
+
+		switch {
+		case finding.Outcome == OutcomeFailed:
+			return ClassUnsupported, finding.Action
+		case finding.Outcome == OutcomeMigrated && finding.Key == "":
+			migrated = finding.Action
+		case finding.Outcome == OutcomePassed && finding.Key == "":
+			passed = finding.Action
+		case finding.Outcome == OutcomeWarning && warning == "":
+			warning = finding.Action
+		}
+	}
+
+	switch {
+	case !found && m.config.Rules.Severity(rule) == SeverityOff:
+		return ClassIgnored, fmt.Sprintf("not migrated, `%s` is turned off through %s", rule, RulesEnv)
+	case !found:
+		return ClassNotReached, fmt.Sprintf("an earlier step failed, otherwise %s", reason)
+	case migrated != "":
+		return ClassMigrated, migrated
+	case passed != "":
+		return ClassSuperseded, passed
+	case classification == ClassMigrated:
+		return ClassSuperseded, warning
+	default:
+		return classification, reason
+	}
+}
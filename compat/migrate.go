@@ -0,0 +1,575 @@
+package compat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libcfbuildpack/layers"
+	"github.com/cloudfoundry/libcfbuildpack/logger"
+	"github.com/paketo-buildpacks/php-composer/composer"
+)
+
+// Config holds the settings for a migration
+type Config struct {
+	// Placeholders resolves v2 version placeholders such as `{PHP_73_LATEST}`
+	Placeholders VersionPlaceholders
+	// Extensions lists the extensions available for each PHP version, extensions are not checked if it is empty
+	Extensions ExtensionCatalog
+	// MergePolicy resolves conflicts with an existing buildpack.yml, the zero value fails on conflicts
+	MergePolicy MergePolicy
+	// SnippetConflicts decides what happens when a migrated snippet would replace a different file, the zero value fails
+	SnippetConflicts SnippetConflictPolicy
+	// DryRun previews the migration instead of writing it, the zero value migrates in place
+	DryRun DryRunPolicy
+	// ApplicationPath is where the application lives when it runs, used to expand `@{HOME}`.  Defaults to
+	// DefaultApplicationPath.
+	ApplicationPath string
+	// ComposerExtensions decides what happens to Composer `ext-*` requirements missing from the extension options, the
+	// zero value adds them
+	ComposerExtensions ComposerExtensionsPolicy
+	// ComposerPath is the directory containing composer.json relative to the application, as set by COMPOSER_PATH
+	ComposerPath string
+	// Rules changes the severity of rules, the ones that are missing keep their default
+	Rules RuleSeverities
+	// Procfile adds the launch processes to the application's Procfile as well, for builds that do not run this
+	// buildpack
+	Procfile bool
+	// Sink receives findings and messages as the migration runs, if it is not nil
+	Sink Sink
+}
+
+// Result is what a migration found and changed
+type Result struct {
+	Report  Report
+	Changes []FileChange
+	// Processes are the launch processes the application needs, such as an APP_START_CMD that is not a PHP script
+	Processes layers.Processes
+}
+
+// Level is how important a message is
+type Level string
+
+const (
+	LevelInfo    Level = "info"
+	LevelWarning Level = "warning"
+	LevelError   Level = "error"
+)
+
+// Sink receives what a migration finds as it runs
+type Sink interface {
+	// Finding is called once for each finding added to the report
+	Finding(finding Finding)
+	// Message is called with guidance meant for people, such as why a setting is no longer supported
+	Message(level Level, message string)
+}
+
+// LoggerSink writes messages to a build log.  Findings are left for the report.
+type LoggerSink struct {
+	Logger logger.Logger
+}
+
+func (LoggerSink) Finding(Finding) {}
+
+func (l LoggerSink) Message(level Level, message string) {
+	switch level {
+	case LevelWarning:
+		l.Logger.BodyWarning("%s", message)
+	case LevelError:
+		l.Logger.BodyError("%s", message)
+	default:
+		l.Logger.Body("%s", message)
+	}
+}
+
+// Migrate migrates the v2 PHP application at appRoot in fs to the layout used by the PHP Cloud Native Buildpacks.  The
+// result is returned even when the migration fails, so that the report shows how far it got.  Files are only written
+// once every step succeeded, a failed migration leaves the application as it was.
+func Migrate(fs FileSystem, appRoot string, config Config) (Result, error) {
+	m := newMigration(fs, appRoot, config)
+	m.workspace.buffered = true
+
+	err := m.run()
+
+	// the inventory is taken even when the migration fails, so that the report accounts for every file
+	if inventoryErr := m.InventoryBPConfig(); err == nil {
+		err = inventoryErr
+	}
+
+	if m.config.DryRun != DryRunOff && err == nil {
+		err = m.ReportDryRun()
+	}
+
+	if m.config.DryRun == DryRunOff && err == nil {
+		err = m.workspace.apply()
+	}
+
+	return Result{Report: *m.report, Changes: m.workspace.Changes(), Processes: m.processes}, err
+}
+
+// migration is a single run of Migrate
+type migration struct {
+	fs        FileSystem
+	appRoot   string
+	config    Config
+	workspace *workspace
+	report    *Report
+	processes layers.Processes
+	// leftOut holds the files, relative to the application, with directives that were left out because the rule that
+	// rejected them is a warning, and the first of those problems
+	leftOut map[string]string
+	// unreached holds the files, relative to the application, that v2 never loaded, and why
+	unreached map[string]string
+}
+
+func newMigration(fs FileSystem, appRoot string, config Config) *migration {
+	if config.MergePolicy == "" {
+		config.MergePolicy = FailOnConflict
+	}
+	if config.ComposerExtensions == "" {
+		config.ComposerExtensions = AddComposerExtensions
+	}
+	if config.SnippetConflicts == "" {
+		config.SnippetConflicts = FailOnSnippetConflict
+	}
+	if config.DryRun == "" {
+		config.DryRun = DryRunOff
+	}
+	if config.ApplicationPath == "" {
+		config.ApplicationPath = DefaultApplicationPath
+	}
+
+	return &migration{
+		fs:        fs,
+		appRoot:   appRoot,
+		config:    config,
+		workspace: newWorkspace(fs, appRoot, config.DryRun != DryRunOff),
+		report:    &Report{DryRun: config.DryRun != DryRunOff},
+		leftOut:   map[string]string{},
+		unreached: map[string]string{},
+	}
+}
+
+// leaveOut records that a file, relative to the application with forward slashes, holds a directive that was left
+// out, so that the inventory classifies it as unsupported
+func (m *migration) leaveOut(file string, problem string) {
+	if _, ok := m.leftOut[file]; !ok {
+		m.leftOut[file] = problem
+	}
+}
+
+// skipUnreached records that v2 never loaded a file, relative to the application with forward slashes, so that the
+// inventory classifies it as ignored
+func (m *migration) skipUnreached(file string, reason string) {
+	m.info("%s is not migrated, it is %s", file, reason)
+	m.unreached[file] = reason
+}
+
+func (m *migration) add(finding Finding) {
+	m.report.Add(finding)
+	if m.config.Sink != nil {
+		m.config.Sink.Finding(finding)
+	}
+}
+
+func (m *migration) message(level Level, format string, args ...interface{}) {
+	if m.config.Sink != nil {
+		m.config.Sink.Message(level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (m *migration) info(format string, args ...interface{}) {
+	m.message(LevelInfo, format, args...)
+}
+
+func (m *migration) warning(format string, args ...interface{}) {
+	m.message(LevelWarning, format, args...)
+}
+
+func (m *migration) error(format string, args ...interface{}) {
+	m.message(LevelError, format, args...)
+}
+
+// run runs every migration step, stopping at the first one that fails
+func (m *migration) run() error {
+	m.ReportRuleSeverities()
+
+	err := m.CheckForPythonExtentions()
+	if err != nil {
+		return err
+	}
+
+	options, err := loadOptionsJSON(m.fs, m.appRoot)
+	if err != nil {
+		return err
+	}
+
+	err = m.ReportOptions(options)
+	if err != nil {
+		return err
+	}
+
+	err = ResolveVersionPlaceholders(&options, m.config.Placeholders)
+	if err != nil {
+		m.add(Finding{Rule: "version-placeholders", Outcome: OutcomeFailed, File: optionsJSONPath, Action: "build failed, unknown version placeholder"})
+		return err
+	}
+	m.add(Finding{Rule: "version-placeholders", Outcome: OutcomePassed, File: optionsJSONPath, Action: "versions resolved"})
+
+	err = m.MigrateWebServer(&options)
+	if err != nil {
+		return err
+	}
+
+	err = m.ErrorIfShouldHaveMovedWebFilesToWebDir(options)
+	if err != nil {
+		return err
+	}
+
+	err = m.MigrateAppStartCommand(&options)
+	if err != nil {
+		return err
+	}
+
+	err = m.MigratePHPModules(options)
+	if err != nil {
+		return err
+	}
+
+	if strings.ToLower(options.Composer.Version) == "latest" {
+		options.Composer.Version = ""
+		if m.enabled("composer-latest") {
+			err = m.violation(Finding{Rule: "composer-latest", File: optionsJSONPath, Key: "COMPOSER_VERSION", Action: "`latest` is no longer supported, the default Composer version is used"},
+				errors.New("COMPOSER_VERSION `latest` is no longer supported, set a version or remove it from options.json"),
+				"Specifying a version of 'latest' is no longer supported. The default version of the php-composer-cnb will be used instead.")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	composerLocation, err := m.findComposerJSON(options)
+	if err != nil {
+		return err
+	}
+	if composerLocation != "" && m.enabled("composer-notes") {
+		err = m.violation(Finding{Rule: "composer-notes", File: m.relative(composerLocation), Action: "vendor directory and composer files are no longer moved"},
+			errors.New("the vendor directory and Composer files are no longer moved"),
+			"Attention: some lesser used Composer configuration options have been removed.",
+			"- The vendor directory is no longer migrated to LIBDIR. You may need to adjust your code to use a relative path to Composer dependencies.",
+			"- The composer.json and composer.lock files are no longer moved to the root of your application. This is the behavior most people expect. If you need them in a specific location, put them there prior to pushing your code.")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.MigrateHTTPDConf(options)
+	if err != nil {
+		return err
+	}
+
+	err = m.MigrateNginxConf(options)
+	if err != nil {
+		return err
+	}
+
+	// migrate php.ini and php-fpm snippets
+	err = m.MigratePHPSnippets(options, "PHP INI", "php.ini.d", phpIniSnippetDir, "ini")
+	if err != nil {
+		return err
+	}
+
+	err = m.MigratePHPSnippets(options, "PHP-FPM", "fpm.d", phpFpmSnippetDir, "conf")
+	if err != nil {
+		return err
+	}
+
+	// migrate full php.ini and php-fpm.conf overrides to snippets
+	err = m.MigratePHPIni(options)
+	if err != nil {
+		return err
+	}
+
+	err = m.MigratePHPFpmConf(options)
+	if err != nil {
+		return err
+	}
+
+	// migrate COMPOSER_PATH to buildpack.yml
+	options.Composer.Path = m.config.ComposerPath
+
+	// migrate PHP/ZEND_EXTENSIONS, with the ones Composer needs
+	err = m.ReconcileComposerExtensions(&options)
+	if err != nil {
+		return err
+	}
+
+	err = m.MigrateExtensions(options)
+	if err != nil {
+		return err
+	}
+
+	err = m.ValidateSnippets(options)
+	if err != nil {
+		return err
+	}
+
+	// unless the `buildpack-yml` rule is an error, conflicts keep the values buildpack.yml already has
+	policy := m.config.MergePolicy
+	if policy == FailOnConflict && m.config.Rules.Severity("buildpack-yml") != SeverityError {
+		policy = PreferBuildpackYAML
+	}
+
+	conflicts, err := writeOptionsToBuildpackYAML(m.workspace, options, policy)
+	if err != nil {
+		for _, conflict := range conflicts {
+			m.error("%s", conflict)
+			m.add(Finding{Rule: "buildpack-yml", Outcome: OutcomeFailed, File: "buildpack.yml", Key: conflict.Key, Action: "build failed, conflicting values"})
+		}
+		return err
+	}
+
+	if len(conflicts) > 0 && m.enabled("buildpack-yml") {
+		for _, conflict := range conflicts {
+			m.warning("%s, keeping the value from %s", conflict, policy)
+			m.add(Finding{Rule: "buildpack-yml", Outcome: OutcomeWarning, File: "buildpack.yml", Key: conflict.Key, Action: fmt.Sprintf("kept the value from %s", policy)})
+		}
+	}
+	m.add(Finding{Rule: "buildpack-yml", Outcome: OutcomeMigrated, File: optionsJSONPath, Action: "settings written to buildpack.yml"})
+	m.report.Generated("buildpack.yml")
+
+	return nil
+}
+
+// ReportDryRun shows the changes a dry run would have made and, under DryRunFail, fails if there are any
+func (m *migration) ReportDryRun() error {
+	changes := m.workspace.Changes()
+
+	m.info("Dry run, the application has not been modified")
+	if len(changes) == 0 {
+		m.info("No files would be created or changed")
+	}
+	for _, change := range changes {
+		m.info("%s", change.Diff())
+	}
+
+	if m.config.DryRun == DryRunFail && len(changes) > 0 {
+		m.add(Finding{Rule: "dry-run", Outcome: OutcomeFailed, Action: fmt.Sprintf("build failed, %d file(s) would be created or changed", len(changes))})
+		return DryRunError{Changes: len(changes)}
+	}
+
+	m.add(Finding{Rule: "dry-run", Outcome: OutcomePassed, Action: fmt.Sprintf("%d file(s) would be created or changed", len(changes))})
+	return nil
+}
+
+func (m *migration) CheckForPythonExtentions() error {
+	if !m.enabled("extensions-folder") {
+		return nil
+	}
+
+	extensionsExists, err := fileExists(m.fs, filepath.Join(m.appRoot, ".extensions"))
+	if err != nil {
+		return err
+	}
+
+	if extensionsExists {
+		return m.violation(Finding{Rule: "extensions-folder", File: ".extensions", Action: "remove the folder"},
+			errors.New("Use of .extensions folder has been removed. Please remove this folder from your application."))
+	}
+
+	m.add(Finding{Rule: "extensions-folder", Outcome: OutcomePassed, Action: "no .extensions folder"})
+	return nil
+}
+
+// ReportOptions explains what happens to each option found in options.json.  The options that are not migrated only
+// fail the build when the `legacy-option` rule is an error.
+func (m *migration) ReportOptions(options Options) error {
+	if !m.enabled("legacy-option") {
+		return nil
+	}
+
+	strict := m.config.Rules.Severity("legacy-option") == SeverityError
+
+	var problems []string
+	for _, key := range options.Keys {
+		definition, _ := lookupOption(key)
+		if definition.Status == optionMigrated {
+			m.info("%s: %s", key, definition.Guidance)
+			m.add(Finding{Rule: "legacy-option", Outcome: OutcomeMigrated, File: optionsJSONPath, Key: key, Action: definition.Guidance})
+			continue
+		}
+
+		// ignored or unsupported
+		message := fmt.Sprintf("%s is %s: %s", key, definition.Status, definition.Guidance)
+
+		if strict {
+			problems = append(problems, message)
+			m.error("%s", message)
+			m.add(Finding{Rule: "legacy-option", Outcome: OutcomeFailed, File: optionsJSONPath, Key: key, Action: "build failed, " + definition.Guidance})
+			continue
+		}
+
+		m.warning("%s", message)
+		m.add(Finding{Rule: "legacy-option", Outcome: OutcomeDropped, File: optionsJSONPath, Key: key, Action: definition.Guidance})
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("options.json sets options that are not migrated, remove them:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// MigrateExtensions writes the extensions to load to a snippet.  Extensions that the selected PHP version does not
+// provide fail the build, unless the `extensions` rule is a warning, which leaves them out, or is turned off, which
+// loads them anyway.
+func (m *migration) MigrateExtensions(options Options) error {
+	options.PHP.Extensions = m.normalizeExtensions("PHP_EXTENSIONS", options.PHP.Version, options.PHP.Extensions)
+	options.PHP.ZendExtensions = m.normalizeExtensions("ZEND_EXTENSIONS", options.PHP.Version, options.PHP.ZendExtensions)
+
+	if m.enabled("extensions") {
+		err := m.checkExtensions(&options)
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := bytes.Buffer{}
+
+	for _, phpExt := range options.PHP.Extensions {
+		buf.WriteString(fmt.Sprintf("extension=%s.so\n", phpExt))
+	}
+
+	for _, zendExt := range options.PHP.ZendExtensions {
+		buf.WriteString(fmt.Sprintf("zend_extension=%s.so\n", zendExt))
+	}
+
+	err := m.workspace.WriteFile(filepath.Join(".php.ini.d", "compat-extensions.ini"), 0644, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	m.add(Finding{Rule: "extensions", Outcome: OutcomeMigrated, File: optionsJSONPath, Key: "PHP_EXTENSIONS, ZEND_EXTENSIONS", Action: fmt.Sprintf("%d extension(s) written to .php.ini.d/compat-extensions.ini", len(options.PHP.Extensions)+len(options.PHP.ZendExtensions))})
+	m.report.Generated(".php.ini.d/compat-extensions.ini")
+	return nil
+}
+
+// checkExtensions fails on the extensions that the selected PHP version does not provide, or leaves them out when the
+// `extensions` rule is a warning
+func (m *migration) checkExtensions(options *Options) error {
+	problems, err := m.config.Extensions.Check(options.PHP.Version, options.PHP.Extensions, options.PHP.ZendExtensions)
+	if err != nil {
+		return m.failPHPVersion(err)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if m.config.Rules.Severity("extensions") == SeverityError {
+		for _, problem := range problems {
+			m.error("%s", problem)
+		}
+		m.add(Finding{Rule: "extensions", Outcome: OutcomeFailed, File: optionsJSONPath, Key: "PHP_EXTENSIONS, ZEND_EXTENSIONS", Action: "build failed, " + strings.Join(problems, "; ")})
+		return fmt.Errorf("unable to migrate extensions:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	for _, problem := range problems {
+		m.warning("%s, it is left out", problem)
+	}
+	m.add(Finding{Rule: "extensions", Outcome: OutcomeWarning, File: optionsJSONPath, Key: "PHP_EXTENSIONS, ZEND_EXTENSIONS", Action: "left out, " + strings.Join(problems, "; ")})
+
+	options.PHP.Extensions, err = m.config.Extensions.available(options.PHP.Version, options.PHP.Extensions, false)
+	if err != nil {
+		return err
+	}
+	options.PHP.ZendExtensions, err = m.config.Extensions.available(options.PHP.Version, options.PHP.ZendExtensions, true)
+	return err
+}
+
+// failPHPVersion fails the migration on a PHP_VERSION that the extension catalog cannot read
+func (m *migration) failPHPVersion(err error) error {
+	m.error("%s", err)
+	m.add(Finding{Rule: "extensions", Outcome: OutcomeFailed, File: optionsJSONPath, Key: "PHP_VERSION", Action: "build failed, not a valid version constraint"})
+	return err
+}
+
+func (m *migration) MigrateAdditionalCommands(options Options) error {
+	buf := bytes.Buffer{}
+
+	for _, command := range options.PHP.AdditionalPreprocessCommands {
+		buf.WriteString(fmt.Sprintf("%s\n", command))
+	}
+
+	return m.workspace.WriteFile(filepath.Join(".profile.d", "additional-cmds.sh"), 0644, buf.Bytes())
+}
+
+// findComposerJSON returns the composer.json that php-composer-cnb would use, or an empty path if there is none.  It
+// looks in the same places as composer.FindComposer, the application root and WEBDIR, each joined with ComposerPath
+// when it is set, but through the migration's FileSystem.
+func (m *migration) findComposerJSON(options Options) (string, error) {
+	webDir := "htdocs"
+	if options.PHP.WebDir != "" {
+		webDir = options.PHP.WebDir
+	}
+
+	paths := []string{
+		filepath.Join(m.appRoot, composer.ComposerJSON),
+		filepath.Join(m.appRoot, webDir, composer.ComposerJSON),
+	}
+	if m.config.ComposerPath != "" {
+		paths = append(paths,
+			filepath.Join(m.appRoot, m.config.ComposerPath, composer.ComposerJSON),
+			filepath.Join(m.appRoot, webDir, m.config.ComposerPath, composer.ComposerJSON),
+		)
+	}
+
+	for _, path := range paths {
+		exists, err := fileExists(m.fs, path)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return path, nil
+		}
+	}
+	return "", nil
+}
+
+func (m *migration) ErrorIfShouldHaveMovedWebFilesToWebDir(options Options) error {
+	if !m.enabled("webdir-move") {
+		return nil
+	}
+
+	isWebApp, err := fileExists(m.fs, filepath.Join(m.appRoot, "index.php"))
+	if err != nil {
+		return err
+	}
+
+	webDir := "htdocs"
+	if options.PHP.WebDir != "" {
+		webDir = options.PHP.WebDir
+	}
+	webDirPath := filepath.Join(m.appRoot, webDir)
+	webDirExists, err := fileExists(m.fs, webDirPath)
+	if err != nil {
+		return err
+	}
+
+	if isWebApp && !webDirExists {
+		return m.violation(Finding{Rule: "webdir-move", File: "index.php", Key: "WEBDIR", Action: fmt.Sprintf("%s does not exist", webDir)},
+			errors.New("files no longer moved into WEBDIR"),
+			"WEBDIR doesn't exist, we no longer move files into WEBDIR. Please create WEBDIR and push your app again.")
+	}
+
+	m.add(Finding{Rule: "webdir-move", Outcome: OutcomePassed, Key: "WEBDIR", Action: "files are already in place"})
+	return nil
+}
+
+// relative returns path relative to the application root
+func (m *migration) relative(path string) string {
+	if relative, err := filepath.Rel(m.appRoot, path); err == nil {
+		return relative
+	}
+	return path
+}
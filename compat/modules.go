@@ -0,0 +1,130 @@
+package compat
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/buildpack/libbuildpack/buildplan"
+)
+
+// phpModule is what a v2 PHP_MODULES value becomes in v3
+type phpModule struct {
+	// Requirement is the build plan entry that provides the module, if there is one
+	Requirement *buildplan.Required
+	// Guidance explains the v3 equivalent, or what to use instead when there is none
+	Guidance string
+}
+
+// phpModules maps each value v2 accepted in PHP_MODULES to its v3 equivalent
+var phpModules = map[string]phpModule{
+	"cli": {
+		Requirement: &buildplan.Required{Name: "php", Metadata: buildplan.Metadata{"build": true, "launch": true}},
+		Guidance:    "the `php` command is always installed by the PHP dist buildpack",
+	},
+	"fpm": {
+		Requirement: &buildplan.Required{Name: "php", Metadata: buildplan.Metadata{"launch": true}},
+		Guidance:    "PHP-FPM is always installed by the PHP dist buildpack and started by the PHP web buildpack",
+	},
+	"cgi": {
+		Guidance: "`php-cgi` is not installed, serve the application through PHP-FPM, the default, or with the built in web server by setting WEB_SERVER to `php-server`",
+	},
+	"pear": {
+		Guidance: "PEAR is not installed, require the PEAR packages you use through Composer instead, most are published on Packagist under `pear/`",
+	},
+}
+
+// MergePHPModuleRequirements adds the build plan entries that provide the PHP_MODULES an application asked for to
+// requires.  A module provided by a dependency that is already required, such as `php`, adds its metadata to that
+// requirement rather than requiring it twice.
+func MergePHPModuleRequirements(requires []buildplan.Required, options Options) []buildplan.Required {
+	for _, name := range options.PHP.Modules {
+		module, ok := phpModules[strings.ToLower(strings.TrimSpace(name))]
+		if !ok || module.Requirement == nil {
+			continue
+		}
+
+		requires = mergeRequirement(requires, buildplan.Required{
+			Name:     module.Requirement.Name,
+			Version:  options.PHP.Version,
+			Metadata: module.Requirement.Metadata,
+		})
+	}
+	return requires
+}
+
+// mergeRequirement adds a requirement to requires, merging its metadata into an existing requirement of the same
+// dependency.  The existing version is kept, and a phase such as `launch` is required if either asks for it.
+func mergeRequirement(requires []buildplan.Required, requirement buildplan.Required) []buildplan.Required {
+	for i, existing := range requires {
+		if existing.Name != requirement.Name {
+			continue
+		}
+
+		metadata := buildplan.Metadata{}
+		for key, value := range existing.Metadata {
+			metadata[key] = value
+		}
+		for key, value := range requirement.Metadata {
+			if current, ok := metadata[key].(bool); ok && current {
+				continue
+			}
+			metadata[key] = value
+		}
+
+		if existing.Version == "" {
+			existing.Version = requirement.Version
+		}
+		existing.Metadata = metadata
+		requires[i] = existing
+		return requires
+	}
+
+	return append(requires, requirement)
+}
+
+// MigratePHPModules maps each PHP_MODULES value to its v3 equivalent, failing on the ones that have none unless the
+// `php-modules` rule is a warning
+func (m *migration) MigratePHPModules(options Options) error {
+	if len(options.PHP.Modules) == 0 || !m.enabled("php-modules") {
+		return nil
+	}
+
+	var problems []string
+	for _, name := range options.PHP.Modules {
+		module, ok := phpModules[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			var known []string
+			for module := range phpModules {
+				known = append(known, fmt.Sprintf("`%s`", module))
+			}
+			sort.Strings(known)
+
+			problem := fmt.Sprintf("PHP_MODULES `%s` is not a PHP module, expected one of %s", name, strings.Join(known, ", "))
+			if err := m.violation(Finding{Rule: "php-modules", File: optionsJSONPath, Key: name, Action: "unknown module"}, errors.New(problem)); err != nil {
+				problems = append(problems, problem)
+			}
+			continue
+		}
+
+		if module.Requirement == nil {
+			problem := fmt.Sprintf("PHP_MODULES `%s` has no v3 equivalent: %s", name, module.Guidance)
+			if err := m.violation(Finding{Rule: "php-modules", File: optionsJSONPath, Key: name, Action: module.Guidance}, errors.New(problem)); err != nil {
+				problems = append(problems, problem)
+			}
+			continue
+		}
+
+		m.add(Finding{Rule: "php-modules", Outcome: OutcomeMigrated, File: optionsJSONPath, Key: name, Action: fmt.Sprintf("provided by the `%s` requirement, %s", module.Requirement.Name, module.Guidance)})
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			m.error("%s", problem)
+		}
+		return fmt.Errorf("unable to migrate PHP_MODULES:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
@@ -0,0 +1,739 @@
+package compat
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/paketo-buildpacks/php-web/config"
+)
+
+const (
+	// NginxHTTPSnippet is the include holding the http level configuration migrated from `.bp-config/nginx`.  The PHP
+	// web buildpack includes `.nginx.conf.d/*-http.conf` at the end of its `http` block.
+	NginxHTTPSnippet = ".nginx.conf.d/00-compat-http.conf"
+	// NginxServerSnippet is the include holding the server level configuration migrated from `.bp-config/nginx`.  The
+	// PHP web buildpack includes `.nginx.conf.d/*-server.conf` at the end of its `server` block.
+	NginxServerSnippet = ".nginx.conf.d/00-compat-server.conf"
+)
+
+// legacyNginxConfigDir held the v2 nginx configuration, copied over the stock `conf/` folder of nginx
+var legacyNginxConfigDir = filepath.Join(".bp-config", "nginx")
+
+// nginxContext is the block of nginx.conf that a directive belongs to
+type nginxContext string
+
+const (
+	nginxMain   nginxContext = "main"
+	nginxHTTP   nginxContext = "http"
+	nginxServer nginxContext = "server"
+)
+
+// ownedNginxDirectives are set by the PHP web buildpack outside of the includes, v2 values for them are dropped
+var ownedNginxDirectives = map[string]string{
+	"daemon":           "nginx runs in the foreground so the platform can supervise it",
+	"error_log":        "nginx logs to standard error so the platform collects its logs",
+	"events":           "the PHP web buildpack configures the nginx workers",
+	"pid":              "the PHP web buildpack manages the nginx process",
+	"user":             "nginx runs as the user of the image",
+	"worker_processes": "the PHP web buildpack configures the nginx workers",
+}
+
+// nginxFPMMarkers show that a directive points at PHP-FPM, which the PHP web buildpack connects nginx to itself
+var nginxFPMMarkers = []string{"PHP_FPM_LISTEN", "php_fpm", "php-fpm.socket"}
+
+// stockNginxFPMBlocks are the blocks of the stock v2 files that pointed nginx at PHP-FPM, such as the `php_fpm`
+// upstream, by their normalized form.  The PHP web buildpack does the same itself, so copies of them are dropped.
+var stockNginxFPMBlocks = map[string]bool{}
+
+func init() {
+	for file, versions := range stockServerConfigs {
+		if !strings.HasPrefix(file, "nginx/") {
+			continue
+		}
+
+		for _, version := range versions {
+			directives, _ := parseNginxConf([]byte(version))
+			for _, d := range directives {
+				if d.Block && pointsAtPHPFpm(d) {
+					stockNginxFPMBlocks[d.normalized()] = true
+				}
+			}
+		}
+	}
+}
+
+// pointsAtPHPFpm reports whether a directive, or one inside it, points at PHP-FPM
+func pointsAtPHPFpm(d nginxDirective) bool {
+	for _, marker := range nginxFPMMarkers {
+		if strings.Contains(d.normalized(), marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// nginxDirective is a directive, or a block and the directives inside it, from an nginx configuration file
+type nginxDirective struct {
+	Name     string
+	Args     []string
+	Line     int
+	Block    bool
+	Children []nginxDirective
+}
+
+// normalized ignores whitespace and comments, to compare directives by what they do
+func (d nginxDirective) normalized() string {
+	parts := []string{d.text()}
+	if d.Block {
+		parts[0] += " {"
+	}
+	for _, child := range d.Children {
+		parts = append(parts, child.normalized())
+	}
+	return strings.Join(parts, "\n")
+}
+
+// text is the directive, or the opening of a block, without its terminator
+func (d nginxDirective) text() string {
+	return strings.Join(append([]string{d.Name}, d.Args...), " ")
+}
+
+// render writes the directive back out, indented by depth
+func (d nginxDirective) render(depth int) []string {
+	indent := strings.Repeat("    ", depth)
+	if !d.Block {
+		return []string{indent + d.text() + ";"}
+	}
+
+	lines := []string{indent + d.text() + " {"}
+	for _, child := range d.Children {
+		lines = append(lines, child.render(depth+1)...)
+	}
+	return append(lines, indent+"}")
+}
+
+// nginxToken is a word, a quoted string or one of `;`, `{` and `}`
+type nginxToken struct {
+	Text    string
+	Line    int
+	Special bool
+}
+
+// tokenizeNginxConf splits an nginx configuration file into tokens, keeping quoted strings as they were written
+func tokenizeNginxConf(contents string) ([]nginxToken, []string) {
+	var (
+		tokens   []nginxToken
+		problems []string
+		word     strings.Builder
+		start    int
+	)
+
+	line := 1
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, nginxToken{Text: word.String(), Line: start})
+			word.Reset()
+		}
+	}
+
+	for i := 0; i < len(contents); i++ {
+		c := contents[i]
+		switch {
+		case c == '\n':
+			flush()
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+			flush()
+		case c == '#' && word.Len() == 0:
+			for i < len(contents) && contents[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '"' || c == '\'':
+			if word.Len() == 0 {
+				start = line
+			}
+			quoteLine := line
+			word.WriteByte(c)
+			i++
+			for ; i < len(contents) && contents[i] != c; i++ {
+				if contents[i] == '\\' && i+1 < len(contents) {
+					word.WriteByte(contents[i])
+					i++
+				}
+				if contents[i] == '\n' {
+					line++
+				}
+				word.WriteByte(contents[i])
+			}
+			if i >= len(contents) {
+				problems = append(problems, fmt.Sprintf("line %d: the quoted string is never closed", quoteLine))
+				return nil, problems
+			}
+			word.WriteByte(c)
+		case c == '{' && word.Len() > 0 && strings.ContainsAny(word.String()[word.Len()-1:], "$@#"):
+			// `${name}` is a variable and `@{NAME}` a v2 placeholder, not a block
+			for ; i < len(contents) && contents[i] != '}'; i++ {
+				word.WriteByte(contents[i])
+			}
+			if i < len(contents) {
+				word.WriteByte('}')
+			}
+		case c == ';' || c == '{' || c == '}':
+			flush()
+			tokens = append(tokens, nginxToken{Text: string(c), Line: line, Special: true})
+		default:
+			if word.Len() == 0 {
+				start = line
+			}
+			word.WriteByte(c)
+		}
+	}
+	flush()
+
+	return tokens, problems
+}
+
+// parseNginxConf reads the directives and blocks of an nginx configuration file, returning a problem, prefixed with its
+// line number, for each one that is not properly terminated
+func parseNginxConf(contents []byte) ([]nginxDirective, []string) {
+	tokens, problems := tokenizeNginxConf(string(contents))
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	p := &nginxParser{tokens: tokens}
+	directives, _ := p.block(0)
+	return directives, p.problems
+}
+
+type nginxParser struct {
+	tokens   []nginxToken
+	i        int
+	problems []string
+}
+
+// block reads directives up to the end of the current block, reporting whether the block was closed
+func (p *nginxParser) block(depth int) ([]nginxDirective, bool) {
+	var directives []nginxDirective
+	for p.i < len(p.tokens) {
+		token := p.tokens[p.i]
+		if token.Special {
+			p.i++
+			switch {
+			case token.Text == "}" && depth > 0:
+				return directives, true
+			case token.Text == "}":
+				p.problems = append(p.problems, fmt.Sprintf("line %d: `}` closes a block that was never opened", token.Line))
+			default:
+				p.problems = append(p.problems, fmt.Sprintf("line %d: unexpected `%s`", token.Line, token.Text))
+			}
+			continue
+		}
+
+		directive := nginxDirective{Name: token.Text, Line: token.Line}
+		for p.i++; p.i < len(p.tokens) && !p.tokens[p.i].Special; p.i++ {
+			directive.Args = append(directive.Args, p.tokens[p.i].Text)
+		}
+
+		if p.i >= len(p.tokens) {
+			p.problems = append(p.problems, fmt.Sprintf("line %d: `%s` is missing its closing `;`", directive.Line, directive.Name))
+			return directives, false
+		}
+
+		switch p.tokens[p.i].Text {
+		case ";":
+			p.i++
+		case "{":
+			p.i++
+			directive.Block = true
+
+			var closed bool
+			directive.Children, closed = p.block(depth + 1)
+			if !closed {
+				p.problems = append(p.problems, fmt.Sprintf("line %d: the `%s` block is never closed", directive.Line, directive.Name))
+				return append(directives, directive), false
+			}
+		default:
+			// leave the `}` to close the enclosing block
+			p.problems = append(p.problems, fmt.Sprintf("line %d: `%s` is missing its closing `;`", directive.Line, directive.Name))
+		}
+		directives = append(directives, directive)
+	}
+	return directives, depth == 0
+}
+
+// stockNginxConf reads the directives of the `http` and `server` blocks of the nginx.conf that the PHP web buildpack
+// generates.  The HTTPS redirect can be disabled, so its directives are left out.
+func stockNginxConf(applicationPath string, webDir string) (map[nginxContext]map[string]bool, error) {
+	tmpl, err := template.New("nginx.conf").Parse(config.NginxConfTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, config.NginxConfig{AppRoot: applicationPath, WebDirectory: webDir, DisableHTTPSRedirect: true}); err != nil {
+		return nil, err
+	}
+
+	// the port is only filled in when nginx starts
+	contents := strings.Replace(buf.String(), `{{env "PORT"}}`, "$PORT", -1)
+
+	directives, problems := parseNginxConf([]byte(contents))
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("unable to read the stock nginx.conf:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	stock := map[nginxContext]map[string]bool{nginxHTTP: {}, nginxServer: {}}
+	for _, http := range directives {
+		if http.Name != "http" {
+			continue
+		}
+
+		for _, directive := range http.Children {
+			stock[nginxHTTP][directive.normalized()] = true
+			if directive.Name != "server" {
+				continue
+			}
+
+			for _, child := range directive.Children {
+				stock[nginxServer][child.normalized()] = true
+			}
+		}
+	}
+	return stock, nil
+}
+
+// nginxInclude is an include of the stock v2 nginx.conf, with the block it sits in
+type nginxInclude struct {
+	Pattern string
+	Context nginxContext
+}
+
+// stockNginxIncludes are the includes of the stock v2 nginx.conf, which v2 started from when the application did not
+// have its own
+func stockNginxIncludes() []nginxInclude {
+	versions := stockServerConfigs["nginx/nginx.conf"]
+	directives, _ := parseNginxConf([]byte(versions[len(versions)-1]))
+
+	var (
+		includes []nginxInclude
+		walk     func(directives []nginxDirective, context nginxContext)
+	)
+	walk = func(directives []nginxDirective, context nginxContext) {
+		for _, d := range directives {
+			switch {
+			case d.Name == "include" && len(d.Args) == 1:
+				includes = append(includes, nginxInclude{Pattern: d.Args[0], Context: context})
+			case d.Name == "http" && d.Block:
+				walk(d.Children, nginxHTTP)
+			case d.Name == "server" && d.Block:
+				walk(d.Children, nginxServer)
+			}
+		}
+	}
+	walk(directives, nginxMain)
+	return includes
+}
+
+// nginxTranslator translates the v2 nginx configuration, following its includes, into http and server level includes
+type nginxTranslator struct {
+	m            *migration
+	placeholders snippetPlaceholders
+	stock        map[nginxContext]map[string]bool
+	// files are the `.conf` files under `.bp-config/nginx`, relative to it with forward slashes
+	files   []string
+	visited map[string]bool
+	out     map[nginxContext][]string
+	// headers are the sources of the last `# From` comments written to out
+	headers map[nginxContext]string
+	// server is set once the application's `server` block has been found
+	server   bool
+	problems []string
+	// diffs show how the failing files differ from their stock v2 versions
+	diffs []string
+}
+
+// nginxSource is a file being translated, with the problems found expanding its placeholders by line
+type nginxSource struct {
+	File     string
+	Problems map[int][]string
+	Failed   bool
+	// LeftOut is set when a directive that cannot be migrated was only reported, as the rule is a warning
+	LeftOut  bool
+	Migrated int
+}
+
+// MigrateNginxConf translates the v2 nginx configuration under `.bp-config/nginx` into NginxHTTPSnippet and
+// NginxServerSnippet.  Directives the PHP web buildpack already sets the same way are dropped, and the build only fails
+// for the ones that clash with the settings it owns.  Only the files included from nginx.conf, the application's or the
+// stock v2 one, are translated.
+func (m *migration) MigrateNginxConf(options Options) error {
+	if !m.enabled("custom-nginx") {
+		return nil
+	}
+
+	root := filepath.Join(m.appRoot, legacyNginxConfigDir)
+
+	exists, err := fileExists(m.fs, root)
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	if exists {
+		found, err := findFiles(m.fs, root, regexp.MustCompile(`\.conf$`))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range found {
+			relative, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(relative))
+		}
+	}
+
+	if len(files) == 0 {
+		m.add(Finding{Rule: "custom-nginx", Outcome: OutcomePassed, Action: "no Nginx configuration under .bp-config/nginx"})
+		return nil
+	}
+
+	placeholders := newSnippetPlaceholders(m.config.ApplicationPath, options)
+
+	stock, err := stockNginxConf(m.config.ApplicationPath, placeholders.webDir)
+	if err != nil {
+		return err
+	}
+
+	t := &nginxTranslator{
+		m:            m,
+		placeholders: placeholders,
+		stock:        stock,
+		files:        files,
+		visited:      map[string]bool{},
+		out:          map[nginxContext][]string{},
+		headers:      map[nginxContext]string{},
+	}
+
+	// v2 started from nginx.conf, the other files only took effect when it included them
+	start := "nginx.conf"
+	if containsString(files, "nginx.conf") {
+		if err := t.file("nginx.conf", nginxMain); err != nil {
+			return err
+		}
+	} else {
+		start = "the stock v2 nginx.conf"
+		for _, include := range stockNginxIncludes() {
+			if _, err := t.reach(include.Pattern, include.Context); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, file := range files {
+		if !t.visited[file] {
+			m.skipUnreached(path.Join(filepath.ToSlash(legacyNginxConfigDir), file), fmt.Sprintf("not included from %s, v2 never loaded it", start))
+		}
+	}
+
+	if len(t.problems) > 0 {
+		for _, problem := range t.problems {
+			m.error("%s", problem)
+		}
+		for _, diff := range t.diffs {
+			m.error("%s", diff)
+		}
+		return fmt.Errorf("unable to migrate the Nginx configuration under `.bp-config/nginx`:\n  %s%s", strings.Join(t.problems, "\n  "), strings.Join(append([]string{""}, t.diffs...), "\n"))
+	}
+
+	for _, snippet := range []struct {
+		context nginxContext
+		file    string
+	}{{nginxHTTP, NginxHTTPSnippet}, {nginxServer, NginxServerSnippet}} {
+		if len(t.out[snippet.context]) == 0 {
+			continue
+		}
+
+		contents := fmt.Sprintf("# Migrated from .bp-config/nginx, the %s level directives that the PHP web buildpack does not already set\n%s\n", snippet.context, strings.Join(t.out[snippet.context], "\n"))
+		if err := m.workspace.WriteFile(snippet.file, 0644, []byte(contents)); err != nil {
+			return err
+		}
+
+		m.warning("Found Nginx configuration under `.bp-config/nginx`. This is no longer supported. Moving the %s level directives nginx still needs to `%s`", snippet.context, snippet.file)
+		m.report.Generated(snippet.file)
+	}
+
+	return nil
+}
+
+// file translates a file under `.bp-config/nginx` the first time it is reached, in the context of the include that
+// reached it
+func (t *nginxTranslator) file(name string, context nginxContext) error {
+	if t.visited[name] {
+		return nil
+	}
+	t.visited[name] = true
+
+	source := &nginxSource{File: filepath.ToSlash(filepath.Join(legacyNginxConfigDir, name)), Problems: map[int][]string{}}
+
+	contents, err := t.m.fs.ReadFile(filepath.Join(t.m.appRoot, legacyNginxConfigDir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+
+	if isStockServerConfig(path.Join("nginx", name), contents) {
+		t.m.warning("%s is an unchanged copy of the stock v2 file and can be deleted", source.File)
+		t.m.add(Finding{Rule: "custom-nginx", Outcome: OutcomeWarning, File: source.File, Action: "unchanged stock v2 file, can be deleted"})
+		return nil
+	}
+	defer t.diff(source, name, contents)
+
+	directives, problems := parseNginxConf(t.expand(source, contents))
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			t.fail(source, nginxDirective{}, problem)
+		}
+		return nil
+	}
+
+	if err := t.directives(source, directives, context); err != nil {
+		return err
+	}
+
+	switch {
+	case source.Failed, source.LeftOut && source.Migrated == 0:
+	case source.Migrated == 0:
+		t.m.add(Finding{Rule: "custom-nginx", Outcome: OutcomePassed, File: source.File, Action: "nothing to migrate, the PHP web buildpack already configures nginx the same way"})
+	default:
+		t.m.add(Finding{Rule: "custom-nginx", Outcome: OutcomeMigrated, File: source.File, Action: fmt.Sprintf("%d directive(s) written to .nginx.conf.d", source.Migrated)})
+	}
+	return nil
+}
+
+// diff keeps the difference between a failing file and its stock v2 version, so that only what was changed has to be
+// reviewed
+func (t *nginxTranslator) diff(source *nginxSource, name string, contents []byte) {
+	if !source.Failed {
+		return
+	}
+	if diff := stockServerConfigDiff(path.Join("nginx", name), source.File, contents); diff != "" {
+		t.diffs = append(t.diffs, diff)
+	}
+}
+
+// expand replaces the v2 placeholders outside of comments.  Placeholders that cannot be translated are left in place
+// and only fail the build if their directive is migrated.
+func (t *nginxTranslator) expand(source *nginxSource, contents []byte) []byte {
+	lines := strings.Split(string(contents), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		line, _, problems := t.placeholders.expandLine(line)
+		if len(problems) > 0 {
+			source.Problems[i+1] = problems
+		}
+		lines[i] = line
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// directives translates the directives of a file, or of a block of nginx.conf, in the given context
+func (t *nginxTranslator) directives(source *nginxSource, directives []nginxDirective, context nginxContext) error {
+	for _, d := range directives {
+		if d.Name == "include" {
+			if err := t.include(source, d, context); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if context == nginxMain {
+			switch {
+			case d.Name == "http" && d.Block:
+				if err := t.directives(source, d.Children, nginxHTTP); err != nil {
+					return err
+				}
+			case ownedNginxDirectives[d.Name] != "":
+				t.drop(source, d, ownedNginxDirectives[d.Name])
+			default:
+				t.fail(source, d, fmt.Sprintf("`%s` belongs outside of the `http` block, which the v3 includes cannot reach", d.Name))
+			}
+			continue
+		}
+
+		// the application's own server block becomes the server level include, other servers stay at the http level
+		if context == nginxHTTP && d.Name == "server" && d.Block && !t.server {
+			t.server = true
+			if err := t.directives(source, d.Children, nginxServer); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if t.stock[context][d.normalized()] {
+			continue
+		}
+
+		if stockNginxFPMBlocks[d.normalized()] {
+			t.drop(source, d, "the PHP web buildpack passes PHP requests to PHP-FPM itself, as the stock v2 configuration did")
+			continue
+		}
+
+		if lines := t.directive(source, d, 0); len(lines) > 0 {
+			if t.headers[context] != source.File {
+				t.out[context] = append(t.out[context], "", "# From "+source.File)
+				t.headers[context] = source.File
+			}
+			t.out[context] = append(t.out[context], lines...)
+			source.Migrated++
+		}
+	}
+	return nil
+}
+
+// include translates the files from `.bp-config/nginx` that an include reached in place.  Includes of other files
+// are dropped, v3 does not have the stock v2 files they pointed at.
+func (t *nginxTranslator) include(source *nginxSource, d nginxDirective, context nginxContext) error {
+	if len(d.Args) != 1 {
+		t.fail(source, d, "`include` expects a single file")
+		return nil
+	}
+
+	pattern := strings.Trim(d.Args[0], `"'`)
+	if path.IsAbs(pattern) {
+		t.keep(source, d, context)
+		return nil
+	}
+
+	matched, err := t.reach(pattern, context)
+	if err != nil {
+		return err
+	}
+
+	if !matched {
+		t.m.info("%s line %d: `include %s` is dropped, the PHP web buildpack configures nginx in place of the stock v2 file", source.File, d.Line, pattern)
+	}
+	return nil
+}
+
+// reach translates the files from `.bp-config/nginx` that match an include pattern, reporting whether there were any
+func (t *nginxTranslator) reach(pattern string, context nginxContext) (bool, error) {
+	var matched bool
+	for _, file := range t.files {
+		if ok, _ := path.Match(pattern, file); ok {
+			matched = true
+			if err := t.file(file, context); err != nil {
+				return true, err
+			}
+		}
+	}
+	return matched, nil
+}
+
+// keep migrates a single directive as it is
+func (t *nginxTranslator) keep(source *nginxSource, d nginxDirective, context nginxContext) {
+	if !t.expanded(source, d) {
+		return
+	}
+
+	if t.headers[context] != source.File {
+		t.out[context] = append(t.out[context], "", "# From "+source.File)
+		t.headers[context] = source.File
+	}
+	t.out[context] = append(t.out[context], d.render(0)...)
+	source.Migrated++
+}
+
+// directive checks a directive, and the directives inside it, against the settings the PHP web buildpack owns,
+// returning the lines to migrate
+func (t *nginxTranslator) directive(source *nginxSource, d nginxDirective, depth int) []string {
+	switch d.Name {
+	case "listen":
+		if strings.Contains(strings.Join(d.Args, " "), "PORT") {
+			t.drop(source, d, "the PHP web buildpack already listens on $PORT")
+			return nil
+		}
+		t.fail(source, d, "the PHP web buildpack listens on $PORT, where the platform sends requests")
+		return nil
+
+	case "root":
+		// a location can serve files from somewhere else, the http and server level root is WEBDIR
+		if depth > 0 {
+			break
+		}
+		if len(d.Args) == 1 && path.Clean(strings.Trim(d.Args[0], `"'`)) == path.Join(t.placeholders.home, t.placeholders.webDir) {
+			t.drop(source, d, "the PHP web buildpack already serves WEBDIR")
+			return nil
+		}
+		t.fail(source, d, "the PHP web buildpack serves WEBDIR, set WEBDIR in options.json to change it")
+		return nil
+
+	case "fastcgi_pass", "upstream":
+		if pointsAtPHPFpm(d) {
+			t.fail(source, d, "the PHP web buildpack passes PHP requests to PHP-FPM itself, through its own `php_fpm` upstream")
+			return nil
+		}
+	}
+
+	if !t.expanded(source, d) {
+		return nil
+	}
+
+	if !d.Block {
+		return d.render(depth)
+	}
+
+	indent := strings.Repeat("    ", depth)
+	lines := []string{indent + d.text() + " {"}
+	for _, child := range d.Children {
+		lines = append(lines, t.directive(source, child, depth+1)...)
+	}
+	return append(lines, indent+"}")
+}
+
+// expanded fails a directive that is migrated with placeholders that could not be translated
+func (t *nginxTranslator) expanded(source *nginxSource, d nginxDirective) bool {
+	if problems := source.Problems[d.Line]; len(problems) > 0 {
+		for _, problem := range problems {
+			t.fail(source, d, problem)
+		}
+		delete(source.Problems, d.Line)
+		return false
+	}
+	return true
+}
+
+func (t *nginxTranslator) drop(source *nginxSource, d nginxDirective, reason string) {
+	t.m.warning("%s line %d: `%s` is dropped, %s", source.File, d.Line, d.Name, reason)
+	t.m.add(Finding{Rule: "custom-nginx", Outcome: OutcomeWarning, File: source.File, Key: d.Name, Action: "dropped, " + reason})
+}
+
+// fail records a directive that cannot be migrated, which fails the build unless the rule is a warning.  Without a
+// directive the problem carries its own line number.
+func (t *nginxTranslator) fail(source *nginxSource, d nginxDirective, problem string) {
+	if d.Line > 0 {
+		problem = fmt.Sprintf("line %d: %s", d.Line, problem)
+	}
+
+	if t.m.config.Rules.Severity("custom-nginx") == SeverityWarn {
+		source.LeftOut = true
+		t.m.warning("%s %s, it is left out", source.File, problem)
+		t.m.add(Finding{Rule: "custom-nginx", Outcome: OutcomeWarning, File: source.File, Key: d.Name, Action: "left out, " + problem})
+		t.m.leaveOut(source.File, "left out, "+problem)
+		return
+	}
+
+	source.Failed = true
+	t.problems = append(t.problems, fmt.Sprintf("%s %s", source.File, problem))
+	t.m.add(Finding{Rule: "custom-nginx", Outcome: OutcomeFailed, File: source.File, Key: d.Name, Action: "build failed, " + problem})
+}
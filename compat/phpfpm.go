@@ -0,0 +1,220 @@
+package compat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/paketo-buildpacks/php-web/config"
+)
+
+// PHPFpmSnippet is the snippet holding the settings migrated from a full `.bp-config/php/php-fpm.conf`
+const PHPFpmSnippet = ".php.fpm.d/00-compat-php-fpm.conf"
+
+// migratedPHPFpmSections are the sections of php-fpm.conf that map onto the PHP web buildpack's configuration
+var migratedPHPFpmSections = []string{"global", "www"}
+
+// ownedPHPFpmDirectives are set by the PHP web buildpack and cannot be overridden from a snippet
+var ownedPHPFpmDirectives = map[string]string{
+	"daemonize":              "PHP-FPM runs in the foreground so the platform can supervise it",
+	"error_log":              "PHP-FPM logs to standard error so the platform collects its logs",
+	"group":                  "PHP-FPM runs as the user of the image",
+	"include":                fmt.Sprintf("the PHP web buildpack includes the snippets in `%s/` itself", phpFpmSnippetDir),
+	"listen":                 "the PHP web buildpack chooses where PHP-FPM listens for the web server",
+	"listen.allowed_clients": "the PHP web buildpack chooses where PHP-FPM listens for the web server",
+	"pid":                    "PHP-FPM runs in the foreground and does not need a pid file",
+	"user":                   "PHP-FPM runs as the user of the image",
+}
+
+// stockPHPFpmPoolReason explains why the `[www]` directives of the stock php-fpm.conf cannot be changed from a snippet.
+// Nothing is loaded after that pool, so there is no other place they could go.
+var stockPHPFpmPoolReason = fmt.Sprintf("the PHP web buildpack sets it in its own `[www]` pool after including `%s/`, so a snippet cannot change it", phpFpmSnippetDir)
+
+// stockPHPFpmConf reads the defaults, by section, from the php-fpm.conf that the PHP web buildpack generates
+func stockPHPFpmConf() (map[string]map[string]string, error) {
+	tmpl, err := template.New("php-fpm.conf").Parse(config.PhpFpmConfTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, config.PhpFpmConfig{}); err != nil {
+		return nil, err
+	}
+
+	entries, problems := parseINI(buf.Bytes())
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("unable to read the stock php-fpm.conf:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	defaults := map[string]map[string]string{}
+	for _, entry := range entries {
+		if defaults[entry.Section] == nil {
+			defaults[entry.Section] = map[string]string{}
+		}
+		defaults[entry.Section][entry.Key] = entry.Value
+	}
+	return defaults, nil
+}
+
+// MigratePHPFpmConf maps the `[global]` and `[www]` settings of a full `.bp-config/php/php-fpm.conf` override onto
+// PHPFpmSnippet, keeping only those that differ from the stock php-fpm.conf.  The PHP web buildpack includes the
+// snippet at the end of its `[global]` section, so `[global]` settings override its own, but `[www]` settings only take
+// effect for the directives its `[www]` pool does not set.  Changing one of those is a violation of the `php-fpm-conf`
+// rule, the setting would otherwise be lost.
+func (m *migration) MigratePHPFpmConf(options Options) error {
+	if !m.enabled("php-fpm-conf") {
+		return nil
+	}
+
+	source := filepath.Join(legacyPHPConfigDir, "php-fpm.conf")
+
+	exists, err := fileExists(m.fs, filepath.Join(m.appRoot, source))
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		m.add(Finding{Rule: "php-fpm-conf", Outcome: OutcomePassed, Action: "no php-fpm.conf override"})
+		return nil
+	}
+
+	contents, err := m.fs.ReadFile(filepath.Join(m.appRoot, source))
+	if err != nil {
+		return err
+	}
+
+	entries, problems := parseINI(contents)
+	if len(problems) > 0 {
+		return m.failPHPFpmConf(source, problems)
+	}
+
+	defaults, err := stockPHPFpmConf()
+	if err != nil {
+		return err
+	}
+
+	// the last value of a directive in a section wins
+	final := map[string]iniEntry{}
+	for _, entry := range entries {
+		final[entry.Section+"\x00"+entry.Key] = entry
+	}
+
+	placeholders := newSnippetPlaceholders(m.config.ApplicationPath, options)
+
+	var (
+		sections = map[string][]string{}
+		migrated int
+		skipped  = map[string]bool{}
+		lost     []iniEntry
+	)
+	for _, entry := range entries {
+		if final[entry.Section+"\x00"+entry.Key] != entry {
+			continue
+		}
+
+		if !containsString(migratedPHPFpmSections, entry.Section) {
+			if !skipped[entry.Section] {
+				skipped[entry.Section] = true
+				m.warning("%s line %d: the `[%s]` pool is not migrated, only `[global]` and `[www]` are supported", source, entry.Line, entry.Section)
+				m.add(Finding{Rule: "php-fpm-conf", Outcome: OutcomeWarning, File: source, Key: fmt.Sprintf("[%s]", entry.Section), Action: "not migrated, only the [global] and [www] sections are supported"})
+			}
+			continue
+		}
+
+		if reason, owned := ownedPHPFpmDirectives[entry.Key]; owned {
+			m.warning("%s line %d: `%s` is dropped, %s", source, entry.Line, entry.Key, reason)
+			m.add(Finding{Rule: "php-fpm-conf", Outcome: OutcomeWarning, File: source, Key: entry.Key, Action: "dropped, " + reason})
+			continue
+		}
+
+		entry, entryProblems := placeholders.expandEntry(entry)
+		problems = append(problems, entryProblems...)
+
+		value, ok := defaults[entry.Section][entry.Key]
+		if ok && normalizeINIValue(value) == normalizeINIValue(entry.Value) {
+			continue
+		}
+
+		// the snippets are included from [global], ahead of the PHP web buildpack's own [www] pool, whose directives
+		// then win over the ones set in a snippet
+		if ok && entry.Section == "www" {
+			lost = append(lost, entry)
+			continue
+		}
+
+		sections[entry.Section] = append(sections[entry.Section], fmt.Sprintf("%s = %s", entry.Key, entry.Raw))
+		migrated++
+	}
+
+	if len(problems) > 0 {
+		return m.failPHPFpmConf(source, problems)
+	}
+
+	var failed []string
+	for _, entry := range lost {
+		problem := fmt.Sprintf("line %d: `%s = %s` cannot be migrated, %s", entry.Line, entry.Key, entry.Raw, stockPHPFpmPoolReason)
+		finding := Finding{Rule: "php-fpm-conf", File: source, Key: entry.Key, Action: "not migrated, " + stockPHPFpmPoolReason}
+		if err := m.violation(finding, errors.New(problem), fmt.Sprintf("%s %s", source, problem)); err != nil {
+			failed = append(failed, problem)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to migrate `%s`:\n  %s", source, strings.Join(failed, "\n  "))
+	}
+
+	if migrated == 0 {
+		m.add(Finding{Rule: "php-fpm-conf", Outcome: OutcomePassed, File: source, Action: "matches the stock php-fpm.conf, nothing to migrate"})
+		return nil
+	}
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "; Migrated from %s, only the settings that differ from the stock php-fpm.conf\n", filepath.ToSlash(source))
+	for _, section := range migratedPHPFpmSections {
+		if len(sections[section]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "[%s]\n%s\n", section, strings.Join(sections[section], "\n"))
+	}
+
+	err = m.workspace.WriteFile(PHPFpmSnippet, 0644, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	m.warning("Found a php-fpm.conf override at `%s`. This is no longer supported. Moving the %d changed setting(s) to `%s`", source, migrated, PHPFpmSnippet)
+	m.add(Finding{Rule: "php-fpm-conf", Outcome: OutcomeMigrated, File: source, Action: fmt.Sprintf("changed settings written to %s", PHPFpmSnippet)})
+	m.report.Generated(PHPFpmSnippet)
+	return nil
+}
+
+// failPHPFpmConf records an override that cannot be migrated, which fails the build unless the rule is a warning, in which
+// case none of it is migrated
+func (m *migration) failPHPFpmConf(source string, problems []string) error {
+	if m.config.Rules.Severity("php-fpm-conf") == SeverityWarn {
+		for _, problem := range problems {
+			m.warning("%s %s, it is not migrated", source, problem)
+		}
+		m.add(Finding{Rule: "php-fpm-conf", Outcome: OutcomeWarning, File: source, Action: "not migrated, " + strings.Join(problems, "; ")})
+		m.leaveOut(filepath.ToSlash(source), "not migrated, "+strings.Join(problems, "; "))
+		return nil
+	}
+
+	for _, problem := range problems {
+		m.error("%s %s", source, problem)
+	}
+	m.add(Finding{Rule: "php-fpm-conf", Outcome: OutcomeFailed, File: source, Action: "build failed, " + strings.Join(problems, "; ")})
+	return fmt.Errorf("unable to migrate `%s`:\n  %s", source, strings.Join(problems, "\n  "))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
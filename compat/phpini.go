@@ -0,0 +1,244 @@
+package compat
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/paketo-buildpacks/php-web/config"
+)
+
+// PHPIniSnippet is the snippet holding the settings migrated from a full `.bp-config/php/php.ini`.  PHP loads the
+// snippets in name order, the `00-` prefix loads it before the migrated `00-v2-` snippets so that they still override
+// php.ini, as they did in v2.
+const PHPIniSnippet = ".php.ini.d/00-compat-php-ini.ini"
+
+// forbiddenPHPIniDirectives are set by the PHP buildpacks and cannot be overridden from a snippet
+var forbiddenPHPIniDirectives = map[string]string{
+	"extension_dir": "extensions are installed and found by the PHP buildpack",
+	"include_path":  "the PHP web buildpack builds the include path from LIBDIR, set `php.libdirectory` in buildpack.yml instead",
+}
+
+// removedPHPIniDirectives lists the directives PHP stopped accepting, by the version that removed them
+var removedPHPIniDirectives = map[string][]string{
+	"7.0": {"always_populate_raw_post_data", "asp_tags", "xsl.security_prefs"},
+	"7.1": {"session.entropy_file", "session.entropy_length", "session.hash_bits_per_character", "session.hash_function"},
+	"8.0": {"assert.quiet_eval", "mbstring.func_overload", "track_errors"},
+}
+
+// oldestPHPVersion is assumed when neither options.json nor the extension catalog chooses a PHP version
+const oldestPHPVersion = "7.1"
+
+var phpMinorVersionPattern = regexp.MustCompile(`^(\d+)\.(\d+)`)
+
+// stockPHPIni reads the defaults from the php.ini that the PHP web buildpack generates
+func stockPHPIni(applicationPath string, libDir string) (map[string]string, error) {
+	tmpl, err := template.New("php.ini").Parse(config.PhpIniTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, config.PhpIniConfig{AppRoot: applicationPath, LibDirectory: libDir}); err != nil {
+		return nil, err
+	}
+
+	entries, problems := parseINI(buf.Bytes())
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("unable to read the stock php.ini:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	defaults := map[string]string{}
+	for _, entry := range entries {
+		defaults[entry.Key] = entry.Value
+	}
+	return defaults, nil
+}
+
+// removedPHPIniDirective returns the version that removed a directive, if the selected PHP version no longer accepts it.
+// defaultVersion is the version installed when PHP_VERSION is not set.
+func removedPHPIniDirective(phpVersion string, defaultVersion string, directive string) (string, bool) {
+	selected := oldestPHPVersion
+	if match := phpMinorVersionPattern.FindString(phpVersion); match != "" {
+		selected = match
+	} else if strings.TrimSpace(phpVersion) == "" && defaultVersion != "" {
+		selected = defaultVersion
+	}
+
+	for version, directives := range removedPHPIniDirectives {
+		if compareMinorVersions(selected, version) < 0 {
+			continue
+		}
+		for _, removed := range directives {
+			if removed == directive {
+				return version, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func compareMinorVersions(a string, b string) int {
+	aParts, bParts := strings.SplitN(a, ".", 2), strings.SplitN(b, ".", 2)
+	for i := range aParts {
+		aNumber, _ := strconv.Atoi(aParts[i])
+		bNumber, _ := strconv.Atoi(bParts[i])
+		if aNumber != bNumber {
+			return aNumber - bNumber
+		}
+	}
+	return 0
+}
+
+// MigratePHPIni reduces a full `.bp-config/php/php.ini` override to the directives that differ from the stock
+// php.ini, and writes them to PHPIniSnippet
+func (m *migration) MigratePHPIni(options Options) error {
+	if !m.enabled("php-ini") {
+		return nil
+	}
+
+	source := filepath.Join(legacyPHPConfigDir, "php.ini")
+
+	exists, err := fileExists(m.fs, filepath.Join(m.appRoot, source))
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		m.add(Finding{Rule: "php-ini", Outcome: OutcomePassed, Action: "no php.ini override"})
+		return nil
+	}
+
+	contents, err := m.fs.ReadFile(filepath.Join(m.appRoot, source))
+	if err != nil {
+		return err
+	}
+
+	entries, problems := parseINI(contents)
+	if len(problems) > 0 {
+		return m.failPHPIni(source, problems)
+	}
+
+	placeholders := newSnippetPlaceholders(m.config.ApplicationPath, options)
+
+	defaults, err := stockPHPIni(placeholders.home, placeholders.libDir)
+	if err != nil {
+		return err
+	}
+
+	// the last value of a directive wins, except for extensions, which are all loaded
+	final := map[string]iniEntry{}
+	for _, entry := range entries {
+		final[entry.Key] = entry
+	}
+
+	migratedExtensions := map[string]bool{}
+	for _, extension := range append(append([]string{}, options.PHP.Extensions...), options.PHP.ZendExtensions...) {
+		migratedExtensions[extension] = true
+	}
+
+	var (
+		lines    []string
+		migrated int
+		written  = map[string]bool{}
+		reported = map[string]bool{}
+		section  string
+	)
+	for _, entry := range entries {
+		isExtension := entry.Key == "extension" || entry.Key == "zend_extension"
+		if !isExtension && (written[entry.Key] || final[entry.Key] != entry) {
+			continue
+		}
+		written[entry.Key] = true
+
+		if reason, forbidden := forbiddenPHPIniDirectives[entry.Key]; forbidden {
+			m.warning("%s line %d: `%s` is not migrated, %s", source, entry.Line, entry.Key, reason)
+			m.add(Finding{Rule: "php-ini", Outcome: OutcomeWarning, File: source, Key: entry.Key, Action: "not migrated, " + reason})
+			continue
+		}
+
+		if version, removed := removedPHPIniDirective(options.PHP.Version, m.config.Extensions.Default, entry.Key); removed {
+			m.warning("%s line %d: `%s` is not migrated, it was removed in PHP %s", source, entry.Line, entry.Key, version)
+			m.add(Finding{Rule: "php-ini", Outcome: OutcomeWarning, File: source, Key: entry.Key, Action: fmt.Sprintf("not migrated, removed in PHP %s", version)})
+			continue
+		}
+
+		entry, entryProblems := placeholders.expandEntry(entry)
+		for _, problem := range entryProblems {
+			// a section is expanded with each of its directives, its problems are reported once
+			if !reported[problem] {
+				reported[problem] = true
+				problems = append(problems, problem)
+			}
+		}
+
+		if isExtension {
+			name := strings.TrimSuffix(filepath.Base(entry.Value), ".so")
+			if migratedExtensions[name] {
+				continue
+			}
+		} else if value, ok := defaults[entry.Key]; ok && normalizeINIValue(value) == normalizeINIValue(entry.Value) {
+			continue
+		}
+
+		entrySection := ""
+		if isScopedPHPIniSection(entry.Section) {
+			entrySection = entry.Section
+		}
+		if entrySection != section {
+			if entrySection == "" {
+				lines = append(lines, "[PHP]")
+			} else {
+				lines = append(lines, fmt.Sprintf("[%s]", entrySection))
+			}
+			section = entrySection
+		}
+
+		lines = append(lines, fmt.Sprintf("%s = %s", entry.Key, entry.Raw))
+		migrated++
+	}
+
+	if len(problems) > 0 {
+		return m.failPHPIni(source, problems)
+	}
+
+	if migrated == 0 {
+		m.add(Finding{Rule: "php-ini", Outcome: OutcomePassed, File: source, Action: "matches the stock php.ini, nothing to migrate"})
+		return nil
+	}
+
+	header := fmt.Sprintf("; Migrated from %s, only the settings that differ from the stock php.ini\n", filepath.ToSlash(source))
+	err = m.workspace.WriteFile(PHPIniSnippet, 0644, []byte(header+strings.Join(lines, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+
+	m.warning("Found a php.ini override at `%s`. This is no longer supported. Moving the %d changed setting(s) to `%s`", source, migrated, PHPIniSnippet)
+	m.add(Finding{Rule: "php-ini", Outcome: OutcomeMigrated, File: source, Action: fmt.Sprintf("changed settings written to %s", PHPIniSnippet)})
+	m.report.Generated(PHPIniSnippet)
+	return nil
+}
+
+// failPHPIni records an override that cannot be migrated, which fails the build unless the rule is a warning, in which
+// case none of it is migrated
+func (m *migration) failPHPIni(source string, problems []string) error {
+	if m.config.Rules.Severity("php-ini") == SeverityWarn {
+		for _, problem := range problems {
+			m.warning("%s %s, it is not migrated", source, problem)
+		}
+		m.add(Finding{Rule: "php-ini", Outcome: OutcomeWarning, File: source, Action: "not migrated, " + strings.Join(problems, "; ")})
+		m.leaveOut(filepath.ToSlash(source), "not migrated, "+strings.Join(problems, "; "))
+		return nil
+	}
+
+	for _, problem := range problems {
+		m.error("%s %s", source, problem)
+	}
+	m.add(Finding{Rule: "php-ini", Outcome: OutcomeFailed, File: source, Action: "build failed, " + strings.Join(problems, "; ")})
+	return fmt.Errorf("unable to migrate `%s`:\n  %s", source, strings.Join(problems, "\n  "))
+}
@@ -0,0 +1,122 @@
+package compat
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+	"github.com/cloudfoundry/libcfbuildpack/layers"
+)
+
+// ReportEnv is set at launch to the location of the migration report
+const ReportEnv = "PHP_COMPAT_REPORT"
+
+// Outcome is the result of evaluating a single migration rule
+type Outcome string
+
+const (
+	OutcomePassed   Outcome = "passed"
+	OutcomeMigrated Outcome = "migrated"
+	OutcomeWarning  Outcome = "warning"
+	// OutcomeDropped is a known v2 setting that is not carried over to v3
+	OutcomeDropped Outcome = "dropped"
+	OutcomeFailed  Outcome = "failed"
+)
+
+// Finding records a migration rule that was evaluated, what it found and what was done about it
+type Finding struct {
+	Rule    string  `json:"rule"`
+	Outcome Outcome `json:"outcome"`
+	File    string  `json:"file,omitempty"`
+	Key     string  `json:"key,omitempty"`
+	Action  string  `json:"action"`
+}
+
+// Report is the machine readable record of a migration
+type Report struct {
+	DryRun         bool      `json:"dry_run"`
+	Findings       []Finding `json:"findings"`
+	GeneratedFiles []string  `json:"generated_files"`
+	// Inventory classifies every file found under `.bp-config`
+	Inventory []InventoryItem `json:"inventory"`
+}
+
+// Add records a finding
+func (r *Report) Add(finding Finding) {
+	r.Findings = append(r.Findings, finding)
+}
+
+// Generated records a file, relative to the application root, that the migration created or changed
+func (r *Report) Generated(file string) {
+	for _, existing := range r.GeneratedFiles {
+		if existing == file {
+			return
+		}
+	}
+	r.GeneratedFiles = append(r.GeneratedFiles, file)
+}
+
+// Markdown summarises the report as a table
+func (r Report) Markdown() string {
+	escape := func(value string) string {
+		return strings.ReplaceAll(value, "|", `\|`)
+	}
+
+	lines := []string{
+		"| Rule | Outcome | Source | Action |",
+		"| --- | --- | --- | --- |",
+	}
+
+	for _, finding := range r.Findings {
+		source := finding.File
+		if finding.Key != "" {
+			source = fmt.Sprintf("%s `%s`", source, finding.Key)
+		}
+		lines = append(lines, fmt.Sprintf("| %s | %s | %s | %s |", finding.Rule, finding.Outcome, escape(strings.TrimSpace(source)), escape(finding.Action)))
+	}
+
+	if len(r.GeneratedFiles) > 0 {
+		lines = append(lines, "", "Generated files:")
+		for _, file := range r.GeneratedFiles {
+			lines = append(lines, fmt.Sprintf("- `%s`", file))
+		}
+	}
+
+	if len(r.Inventory) > 0 {
+		lines = append(lines, "", "| File | Classification | Reason |", "| --- | --- | --- |")
+		for _, item := range r.Inventory {
+			lines = append(lines, fmt.Sprintf("| %s | %s | %s |", escape(item.File), item.Classification, escape(item.Reason)))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// WriteReport logs the report and writes it as JSON to the launch layer, exposing its location through ReportEnv
+func (c Contributor) WriteReport(report Report) error {
+	c.log.Header("PHP Compat migration report")
+	c.log.Body("%s", report.Markdown())
+
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	layer := c.layers.Layer(Layer)
+	layer.Touch()
+
+	reportPath := filepath.Join(layer.Root, "report.json")
+	err = helper.WriteFile(reportPath, 0644, "%s", contents)
+	if err != nil {
+		return err
+	}
+
+	err = layer.OverrideLaunchEnv(ReportEnv, reportPath)
+	if err != nil {
+		return err
+	}
+
+	return layer.WriteMetadata(map[string]interface{}{"report": reportPath}, layers.Launch)
+}
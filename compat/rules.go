@@ -0,0 +1,164 @@
+package compat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RulesEnv changes the severity of migration rules, as a comma separated list such as
+// `custom-httpd=warn,webdir-move=off`.  Rules that are not listed keep their default severity.
+const RulesEnv = "BP_PHP_COMPAT_RULES"
+
+// Severity decides what happens when a rule finds something that v3 no longer does
+type Severity string
+
+const (
+	// SeverityError fails the build
+	SeverityError Severity = "error"
+	// SeverityWarn reports the problem and carries on without it
+	SeverityWarn Severity = "warn"
+	// SeverityOff skips the rule
+	SeverityOff Severity = "off"
+)
+
+// Rule is a migration check whose findings are reported under its ID
+type Rule struct {
+	ID          string
+	Default     Severity
+	Description string
+	// Fixed rules keep their default severity, because detection already fails on what they check or because DryRunEnv
+	// already decides what a dry run does
+	Fixed bool
+}
+
+// Rules lists every rule, in the order the migration evaluates them.  Only the severity of the rules that are not
+// fixed can be changed through RulesEnv.
+var Rules = []Rule{
+	{ID: "extensions-folder", Default: SeverityError, Description: "a `.extensions` folder, v2 buildpack extensions are no longer run"},
+	{ID: "legacy-option", Default: SeverityWarn, Description: "options.json settings that v3 handles differently or not at all"},
+	{ID: "version-placeholders", Default: SeverityError, Description: "version placeholders such as `{PHP_73_LATEST}` that cannot be resolved", Fixed: true},
+	{ID: "web-server", Default: SeverityError, Description: "a `WEB_SERVER` that v3 does not offer", Fixed: true},
+	{ID: "webdir-move", Default: SeverityError, Description: "a web application without WEBDIR, files are no longer moved into it"},
+	{ID: "app-start-cmd", Default: SeverityWarn, Description: "an `APP_START_CMD` that is not a PHP script, which becomes a launch process"},
+	{ID: "php-modules", Default: SeverityError, Description: "`PHP_MODULES` that v3 cannot provide"},
+	{ID: "composer-latest", Default: SeverityWarn, Description: "COMPOSER_VERSION set to `latest`, the default Composer version is used instead"},
+	{ID: "composer-notes", Default: SeverityWarn, Description: "a Composer application, the vendor directory and Composer files are no longer moved"},
+	{ID: "custom-httpd", Default: SeverityError, Description: "directives under `.bp-config/httpd` that cannot be migrated"},
+	{ID: "custom-nginx", Default: SeverityError, Description: "directives under `.bp-config/nginx` that cannot be migrated"},
+	{ID: "php-ini-snippets", Default: SeverityError, Description: "snippets under `.bp-config/php/php.ini.d` that conflict with existing files, resolved as " + SnippetConflictsEnv + " says"},
+	{ID: "snippet-placeholders", Default: SeverityError, Description: "placeholders in snippets that cannot be translated"},
+	{ID: "php-fpm-snippets", Default: SeverityError, Description: "snippets under `.bp-config/php/fpm.d` that conflict with existing files, resolved as " + SnippetConflictsEnv + " says"},
+	{ID: "php-ini", Default: SeverityError, Description: "a `.bp-config/php/php.ini` override that cannot be parsed or translated"},
+	{ID: "php-fpm-conf", Default: SeverityError, Description: "a `.bp-config/php/php-fpm.conf` override that cannot be parsed or translated, or that changes the stock `[www]` pool"},
+	{ID: "composer-extensions", Default: SeverityError, Description: "Composer `ext-*` requirements, handled as " + ComposerExtensionsEnv + " says"},
+	{ID: "extensions", Default: SeverityError, Description: "extensions that the selected PHP version does not provide"},
+	{ID: "snippet-validation", Default: SeverityError, Description: "snippets that cannot be parsed or set a directive to conflicting values"},
+	{ID: "buildpack-yml", Default: SeverityError, Description: "settings that conflict with an existing buildpack.yml, resolved as " + MergePolicyEnv + " says"},
+	{ID: "dry-run", Default: SeverityError, Description: "files that a dry run with " + DryRunEnv + " set to `" + string(DryRunFail) + "` would create or change", Fixed: true},
+}
+
+// RuleSeverities are the severities chosen for rules by their ID
+type RuleSeverities map[string]Severity
+
+// ParseRuleSeverities validates a list of `rule=severity` pairs as found in RulesEnv
+func ParseRuleSeverities(value string) (RuleSeverities, error) {
+	severities := RuleSeverities{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s expects `rule=severity` pairs, found `%s`", RulesEnv, entry)
+		}
+
+		id := strings.ToLower(strings.TrimSpace(parts[0]))
+		rule, ok := findRule(id)
+		if !ok {
+			var ids []string
+			for _, rule := range Rules {
+				ids = append(ids, "`"+rule.ID+"`")
+			}
+			return nil, fmt.Errorf("%s names the unknown rule `%s`, it must be one of %s", RulesEnv, parts[0], strings.Join(ids, ", "))
+		}
+
+		switch severity := Severity(strings.ToLower(strings.TrimSpace(parts[1]))); severity {
+		case SeverityError, SeverityWarn, SeverityOff:
+			if rule.Fixed && severity != rule.Default {
+				return nil, fmt.Errorf("%s cannot set `%s` to `%s`, it is always `%s`", RulesEnv, id, severity, rule.Default)
+			}
+			severities[id] = severity
+		default:
+			return nil, fmt.Errorf("%s must set `%s` to `%s`, `%s` or `%s`, found `%s`", RulesEnv, id, SeverityError, SeverityWarn, SeverityOff, parts[1])
+		}
+	}
+
+	return severities, nil
+}
+
+// Severity is the severity of a rule, its default unless one was chosen.  Unknown rules are errors.
+func (s RuleSeverities) Severity(id string) Severity {
+	if severity, ok := s[id]; ok {
+		return severity
+	}
+	if rule, ok := findRule(id); ok {
+		return rule.Default
+	}
+	return SeverityError
+}
+
+func findRule(id string) (Rule, bool) {
+	for _, rule := range Rules {
+		if rule.ID == id {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// ReportRuleSeverities logs the severity chosen for every rule that does not use its default
+func (m *migration) ReportRuleSeverities() {
+	for _, rule := range Rules {
+		if severity := m.config.Rules.Severity(rule.ID); severity != rule.Default {
+			m.info("%s sets `%s` to `%s` instead of `%s`: %s", RulesEnv, rule.ID, severity, rule.Default, rule.Description)
+		}
+	}
+}
+
+// enabled reports whether a rule runs, logging the rules that are turned off
+func (m *migration) enabled(rule string) bool {
+	if m.config.Rules.Severity(rule) != SeverityOff {
+		return true
+	}
+
+	m.info("Skipping `%s`, it is turned off through %s", rule, RulesEnv)
+	return false
+}
+
+// violation records a problem found by a rule according to its severity.  As an error the finding fails, the
+// messages are logged as errors and err is returned to fail the build.  As a warning they are only logged, falling
+// back to err if there are none.
+func (m *migration) violation(finding Finding, err error, messages ...string) error {
+	if m.config.Rules.Severity(finding.Rule) == SeverityError {
+		for _, message := range messages {
+			m.error("%s", message)
+		}
+		finding.Outcome = OutcomeFailed
+		finding.Action = "build failed, " + finding.Action
+		m.add(finding)
+		return err
+	}
+
+	if len(messages) == 0 {
+		messages = []string{err.Error()}
+	}
+	for _, message := range messages {
+		m.warning("%s", message)
+	}
+	finding.Outcome = OutcomeWarning
+	m.add(finding)
+	return nil
+}
@@ -0,0 +1,442 @@
+package compat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type optionType string
+
+const (
+	stringOption     optionType = "a string"
+	stringListOption optionType = "a list of strings"
+	boolOption       optionType = "a boolean"
+	scalarOption     optionType = "a string or a boolean"
+)
+
+type optionStatus string
+
+const (
+	optionMigrated    optionStatus = "migrated"
+	optionIgnored     optionStatus = "ignored"
+	optionUnsupported optionStatus = "unsupported"
+)
+
+type optionDefinition struct {
+	Type     optionType
+	Status   optionStatus
+	Guidance string
+}
+
+// optionsSchema catalogs every key that the v2 PHP buildpack understood in `.bp-config/options.json`, along with
+// what happens to it during migration.  Families of keys, such as version placeholders, are in optionPatterns.
+var optionsSchema = map[string]optionDefinition{
+	"ADDITIONAL_PREPROCESS_CMDS": {
+		Type:     stringListOption,
+		Status:   optionUnsupported,
+		Guidance: "Commands are no longer run before your application starts. Move them into a `.profile` script at the root of your application and remove this setting from options.json.",
+	},
+	"ADMIN_EMAIL": {
+		Type:     stringOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `php.serveradmin` in buildpack.yml.",
+	},
+	"APP_START_CMD": {
+		Type:     stringOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `php.script` in buildpack.yml when it is a PHP script under the application, otherwise run as a launch process.",
+	},
+	"COMPOSER_BIN_DIR": {
+		Type:     stringOption,
+		Status:   optionUnsupported,
+		Guidance: "COMPOSER_BIN_DIR is no longer supported. Please create a Github issue if you have a use case which requires this option. Otherwise, remove this setting from options.json.",
+	},
+	"COMPOSER_CACHE_DIR": {
+		Type:     stringOption,
+		Status:   optionUnsupported,
+		Guidance: "COMPOSER_CACHE_DIR is no longer supported. Please create a Github issue if you have a use case which requires this option. Otherwise, remove this setting from options.json.",
+	},
+	"COMPOSER_GITHUB_OAUTH_TOKEN": {
+		Type:     stringOption,
+		Status:   optionUnsupported,
+		Guidance: "Tokens are no longer read from options.json. Set COMPOSER_GITHUB_OAUTH_TOKEN as an environment variable instead and remove this setting from options.json.",
+	},
+	"COMPOSER_INSTALL_GLOBAL": {
+		Type:     stringListOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `composer.install_global` in buildpack.yml.",
+	},
+	"COMPOSER_INSTALL_OPTIONS": {
+		Type:     stringListOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `composer.install_options` in buildpack.yml.",
+	},
+	"COMPOSER_VENDOR_DIR": {
+		Type:     stringOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `composer.vendor_directory` in buildpack.yml.",
+	},
+	"COMPOSER_VERSION": {
+		Type:     stringOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `composer.version` in buildpack.yml.",
+	},
+	"DOWNLOAD_URL": {
+		Type:     stringOption,
+		Status:   optionIgnored,
+		Guidance: "Dependencies are now provided by each buildpack. Remove this setting from options.json.",
+	},
+	"HTTPD_MODULES_STRIP": {
+		Type:     boolOption,
+		Status:   optionIgnored,
+		Guidance: "HTTPD modules are no longer stripped. Remove this setting from options.json.",
+	},
+	"HTTPD_STRIP": {
+		Type:     boolOption,
+		Status:   optionIgnored,
+		Guidance: "HTTPD files are no longer stripped. Remove this setting from options.json.",
+	},
+	"HTTPD_VERSION": {
+		Type:     stringOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `httpd.version` in buildpack.yml.",
+	},
+	"LIBDIR": {
+		Type:     stringOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `php.libdirectory` in buildpack.yml.",
+	},
+	"NGINX_STRIP": {
+		Type:     boolOption,
+		Status:   optionIgnored,
+		Guidance: "Nginx files are no longer stripped. Remove this setting from options.json.",
+	},
+	"NGINX_VERSION": {
+		Type:     stringOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `nginx.version` in buildpack.yml.",
+	},
+	"PHP_FPM_LISTEN": {
+		Type:     stringOption,
+		Status:   optionIgnored,
+		Guidance: "The PHP web buildpack chooses where PHP-FPM listens. Remove this setting from options.json.",
+	},
+	"PHP_EXTENSIONS": {
+		Type:     stringListOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `.php.ini.d/compat-extensions.ini`.",
+	},
+	"PHP_MODULES": {
+		Type:     stringListOption,
+		Status:   optionMigrated,
+		Guidance: "The full PHP distribution is always installed, which provides `cli` and `fpm`. `cgi` and `pear` are no longer available.",
+	},
+	"PHP_MODULES_STRIP": {
+		Type:     boolOption,
+		Status:   optionIgnored,
+		Guidance: "PHP modules are no longer stripped. Remove this setting from options.json.",
+	},
+	"PHP_STRIP": {
+		Type:     boolOption,
+		Status:   optionIgnored,
+		Guidance: "PHP files are no longer stripped. Remove this setting from options.json.",
+	},
+	"PHP_VERSION": {
+		Type:     stringOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `php.version` in buildpack.yml.",
+	},
+	"PHP_VM": {
+		Type:     stringOption,
+		Status:   optionIgnored,
+		Guidance: "PHP is the only supported runtime. Remove this setting from options.json.",
+	},
+	"STACK": {
+		Type:     stringOption,
+		Status:   optionIgnored,
+		Guidance: "The stack is chosen by the platform. Remove this setting from options.json.",
+	},
+	"WEBDIR": {
+		Type:     stringOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `php.webdirectory` in buildpack.yml.",
+	},
+	"WEB_SERVER": {
+		Type:     stringOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `php.webserver` in buildpack.yml, `apache` as `httpd`. `none` runs the application as a script.",
+	},
+	"ZEND_EXTENSIONS": {
+		Type:     stringListOption,
+		Status:   optionMigrated,
+		Guidance: "Migrated to `.php.ini.d/compat-extensions.ini`.",
+	},
+}
+
+// optionPatterns catalogs the families of v2 keys that are matched by name, such as the version placeholders that the
+// v2 defaults defined alongside the options
+var optionPatterns = []struct {
+	Pattern    *regexp.Regexp
+	Definition optionDefinition
+}{
+	{
+		Pattern: regexp.MustCompile(`^(PHP|HTTPD|NGINX|COMPOSER)_([0-9]+_LATEST|LATEST|DEFAULT|STABLE|MAINLINE)$`),
+		Definition: optionDefinition{
+			Type:     stringOption,
+			Status:   optionIgnored,
+			Guidance: "Version placeholders are resolved from the buildpack, the value set here is not used. Remove this setting from options.json.",
+		},
+	},
+	{
+		Pattern: regexp.MustCompile(`^([A-Z0-9]+_)*(DOWNLOAD|HASH)_URL$`),
+		Definition: optionDefinition{
+			Type:     stringOption,
+			Status:   optionIgnored,
+			Guidance: "Dependencies are now provided by each buildpack. Remove this setting from options.json.",
+		},
+	},
+	{
+		Pattern: regexp.MustCompile(`^NEWRELIC_[A-Z0-9_]+$`),
+		Definition: optionDefinition{
+			Type:     scalarOption,
+			Status:   optionUnsupported,
+			Guidance: "The PHP buildpacks do not install the New Relic agent. Use a New Relic buildpack instead and remove this setting from options.json.",
+		},
+	},
+}
+
+// lookupOption finds the definition of a v2 key, by name or by the family it belongs to
+func lookupOption(key string) (optionDefinition, bool) {
+	if definition, ok := optionsSchema[key]; ok {
+		return definition, true
+	}
+
+	for _, family := range optionPatterns {
+		if family.Pattern.MatchString(key) {
+			return family.Definition, true
+		}
+	}
+
+	return optionDefinition{}, false
+}
+
+// OptionsProblem is a single problem found in `.bp-config/options.json`, positioned by line and column
+type OptionsProblem struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+// OptionsError lists every problem found while validating `.bp-config/options.json`
+type OptionsError struct {
+	Problems []OptionsProblem
+}
+
+func (e OptionsError) Error() string {
+	lines := []string{fmt.Sprintf("found %d problem(s) in `.bp-config/options.json`:", len(e.Problems))}
+	for _, problem := range e.Problems {
+		lines = append(lines, fmt.Sprintf("  line %d, column %d: %s", problem.Line, problem.Column, problem.Message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validateOptionsJSON checks the contents of options.json against optionsSchema and reports every problem it finds.
+// It returns the options present in the file, in the order they appear.
+func validateOptionsJSON(contents []byte) ([]string, error) {
+	var problems []OptionsProblem
+	report := func(offset int64, format string, args ...interface{}) {
+		line, column := position(contents, offset)
+		problems = append(problems, OptionsProblem{Line: line, Column: column, Message: fmt.Sprintf(format, args...)})
+	}
+	syntaxError := func(err error) error {
+		offset := int64(len(contents))
+		if syntaxErr, ok := err.(*json.SyntaxError); ok && syntaxErr.Offset > 0 {
+			// the decoder reports the offset just past the offending character
+			offset = syntaxErr.Offset - 1
+		}
+		report(offset, "invalid JSON: %s", err)
+		return OptionsError{Problems: problems}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+
+	start := nextTokenOffset(contents, 0)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, syntaxError(err)
+	}
+
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		report(start, "expected a JSON object containing options")
+		return nil, OptionsError{Problems: problems}
+	}
+
+	var keys []string
+	seen := map[string]int64{}
+	for decoder.More() {
+		keyOffset := nextTokenOffset(contents, decoder.InputOffset())
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, syntaxError(err)
+		}
+		key := token.(string)
+
+		valueOffset := nextTokenOffset(contents, decoder.InputOffset())
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, syntaxError(err)
+		}
+
+		if first, ok := seen[key]; ok {
+			line, column := position(contents, first)
+			report(keyOffset, "duplicate option %q, first defined at line %d, column %d", key, line, column)
+			continue
+		}
+		seen[key] = keyOffset
+
+		definition, known := lookupOption(key)
+		if !known {
+			if suggestion := suggestOption(key); suggestion != "" {
+				report(keyOffset, "unknown option %q, did you mean %q?", key, suggestion)
+			} else {
+				report(keyOffset, "unknown option %q", key)
+			}
+			continue
+		}
+		keys = append(keys, key)
+
+		if found, ok := checkOptionType(definition.Type, value); !ok {
+			report(valueOffset, "%s must be %s, found %s", key, definition.Type, found)
+		}
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, syntaxError(err)
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		report(nextTokenOffset(contents, decoder.InputOffset()), "unexpected content after the closing brace")
+	}
+
+	if len(problems) > 0 {
+		return nil, OptionsError{Problems: problems}
+	}
+
+	return keys, nil
+}
+
+// checkOptionType reports whether value has the expected type and, if not, describes what was found instead.
+// A `null` value is always accepted, as it was by the v2 buildpack.
+func checkOptionType(expected optionType, value json.RawMessage) (string, bool) {
+	var decoded interface{}
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		return "invalid JSON", false
+	}
+
+	switch v := decoded.(type) {
+	case nil:
+		return "null", true
+	case string:
+		return "a string", expected == stringOption || expected == scalarOption
+	case bool:
+		return "a boolean", expected == boolOption || expected == scalarOption
+	case float64:
+		return "a number", false
+	case map[string]interface{}:
+		return "an object", false
+	case []interface{}:
+		if expected != stringListOption {
+			return "a list", false
+		}
+		for i, item := range v {
+			if _, ok := item.(string); !ok {
+				return fmt.Sprintf("a non-string value at index %d", i), false
+			}
+		}
+		return "a list of strings", true
+	}
+
+	return "an unknown value", false
+}
+
+// suggestOption finds the known option closest to key, allowing for case, surrounding whitespace and small typos
+func suggestOption(key string) string {
+	normalized := strings.ToUpper(strings.TrimSpace(key))
+
+	var known []string
+	for option := range optionsSchema {
+		known = append(known, option)
+	}
+	sort.Strings(known)
+
+	suggestion, best := "", 3
+	for _, option := range known {
+		if option == normalized {
+			return option
+		}
+
+		if distance := levenshtein(normalized, option); distance < best {
+			suggestion, best = option, distance
+		}
+	}
+
+	return suggestion
+}
+
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	result := values[0]
+	for _, value := range values[1:] {
+		if value < result {
+			result = value
+		}
+	}
+	return result
+}
+
+// nextTokenOffset skips the whitespace and separators that the JSON decoder leaves in front of the next token
+func nextTokenOffset(contents []byte, offset int64) int64 {
+	for offset < int64(len(contents)) && strings.IndexByte(" \t\r\n,:", contents[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// position converts a byte offset into a 1-based line and column
+func position(contents []byte, offset int64) (int, int) {
+	if offset > int64(len(contents)) {
+		offset = int64(len(contents))
+	}
+
+	before := contents[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+
+	return line, column
+}
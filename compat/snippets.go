@@ -0,0 +1,333 @@
+package compat
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultApplicationPath is where the lifecycle puts the application, in the build and when it runs
+const DefaultApplicationPath = "/workspace"
+
+// snippetPlaceholderPattern matches the v2 placeholders `{NAME}`, `@{NAME}`, replaced while staging, and `#{NAME}`,
+// replaced when the application started
+var snippetPlaceholderPattern = regexp.MustCompile(`([@#]?)\{([A-Z][A-Z0-9_]*)\}`)
+
+// legacyPHPConfigDir holds the v2 php.ini and php-fpm overrides, relative to the application
+var legacyPHPConfigDir = filepath.Join(".bp-config", "php")
+
+const (
+	// phpIniSnippetDir holds the php.ini snippets the PHP web buildpack loads
+	phpIniSnippetDir = ".php.ini.d"
+	// phpFpmSnippetDir holds the php-fpm snippets the PHP web buildpack includes
+	phpFpmSnippetDir = ".php.fpm.d"
+)
+
+// migratedSnippetPrefix starts the names of migrated snippets
+const migratedSnippetPrefix = "00-v2-"
+
+// SnippetConflictsEnv selects the SnippetConflictPolicy
+const SnippetConflictsEnv = "BP_PHP_COMPAT_SNIPPET_CONFLICTS"
+
+// SnippetConflictPolicy decides what happens when a migrated snippet would replace an existing file with different
+// contents
+type SnippetConflictPolicy string
+
+const (
+	// KeepExistingSnippets leaves the existing file alone and does not migrate the snippet
+	KeepExistingSnippets SnippetConflictPolicy = "keep"
+	// ReplaceExistingSnippets overwrites the existing file with the migrated snippet
+	ReplaceExistingSnippets SnippetConflictPolicy = "replace"
+	// FailOnSnippetConflict fails the build while any snippet conflicts with an existing file
+	FailOnSnippetConflict SnippetConflictPolicy = "fail"
+)
+
+// ParseSnippetConflictPolicy validates a snippet conflict policy, defaulting to FailOnSnippetConflict
+func ParseSnippetConflictPolicy(value string) (SnippetConflictPolicy, error) {
+	switch policy := SnippetConflictPolicy(strings.ToLower(value)); policy {
+	case "":
+		return FailOnSnippetConflict, nil
+	case KeepExistingSnippets, ReplaceExistingSnippets, FailOnSnippetConflict:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%s must be one of `%s`, `%s` or `%s`, found `%s`", SnippetConflictsEnv, KeepExistingSnippets, ReplaceExistingSnippets, FailOnSnippetConflict, value)
+	}
+}
+
+// untranslatablePlaceholders explains the v2 placeholders that have no v3 equivalent
+var untranslatablePlaceholders = map[string]string{
+	"PHP_FPM_LISTEN": "the PHP-FPM listen address is managed by the PHP web buildpack, remove the setting that uses it",
+}
+
+// snippetPlaceholders translates the v2 placeholders found in php.ini and php-fpm snippets
+type snippetPlaceholders struct {
+	home   string
+	webDir string
+	libDir string
+}
+
+func newSnippetPlaceholders(applicationPath string, options Options) snippetPlaceholders {
+	placeholders := snippetPlaceholders{home: applicationPath, webDir: "htdocs", libDir: "lib"}
+	if options.PHP.WebDir != "" {
+		placeholders.webDir = options.PHP.WebDir
+	}
+	if options.PHP.LibDir != "" {
+		placeholders.libDir = options.PHP.LibDir
+	}
+	return placeholders
+}
+
+// translate finds the v3 replacement for a placeholder, or explains why there is none
+func (p snippetPlaceholders) translate(prefix string, name string) (string, error) {
+	if reason, ok := untranslatablePlaceholders[name]; ok {
+		return "", fmt.Errorf("`%s{%s}` cannot be translated, %s", prefix, name, reason)
+	}
+
+	switch name {
+	case "HOME":
+		return p.home, nil
+	case "WEBDIR":
+		return p.webDir, nil
+	case "LIBDIR":
+		return p.libDir, nil
+	case "TMPDIR":
+		return "/tmp", nil
+	}
+
+	// runtime placeholders were read from the environment, which PHP can still do itself
+	if prefix == "#" {
+		return fmt.Sprintf("${%s}", name), nil
+	}
+
+	return "", fmt.Errorf("`%s{%s}` is not a known placeholder, expected one of `{HOME}`, `{WEBDIR}`, `{LIBDIR}` or `{TMPDIR}`", prefix, name)
+}
+
+// expand replaces every placeholder outside of comments.  It returns how many it replaced and a problem, prefixed with
+// its line number, for each one it could not.
+func (p snippetPlaceholders) expand(contents []byte) ([]byte, int, []string) {
+	var (
+		expanded int
+		problems []string
+	)
+
+	lines := strings.SplitAfter(string(contents), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, ";") || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		line, count, lineProblems := p.expandLine(line)
+		for _, problem := range lineProblems {
+			problems = append(problems, fmt.Sprintf("line %d: %s", i+1, problem))
+		}
+		lines[i] = line
+		expanded += count
+	}
+
+	return []byte(strings.Join(lines, "")), expanded, problems
+}
+
+// expandEntry replaces the placeholders in the section and value of a directive parsed from a php.ini or php-fpm.conf
+// override.  The overrides are parsed before they are expanded, so that placeholders only fail the directives that
+// are migrated.
+func (p snippetPlaceholders) expandEntry(entry iniEntry) (iniEntry, []string) {
+	section, _, sectionProblems := p.expandLine(entry.Section)
+	raw, _, problems := p.expandLine(entry.Raw)
+
+	for i, problem := range sectionProblems {
+		sectionProblems[i] = fmt.Sprintf("section `[%s]`: %s", entry.Section, problem)
+	}
+	for i, problem := range problems {
+		problems[i] = fmt.Sprintf("line %d: %s", entry.Line, problem)
+	}
+
+	entry.Section = section
+	entry.Value, _, _ = p.expandLine(entry.Value)
+	entry.Raw = raw
+	return entry, append(sectionProblems, problems...)
+}
+
+// expandLine replaces the placeholders in a single line or value
+func (p snippetPlaceholders) expandLine(line string) (string, int, []string) {
+	var (
+		expanded int
+		problems []string
+	)
+
+	buf := bytes.Buffer{}
+	last := 0
+	for _, match := range snippetPlaceholderPattern.FindAllStringSubmatchIndex(line, -1) {
+		// `${NAME}` is already an environment variable
+		if match[0] > 0 && line[match[0]-1] == '$' {
+			continue
+		}
+
+		replacement, err := p.translate(line[match[2]:match[3]], line[match[4]:match[5]])
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		buf.WriteString(line[last:match[0]])
+		buf.WriteString(replacement)
+		last = match[1]
+		expanded++
+	}
+	buf.WriteString(line[last:])
+
+	return buf.String(), expanded, problems
+}
+
+// MigratePHPSnippets moves the snippets under `.bp-config/php/<oldSnippetFolder>` to newSnippetFolder, prefixing their
+// names with migratedSnippetPrefix.  v2 did not load the snippets in subdirectories, so they are left where they are.
+// A snippet that would replace a different file is a conflict, resolved with the snippet conflict policy, and a snippet
+// whose placeholders cannot be translated is not migrated.  Either fails the build unless its rule is a warning.
+func (m *migration) MigratePHPSnippets(options Options, name string, oldSnippetFolder string, newSnippetFolder string, extension string) error {
+	if !m.enabled(snippetRule(name)) {
+		return nil
+	}
+
+	oldIniPath := filepath.Join(m.appRoot, legacyPHPConfigDir, oldSnippetFolder)
+	exists, err := fileExists(m.fs, oldIniPath)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		found, err := findFiles(m.fs, oldIniPath, regexp.MustCompile(fmt.Sprintf(`^.*\.%s$`, extension)))
+		if err != nil {
+			return err
+		}
+
+		var iniFiles []string
+		for _, file := range found {
+			if filepath.Dir(file) != oldIniPath {
+				m.info("Leaving `%s` alone, v2 did not load snippets in subdirectories", m.relative(file))
+				continue
+			}
+			iniFiles = append(iniFiles, file)
+		}
+
+		if len(iniFiles) > 0 {
+			m.warning("Found %d %s snippets under `.bp-config/php/%s/`. This location has changed. Moving files to `%s/`", len(iniFiles), name, oldSnippetFolder, newSnippetFolder)
+		}
+
+		placeholders := newSnippetPlaceholders(m.config.ApplicationPath, options)
+
+		var problems, conflicts []string
+		for _, file := range iniFiles {
+			source := m.relative(file)
+
+			info, err := m.fs.Stat(file)
+			if err != nil {
+				return err
+			}
+
+			contents, err := m.fs.ReadFile(file)
+			if err != nil {
+				return err
+			}
+
+			contents, expanded, fileProblems := placeholders.expand(contents)
+			if len(fileProblems) > 0 {
+				switch m.config.Rules.Severity("snippet-placeholders") {
+				case SeverityError:
+					for _, problem := range fileProblems {
+						problems = append(problems, fmt.Sprintf("%s %s", source, problem))
+					}
+					m.add(Finding{Rule: "snippet-placeholders", Outcome: OutcomeFailed, File: source, Action: "build failed, " + strings.Join(fileProblems, "; ")})
+				case SeverityWarn:
+					for _, problem := range fileProblems {
+						m.warning("%s %s, it is not migrated", source, problem)
+					}
+					m.add(Finding{Rule: "snippet-placeholders", Outcome: OutcomeWarning, File: source, Action: "not migrated, " + strings.Join(fileProblems, "; ")})
+				default:
+					m.info("Leaving `%s` out, its placeholders cannot be translated and `snippet-placeholders` is turned off through %s", source, RulesEnv)
+				}
+				m.leaveOut(filepath.ToSlash(source), "not migrated, "+strings.Join(fileProblems, "; "))
+				continue
+			}
+
+			target := migratedSnippetPath(file, newSnippetFolder)
+
+			existing, targetExists, err := m.workspace.ReadFile(target)
+			if err != nil {
+				return err
+			}
+
+			if targetExists && bytes.Equal(existing, contents) {
+				m.add(Finding{Rule: snippetRule(name), Outcome: OutcomePassed, File: source, Action: fmt.Sprintf("already migrated to %s", target)})
+				continue
+			}
+
+			if targetExists {
+				switch m.config.SnippetConflicts {
+				case KeepExistingSnippets:
+					m.warning("`%s` already exists and differs from `%s`, keeping it", target, source)
+					m.add(Finding{Rule: snippetRule(name), Outcome: OutcomeWarning, File: source, Key: target, Action: fmt.Sprintf("not migrated, kept the existing %s", target)})
+					continue
+				case ReplaceExistingSnippets:
+					m.warning("`%s` already exists and differs from `%s`, replacing it", target, source)
+				default:
+					conflict := fmt.Sprintf("%s would replace %s, which has different contents", source, target)
+					if m.config.Rules.Severity(snippetRule(name)) == SeverityWarn {
+						m.warning("%s, keeping it", conflict)
+						m.add(Finding{Rule: snippetRule(name), Outcome: OutcomeWarning, File: source, Key: target, Action: fmt.Sprintf("not migrated, kept the existing %s", target)})
+						continue
+					}
+					conflicts = append(conflicts, conflict)
+					m.add(Finding{Rule: snippetRule(name), Outcome: OutcomeFailed, File: source, Key: target, Action: "build failed, conflicting file"})
+					continue
+				}
+			}
+
+			err = m.workspace.WriteFile(target, info.Mode(), contents)
+			if err != nil {
+				return err
+			}
+
+			action := fmt.Sprintf("copied to %s", target)
+			if expanded > 0 {
+				action = fmt.Sprintf("copied to %s, expanding %d placeholder(s)", target, expanded)
+			}
+			m.add(Finding{Rule: snippetRule(name), Outcome: OutcomeMigrated, File: source, Action: action})
+			m.report.Generated(target)
+		}
+
+		if len(problems) > 0 {
+			for _, problem := range problems {
+				m.error("%s", problem)
+			}
+			return fmt.Errorf("unable to translate placeholders in %s snippets:\n  %s", name, strings.Join(problems, "\n  "))
+		}
+
+		if len(conflicts) > 0 {
+			for _, conflict := range conflicts {
+				m.error("%s", conflict)
+			}
+			return fmt.Errorf("unable to migrate %s snippets, set %s to `%s` to keep the existing files or `%s` to replace them:\n  %s", name, SnippetConflictsEnv, KeepExistingSnippets, ReplaceExistingSnippets, strings.Join(conflicts, "\n  "))
+		}
+
+		if len(iniFiles) > 0 {
+			return nil
+		}
+	}
+
+	m.add(Finding{Rule: snippetRule(name), Outcome: OutcomePassed, Action: fmt.Sprintf("no snippets under .bp-config/php/%s", oldSnippetFolder)})
+	return nil
+}
+
+// migratedSnippetPath finds where a v2 snippet goes, relative to the application.  v2 loaded snippets in lexical
+// order, so the prefix keeps them in that order and loads them before the snippets written for v3, which override
+// them.
+func migratedSnippetPath(file string, newFolder string) string {
+	return filepath.Join(newFolder, migratedSnippetPrefix+filepath.Base(file))
+}
+
+// snippetRule names the rule for a kind of snippet, such as `php-ini-snippets` for "PHP INI"
+func snippetRule(name string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "-").Replace(name)) + "-snippets"
+}
@@ -0,0 +1,136 @@
+package compat
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libcfbuildpack/layers"
+)
+
+// procfile lists launch processes as `type: command` lines, for the Procfile buildpack
+const procfile = "Procfile"
+
+// MigrateAppStartCommand keeps an APP_START_CMD that names a PHP script under the application as `php.script`.  v3
+// only runs scripts that way, so any other command becomes a launch process that runs it unchanged: the web process of
+// an application without a web server, or a worker beside the web server.  Such a command fails the build when the
+// `app-start-cmd` rule is an error.
+func (m *migration) MigrateAppStartCommand(options *Options) error {
+	command := strings.TrimSpace(options.PHP.AppStartCommand)
+	if command == "" {
+		return nil
+	}
+
+	script, err := m.phpScript(command)
+	if err != nil {
+		return err
+	}
+
+	if script != "" {
+		options.PHP.AppStartCommand = script
+		m.add(Finding{Rule: "app-start-cmd", Outcome: OutcomeMigrated, File: optionsJSONPath, Key: "APP_START_CMD", Action: "written to `php.script` in buildpack.yml"})
+		return nil
+	}
+
+	processType := "worker"
+	webApp, err := m.isWebApp(*options)
+	if err != nil {
+		return err
+	}
+	if !webApp {
+		processType = "web"
+	}
+
+	problem := fmt.Sprintf("APP_START_CMD `%s` is not a PHP script under the application, v3 can only run it as the `%s` launch process", command, processType)
+	switch m.config.Rules.Severity("app-start-cmd") {
+	case SeverityError:
+		return m.violation(Finding{Rule: "app-start-cmd", File: optionsJSONPath, Key: "APP_START_CMD", Action: "not a PHP script under the application"}, errors.New(problem), problem)
+	case SeverityWarn:
+		m.warning("%s", problem)
+	default:
+		m.info("%s", problem)
+	}
+
+	options.PHP.AppStartCommand = ""
+
+	process := layers.Process{Type: processType, Command: command}
+	m.processes = append(m.processes, process)
+	m.add(Finding{Rule: "app-start-cmd", Outcome: OutcomeMigrated, File: optionsJSONPath, Key: "APP_START_CMD", Action: fmt.Sprintf("runs as the `%s` launch process", processType)})
+
+	if m.config.Procfile {
+		return m.addToProcfile(process)
+	}
+	return nil
+}
+
+// addToProcfile adds a launch process to the Procfile, as a `type: command` line.  A process type that the Procfile
+// already runs with another command fails, as there is no telling which one is meant.
+func (m *migration) addToProcfile(process layers.Process) error {
+	contents, _, err := m.workspace.ReadFile(procfile)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.HasPrefix(strings.TrimSpace(line), "#") || strings.TrimSpace(parts[0]) != process.Type {
+			continue
+		}
+
+		if command := strings.TrimSpace(parts[1]); command != process.Command {
+			err := fmt.Errorf("%s already runs `%s` as the `%s` process, replace it with `%s` or remove APP_START_CMD", procfile, command, process.Type, process.Command)
+			m.error("%s", err)
+			m.add(Finding{Rule: "app-start-cmd", Outcome: OutcomeFailed, File: procfile, Key: process.Type, Action: "build failed, the process already runs another command"})
+			return err
+		}
+		return nil
+	}
+
+	if len(contents) > 0 && !strings.HasSuffix(string(contents), "\n") {
+		contents = append(contents, '\n')
+	}
+	contents = append(contents, fmt.Sprintf("%s: %s\n", process.Type, process.Command)...)
+
+	if err := m.workspace.WriteFile(procfile, 0644, contents); err != nil {
+		return err
+	}
+
+	m.add(Finding{Rule: "app-start-cmd", Outcome: OutcomeMigrated, File: optionsJSONPath, Key: "APP_START_CMD", Action: fmt.Sprintf("`%s` process added to %s", process.Type, procfile)})
+	m.report.Generated(procfile)
+	return nil
+}
+
+// phpScript returns the path, relative to the application root, of the PHP script a command runs on its own, if it
+// is one
+func (m *migration) phpScript(command string) (string, error) {
+	if strings.ContainsAny(command, " \t") || path.Ext(command) != ".php" || path.IsAbs(command) {
+		return "", nil
+	}
+
+	script := path.Clean(command)
+	if script == ".." || strings.HasPrefix(script, "../") {
+		return "", nil
+	}
+
+	exists, err := fileExists(m.fs, filepath.Join(m.appRoot, filepath.FromSlash(script)))
+	if err != nil || !exists {
+		return "", err
+	}
+	return script, nil
+}
+
+// isWebApp reports whether a web server serves the application, which v3 decides by whether WEBDIR exists.  An empty
+// WEB_SERVER is what MigrateWebServer leaves for `none`.
+func (m *migration) isWebApp(options Options) (bool, error) {
+	if options.PHP.WebServer == "" {
+		return false, nil
+	}
+
+	webDir := "htdocs"
+	if options.PHP.WebDir != "" {
+		webDir = options.PHP.WebDir
+	}
+	return fileExists(m.fs, filepath.Join(m.appRoot, webDir))
+}
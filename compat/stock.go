@@ -0,0 +1,317 @@
+package compat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// stockServerConfigs are the httpd and nginx configuration files that the v2 PHP buildpack shipped in its
+// `defaults/config` folder, by their path under `.bp-config`.  Applications often committed copies of them.  When a
+// release changes a file, its new version is appended, the last version is the one shown in diffs.
+var stockServerConfigs = map[string][]string{
+	"httpd/httpd.conf": {
+		// before the request header `Proxy` was unset, against httpoxy
+		`ServerRoot "${HOME}/httpd"
+Listen ${PORT}
+ServerAdmin "${HTTPD_SERVER_ADMIN}"
+ServerName "0.0.0.0"
+DocumentRoot "${HOME}/#{WEBDIR}"
+Include conf/extra/httpd-modules.conf
+Include conf/extra/httpd-directories.conf
+Include conf/extra/httpd-mime.conf
+Include conf/extra/httpd-deflate.conf
+Include conf/extra/httpd-logging.conf
+Include conf/extra/httpd-mpm.conf
+Include conf/extra/httpd-default.conf
+Include conf/extra/httpd-remoteip.conf
+Include conf/extra/httpd-php.conf
+`,
+		`ServerRoot "${HOME}/httpd"
+Listen ${PORT}
+ServerAdmin "${HTTPD_SERVER_ADMIN}"
+ServerName "0.0.0.0"
+DocumentRoot "${HOME}/#{WEBDIR}"
+Include conf/extra/httpd-modules.conf
+Include conf/extra/httpd-directories.conf
+Include conf/extra/httpd-mime.conf
+Include conf/extra/httpd-deflate.conf
+Include conf/extra/httpd-logging.conf
+Include conf/extra/httpd-mpm.conf
+Include conf/extra/httpd-default.conf
+Include conf/extra/httpd-remoteip.conf
+Include conf/extra/httpd-php.conf
+
+<IfModule !mod_headers.c>
+  LoadModule headers_module modules/mod_headers.so
+</IfModule>
+
+RequestHeader unset Proxy early
+`,
+	},
+	"httpd/extra/httpd-default.conf": {`Timeout 60
+KeepAlive On
+MaxKeepAliveRequests 100
+KeepAliveTimeout 5
+UseCanonicalName Off
+UseCanonicalPhysicalPort Off
+AccessFileName .htaccess
+ServerTokens Prod
+ServerSignature Off
+HostnameLookups Off
+EnableMMAP Off
+EnableSendfile On
+RequestReadTimeout header=20-40,MinRate=500 body=20,MinRate=500
+`},
+	"httpd/extra/httpd-deflate.conf": {`<IfModule filter_module>
+    <IfModule deflate_module>
+        AddOutputFilterByType DEFLATE text/html text/plain text/xml text/css text/javascript application/javascript
+    </IfModule>
+</IfModule>
+`},
+	"httpd/extra/httpd-directories.conf": {`<Directory />
+    AllowOverride none
+    Require all denied
+</Directory>
+
+<Directory "${HOME}/#{WEBDIR}">
+    Options SymLinksIfOwnerMatch
+    AllowOverride All
+    Require all granted
+</Directory>
+
+<Files ".ht*">
+    Require all denied
+</Files>
+`},
+	"httpd/extra/httpd-logging.conf": {
+		// before the access log had the request id of the router
+		`ErrorLog "/proc/self/fd/2"
+LogLevel info
+<IfModule log_config_module>
+    LogFormat "%a %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-Agent}i\"" combined
+    LogFormat "%a %l %u %t \"%r\" %>s %b" common
+    <IfModule logio_module>
+      LogFormat "%a %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-Agent}i\" %I %O" combinedio
+    </IfModule>
+    CustomLog "/proc/self/fd/1" common
+</IfModule>
+`,
+		`ErrorLog "/proc/self/fd/2"
+LogLevel info
+<IfModule log_config_module>
+    LogFormat "%a %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-Agent}i\"" combined
+    LogFormat "%a %l %u %t \"%r\" %>s %b" common
+    LogFormat "%a %l %u %t \"%r\" %>s %b vcap_request_id=%{X-Vcap-Request-Id}i peer_addr=%{c}a" extended
+    <IfModule logio_module>
+      LogFormat "%a %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-Agent}i\" %I %O" combinedio
+    </IfModule>
+    CustomLog "/proc/self/fd/1" extended
+</IfModule>
+`,
+	},
+	"httpd/extra/httpd-mime.conf": {`<IfModule mime_module>
+    TypesConfig conf/mime.types
+    AddType application/x-compress .Z
+    AddType application/x-gzip .gz .tgz
+</IfModule>
+`},
+	"httpd/extra/httpd-modules.conf": {`LoadModule authz_core_module modules/mod_authz_core.so
+LoadModule authz_host_module modules/mod_authz_host.so
+LoadModule log_config_module modules/mod_log_config.so
+LoadModule env_module modules/mod_env.so
+LoadModule setenvif_module modules/mod_setenvif.so
+LoadModule dir_module modules/mod_dir.so
+LoadModule mime_module modules/mod_mime.so
+LoadModule reqtimeout_module modules/mod_reqtimeout.so
+LoadModule unixd_module modules/mod_unixd.so
+LoadModule mpm_event_module modules/mod_mpm_event.so
+LoadModule proxy_module modules/mod_proxy.so
+LoadModule proxy_fcgi_module modules/mod_proxy_fcgi.so
+LoadModule remoteip_module modules/mod_remoteip.so
+LoadModule rewrite_module modules/mod_rewrite.so
+`},
+	"httpd/extra/httpd-mpm.conf": {`<IfModule mpm_event_module>
+    StartServers             3
+    MinSpareThreads         75
+    MaxSpareThreads        250
+    ThreadsPerChild         25
+    MaxRequestWorkers      400
+    MaxConnectionsPerChild   0
+</IfModule>
+`},
+	"httpd/extra/httpd-php.conf": {
+		// before failed connections to PHP-FPM were retried straight away
+		`DirectoryIndex index.php index.html index.htm
+
+Define fcgi-listener fcgi://#{PHP_FPM_LISTEN}${HOME}/#{WEBDIR}
+
+<Proxy "${fcgi-listener}">
+    ProxySet disablereuse=On
+</Proxy>
+
+<Directory "${HOME}/#{WEBDIR}">
+  <Files *.php>
+      <If "-f %{REQUEST_FILENAME}">
+          SetHandler proxy:fcgi://#{PHP_FPM_LISTEN}
+      </If>
+  </Files>
+</Directory>
+`,
+		`DirectoryIndex index.php index.html index.htm
+
+Define fcgi-listener fcgi://#{PHP_FPM_LISTEN}${HOME}/#{WEBDIR}
+
+<Proxy "${fcgi-listener}">
+    ProxySet disablereuse=On retry=0
+</Proxy>
+
+<Directory "${HOME}/#{WEBDIR}">
+  <Files *.php>
+      <If "-f %{REQUEST_FILENAME}">
+          SetHandler proxy:fcgi://#{PHP_FPM_LISTEN}
+      </If>
+  </Files>
+</Directory>
+`,
+	},
+	"httpd/extra/httpd-remoteip.conf": {`RemoteIpHeader x-forwarded-for
+RemoteIpInternalProxy 10.0.0.0/8 172.16.0.0/12 192.168.0.0/16
+SetEnvIf x-forwarded-proto https HTTPS=on
+`},
+	"nginx/nginx.conf": {`daemon off;
+error_log stderr notice;
+pid @{HOME}/nginx/logs/nginx.pid;
+
+worker_processes auto;
+events {
+    worker_connections 1024;
+}
+
+http {
+    include mime.types;
+    include nginx-defaults.conf;
+    include nginx-logging.conf;
+    include nginx-gzip.conf;
+    include nginx-redirect.conf;
+    include http-*.conf;
+
+    server {
+        listen @{PORT};
+        server_name localhost;
+
+        fastcgi_temp_path @{TMPDIR}/nginx_fastcgi 1 2;
+        client_body_temp_path @{TMPDIR}/nginx_client_body 1 2;
+        proxy_temp_path @{TMPDIR}/nginx_proxy 1 2;
+
+        real_ip_header x-forwarded-for;
+        set_real_ip_from 10.0.0.0/8;
+        real_ip_recursive on;
+
+        include server-*.conf;
+    }
+}
+`},
+	"nginx/nginx-defaults.conf": {`default_type application/octet-stream;
+sendfile on;
+keepalive_timeout 65;
+port_in_redirect off;
+root @{HOME}/#{WEBDIR};
+index index.php index.html;
+server_tokens off;
+`},
+	"nginx/nginx-gzip.conf": {`gzip on;
+`},
+	"nginx/nginx-logging.conf": {
+		// before the access log had the request id of the router
+		`log_format common '$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent';
+access_log /dev/stdout common;
+`,
+		`log_format common '$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent';
+log_format extended '$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent vcap_request_id=$http_x_vcap_request_id';
+access_log /dev/stdout extended;
+`,
+	},
+	"nginx/nginx-redirect.conf": {`# set $https only when SSL is actually used.
+map $http_x_forwarded_proto $proxy_https {
+    https on;
+}
+
+# setup the scheme to use on redirects
+map $http_x_forwarded_proto $redirect_scheme {
+    default http;
+    http http;
+    https https;
+}
+`},
+	"nginx/http-php.conf": {`upstream php_fpm {
+    server unix:#{PHP_FPM_LISTEN};
+}
+`},
+	"nginx/server-defaults.conf": {`# Deny hidden files (.htaccess, .htpasswd, .DS_Store).
+location ~ /\. {
+    deny all;
+    access_log off;
+    log_not_found off;
+}
+`},
+	"nginx/server-locations.conf": {`# Some basic cache-control for static files to be sent to the browser
+location ~* \.(?:ico|css|js|gif|jpeg|jpg|png)$ {
+    expires max;
+    add_header Pragma public;
+    add_header Cache-Control "public, must-revalidate, proxy-revalidate";
+}
+
+location ~ .*\.php$ {
+    try_files $uri =404;
+    include fastcgi_params;
+    fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+    fastcgi_pass php_fpm;
+}
+`},
+}
+
+// stockServerConfigFingerprints are the fingerprints of every version of the stock server configuration files
+var stockServerConfigFingerprints = map[string]map[string]bool{}
+
+func init() {
+	for file, versions := range stockServerConfigs {
+		stockServerConfigFingerprints[file] = map[string]bool{}
+		for _, version := range versions {
+			stockServerConfigFingerprints[file][serverConfigFingerprint(version)] = true
+		}
+	}
+}
+
+// normalizeServerConfig drops comments, blank lines and the whitespace that httpd and nginx ignore
+func normalizeServerConfig(contents string) string {
+	var lines []string
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func serverConfigFingerprint(contents string) string {
+	sum := sha256.Sum256([]byte(normalizeServerConfig(contents)))
+	return hex.EncodeToString(sum[:])
+}
+
+// isStockServerConfig reports whether a file, by its path under `.bp-config`, is an unchanged copy of a stock v2 file
+func isStockServerConfig(file string, contents []byte) bool {
+	return stockServerConfigFingerprints[file][serverConfigFingerprint(string(contents))]
+}
+
+// stockServerConfigDiff shows how a file, by its path under `.bp-config`, differs from the latest stock v2 version of
+// it, ignoring comments and whitespace.  It is empty for files that were not shipped with v2.
+func stockServerConfigDiff(file string, source string, contents []byte) string {
+	versions := stockServerConfigs[file]
+	if len(versions) == 0 {
+		return ""
+	}
+	return unifiedDiff(source, normalizeServerConfig(versions[len(versions)-1]), normalizeServerConfig(string(contents)), false)
+}
@@ -0,0 +1,118 @@
+package compat
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/cloudfoundry/libcfbuildpack/buildpack"
+)
+
+// VersionPlaceholdersMetadata is the buildpack.toml metadata table that maps v2 version placeholders to versions
+const VersionPlaceholdersMetadata = "version-placeholders"
+
+var placeholderPattern = regexp.MustCompile(`^\{([A-Z0-9_]+)\}$`)
+
+// VersionPlaceholders maps a dependency, such as `php` or `nginx`, to the v2 version placeholders it accepts and the
+// version constraint each one resolves to.  An empty constraint selects the default version of the dependency.
+type VersionPlaceholders map[string]map[string]string
+
+// NewVersionPlaceholders reads the version placeholder table out of the buildpack metadata
+func NewVersionPlaceholders(metadata buildpack.Metadata) (VersionPlaceholders, error) {
+	placeholders := VersionPlaceholders{}
+
+	raw, ok := metadata[VersionPlaceholdersMetadata]
+	if !ok {
+		return placeholders, nil
+	}
+
+	dependencies, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("buildpack metadata %s must be a table", VersionPlaceholdersMetadata)
+	}
+
+	for dependency, rawTokens := range dependencies {
+		tokens, ok := rawTokens.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("buildpack metadata %s.%s must be a table", VersionPlaceholdersMetadata, dependency)
+		}
+
+		placeholders[dependency] = map[string]string{}
+		for token, rawConstraint := range tokens {
+			constraint, ok := rawConstraint.(string)
+			if !ok {
+				return nil, fmt.Errorf("buildpack metadata %s.%s.%s must be a string", VersionPlaceholdersMetadata, dependency, token)
+			}
+
+			if constraint != "" {
+				if _, err := semver.NewConstraint(constraint); err != nil {
+					return nil, fmt.Errorf("buildpack metadata %s.%s.%s is not a valid version constraint: %s", VersionPlaceholdersMetadata, dependency, token, err)
+				}
+			}
+
+			placeholders[dependency][token] = constraint
+		}
+	}
+
+	return placeholders, nil
+}
+
+// Resolve replaces a version placeholder, such as `{PHP_73_LATEST}`, with its version constraint.  Versions that are
+// not placeholders are returned unchanged.
+func (v VersionPlaceholders) Resolve(dependency string, option string, version string) (string, error) {
+	match := placeholderPattern.FindStringSubmatch(version)
+	if match == nil {
+		if strings.ContainsAny(version, "{}") {
+			return "", fmt.Errorf("%s has a malformed version placeholder %q", option, version)
+		}
+		return version, nil
+	}
+
+	constraint, ok := v[dependency][match[1]]
+	if !ok {
+		var known []string
+		for token := range v[dependency] {
+			known = append(known, fmt.Sprintf("{%s}", token))
+		}
+		sort.Strings(known)
+
+		if len(known) == 0 {
+			return "", fmt.Errorf("%s has an unknown version placeholder %q, no placeholders are supported for %s", option, version, dependency)
+		}
+		return "", fmt.Errorf("%s has an unknown version placeholder %q, expected one of %s", option, version, strings.Join(known, ", "))
+	}
+
+	return constraint, nil
+}
+
+// ResolveVersionPlaceholders replaces the version placeholders in each of the version options
+func ResolveVersionPlaceholders(options *Options, placeholders VersionPlaceholders) error {
+	versions := []struct {
+		dependency string
+		option     string
+		version    *string
+	}{
+		{"php", "PHP_VERSION", &options.PHP.Version},
+		{"httpd", "HTTPD_VERSION", &options.HTTPD.Version},
+		{"nginx", "NGINX_VERSION", &options.Nginx.Version},
+		{"composer", "COMPOSER_VERSION", &options.Composer.Version},
+	}
+
+	var problems []string
+	for _, v := range versions {
+		resolved, err := placeholders.Resolve(v.dependency, v.option, *v.version)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		*v.version = resolved
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unable to resolve versions in `.bp-config/options.json`:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
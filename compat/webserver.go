@@ -0,0 +1,66 @@
+package compat
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// WebServerHTTPD serves the application with httpd-cnb, the v2 default
+	WebServerHTTPD = "httpd"
+	// WebServerNginx serves the application with nginx-cnb
+	WebServerNginx = "nginx"
+	// WebServerPHP serves the application with PHP's built in web server
+	WebServerPHP = "php-server"
+	// WebServerNone runs the application as a script, without a web server
+	WebServerNone = "none"
+)
+
+// webServers maps the WEB_SERVER values v2 and v3 accept, ignoring case, to the canonical ones
+var webServers = map[string]string{
+	"httpd":      WebServerHTTPD,
+	"apache":     WebServerHTTPD,
+	"nginx":      WebServerNginx,
+	"php-server": WebServerPHP,
+	"none":       WebServerNone,
+}
+
+// CanonicalWebServer maps a WEB_SERVER value, or one of its v2 aliases such as `apache`, to WebServerHTTPD,
+// WebServerNginx, WebServerPHP or WebServerNone.  An empty value is the v2 default, WebServerHTTPD.
+func CanonicalWebServer(value string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(value))
+	if normalized == "" {
+		return WebServerHTTPD, nil
+	}
+
+	if webServer, ok := webServers[normalized]; ok {
+		return webServer, nil
+	}
+
+	return "", fmt.Errorf("WEB_SERVER must be one of `%s` (or `apache`), `%s`, `%s` or `%s`, found `%s`", WebServerHTTPD, WebServerNginx, WebServerPHP, WebServerNone, value)
+}
+
+// MigrateWebServer replaces WEB_SERVER with its canonical value.  Script applications do not name a web server in
+// buildpack.yml, as v3 has no `none`.
+func (m *migration) MigrateWebServer(options *Options) error {
+	webServer, err := CanonicalWebServer(options.PHP.WebServer)
+	if err != nil {
+		m.add(Finding{Rule: "web-server", Outcome: OutcomeFailed, File: optionsJSONPath, Key: "WEB_SERVER", Action: "build failed, unknown web server"})
+		return err
+	}
+
+	switch {
+	case webServer == WebServerNone:
+		m.info("WEB_SERVER is `%s`, the application runs as a script without a web server", options.PHP.WebServer)
+		m.add(Finding{Rule: "web-server", Outcome: OutcomeMigrated, File: optionsJSONPath, Key: "WEB_SERVER", Action: "no web server, the application runs as a script"})
+		webServer = ""
+	case webServer != options.PHP.WebServer:
+		m.info("WEB_SERVER `%s` is migrated as `%s`", options.PHP.WebServer, webServer)
+		m.add(Finding{Rule: "web-server", Outcome: OutcomeMigrated, File: optionsJSONPath, Key: "WEB_SERVER", Action: fmt.Sprintf("written as `%s`", webServer)})
+	default:
+		m.add(Finding{Rule: "web-server", Outcome: OutcomePassed, File: optionsJSONPath, Key: "WEB_SERVER", Action: fmt.Sprintf("`%s` is used as it is", webServer)})
+	}
+
+	options.PHP.WebServer = webServer
+	return nil
+}
@@ -0,0 +1,158 @@
+package compat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DryRunEnv selects the DryRunPolicy.  In a dry run every migration step runs, but the files it would create or change
+// are shown as unified diffs instead of being written to the application.
+const DryRunEnv = "BP_PHP_COMPAT_DRY_RUN"
+
+// DryRunPolicy decides whether the migration writes to the application and, if not, whether the build passes
+type DryRunPolicy string
+
+const (
+	// DryRunOff migrates the application in place
+	DryRunOff DryRunPolicy = "false"
+	// DryRunPass previews the migration and passes the build unless the migration itself fails
+	DryRunPass DryRunPolicy = "true"
+	// DryRunFail previews the migration and fails the build if it would change any files
+	DryRunFail DryRunPolicy = "fail"
+)
+
+// ParseDryRunPolicy validates a dry run policy, defaulting to DryRunOff
+func ParseDryRunPolicy(value string) (DryRunPolicy, error) {
+	switch policy := DryRunPolicy(strings.ToLower(value)); policy {
+	case "":
+		return DryRunOff, nil
+	case DryRunOff, DryRunPass, DryRunFail:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%s must be one of `%s`, `%s` or `%s`, found `%s`", DryRunEnv, DryRunOff, DryRunPass, DryRunFail, value)
+	}
+}
+
+// DryRunError fails a DryRunFail dry run that would have created or changed files
+type DryRunError struct {
+	Changes int
+}
+
+func (e DryRunError) Error() string {
+	return fmt.Sprintf("dry run: the migration would create or change %d file(s), set %s to `%s` to allow it", e.Changes, DryRunEnv, DryRunPass)
+}
+
+// FileChange is a file, relative to the application root, that the migration creates or changes
+type FileChange struct {
+	Path    string
+	Mode    os.FileMode
+	Before  string
+	After   string
+	Created bool
+}
+
+// Diff shows the change in unified diff format
+func (f FileChange) Diff() string {
+	return unifiedDiff(filepath.ToSlash(f.Path), f.Before, f.After, f.Created)
+}
+
+// workspace is the application being migrated.  Files written while it is buffered are held in memory, so that later
+// steps read what earlier steps would have written, and the application itself is left untouched until the changes
+// are applied.
+type workspace struct {
+	fs       FileSystem
+	appRoot  string
+	buffered bool
+	changes  []FileChange
+}
+
+func newWorkspace(fs FileSystem, appRoot string, buffered bool) *workspace {
+	return &workspace{fs: fs, appRoot: appRoot, buffered: buffered}
+}
+
+// Changes lists every file written so far, in the order they were first written
+func (w *workspace) Changes() []FileChange {
+	return w.changes
+}
+
+// apply writes the changes held back while the workspace was buffered
+func (w *workspace) apply() error {
+	if !w.buffered {
+		return nil
+	}
+
+	for _, change := range w.changes {
+		if err := w.fs.WriteFile(filepath.Join(w.appRoot, change.Path), change.Mode, []byte(change.After)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFile reads a file relative to the application root, including any change made to it during a dry run
+func (w *workspace) ReadFile(path string) ([]byte, bool, error) {
+	for _, change := range w.changes {
+		if change.Path == path {
+			return []byte(change.After), true, nil
+		}
+	}
+
+	contents, err := w.fs.ReadFile(filepath.Join(w.appRoot, path))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	return contents, true, nil
+}
+
+// WriteFile writes a file relative to the application root and records the change.  Writing the contents a file
+// already has is not a change.
+func (w *workspace) WriteFile(path string, mode os.FileMode, contents []byte) error {
+	before, exists, err := w.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if exists && string(before) == string(contents) {
+		return nil
+	}
+
+	w.record(FileChange{Path: path, Mode: mode, Before: string(before), After: string(contents), Created: !exists})
+
+	if w.buffered {
+		return nil
+	}
+
+	return w.fs.WriteFile(filepath.Join(w.appRoot, path), mode, contents)
+}
+
+// CopyFile copies a file, given by its absolute path, to a path relative to the application root, keeping its
+// permissions
+func (w *workspace) CopyFile(source string, destination string) error {
+	info, err := w.fs.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	contents, err := w.fs.ReadFile(source)
+	if err != nil {
+		return err
+	}
+
+	return w.WriteFile(destination, info.Mode(), contents)
+}
+
+func (w *workspace) record(change FileChange) {
+	for i, existing := range w.changes {
+		if existing.Path == change.Path {
+			w.changes[i].Mode = change.Mode
+			w.changes[i].After = change.After
+			return
+		}
+	}
+	w.changes = append(w.changes, change)
+}
@@ -0,0 +1,186 @@
+package compat
+
+import (
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var yamlEntryPattern = regexp.MustCompile(`^( *)("[^"]*"|'[^']*'|[^\s#'"\-][^:#]*?) *:(?: +(.*))?$`)
+
+// yamlDocument edits a block style YAML document line by line, so that everything it is not asked to change,
+// including comments, ordering and sections meant for other buildpacks, is written back exactly as it was read
+type yamlDocument struct {
+	lines []string
+}
+
+func newYAMLDocument(contents []byte) *yamlDocument {
+	text := strings.TrimRight(string(contents), "\n")
+	if text == "" {
+		return &yamlDocument{}
+	}
+	return &yamlDocument{lines: strings.Split(text, "\n")}
+}
+
+func (d *yamlDocument) Bytes() []byte {
+	return []byte(strings.Join(d.lines, "\n") + "\n")
+}
+
+// set writes section.key in place.  It returns false when the section is not a block mapping and so cannot be edited
+// line by line.
+func (d *yamlDocument) set(section string, key string, value interface{}) (bool, error) {
+	rendered, err := renderYAMLEntry(key, value)
+	if err != nil {
+		return false, err
+	}
+
+	sectionIndex := d.find(0, len(d.lines), 0, section)
+	if sectionIndex < 0 {
+		d.lines = append(d.lines, section+":")
+		d.lines = append(d.lines, indentLines(rendered, 2)...)
+		return true, nil
+	}
+
+	if _, _, inline, _ := parseYAMLEntry(d.lines[sectionIndex]); !isYAMLComment(inline) {
+		return false, nil
+	}
+
+	sectionEnd := d.blockEnd(sectionIndex)
+	childIndent := 2
+	for i := sectionIndex + 1; i < sectionEnd; i++ {
+		if !isIgnorableYAML(d.lines[i]) {
+			if strings.HasPrefix(strings.TrimSpace(d.lines[i]), "-") {
+				return false, nil
+			}
+			childIndent = indentOf(d.lines[i])
+			break
+		}
+	}
+
+	lines := indentLines(rendered, childIndent)
+
+	keyIndex := d.find(sectionIndex+1, sectionEnd, childIndent, key)
+	if keyIndex < 0 {
+		d.splice(sectionEnd, sectionEnd, lines)
+		return true, nil
+	}
+
+	_, _, inline, _ := parseYAMLEntry(d.lines[keyIndex])
+	if comment := trailingYAMLComment(inline); comment != "" && len(lines) == 1 {
+		lines[0] += " " + comment
+	}
+	d.splice(keyIndex, d.blockEnd(keyIndex), lines)
+
+	return true, nil
+}
+
+// replaceSection rewrites a whole top level section, keeping the comments that precede it
+func (d *yamlDocument) replaceSection(section string, value interface{}) error {
+	rendered, err := renderYAMLEntry(section, value)
+	if err != nil {
+		return err
+	}
+
+	sectionIndex := d.find(0, len(d.lines), 0, section)
+	if sectionIndex < 0 {
+		d.lines = append(d.lines, rendered...)
+		return nil
+	}
+
+	d.splice(sectionIndex, d.blockEnd(sectionIndex), rendered)
+	return nil
+}
+
+func (d *yamlDocument) find(start int, end int, indent int, key string) int {
+	for i := start; i < end; i++ {
+		lineIndent, lineKey, _, ok := parseYAMLEntry(d.lines[i])
+		if ok && lineIndent == indent && lineKey == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// blockEnd returns the index just past the last line that belongs to the entry at index.  Trailing blank lines and
+// comments are left to whatever follows.
+func (d *yamlDocument) blockEnd(index int) int {
+	indent := indentOf(d.lines[index])
+
+	end := index + 1
+	for i := index + 1; i < len(d.lines); i++ {
+		line := d.lines[i]
+		if isIgnorableYAML(line) {
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		lineIndent := indentOf(line)
+		if lineIndent > indent || (lineIndent == indent && (trimmed == "-" || strings.HasPrefix(trimmed, "- "))) {
+			end = i + 1
+			continue
+		}
+		break
+	}
+
+	return end
+}
+
+func (d *yamlDocument) splice(start int, end int, lines []string) {
+	result := append([]string{}, d.lines[:start]...)
+	result = append(result, lines...)
+	d.lines = append(result, d.lines[end:]...)
+}
+
+func parseYAMLEntry(line string) (int, string, string, bool) {
+	match := yamlEntryPattern.FindStringSubmatch(line)
+	if match == nil {
+		return 0, "", "", false
+	}
+
+	key := match[2]
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') {
+		key = key[1 : len(key)-1]
+	}
+
+	return len(match[1]), key, strings.TrimSpace(match[3]), true
+}
+
+func renderYAMLEntry(key string, value interface{}) ([]string, error) {
+	contents, err := yaml.Marshal(yaml.MapSlice{{Key: key, Value: value}})
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(contents), "\n"), "\n"), nil
+}
+
+func trailingYAMLComment(value string) string {
+	if strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'") {
+		return ""
+	}
+
+	if index := strings.Index(value, " #"); index >= 0 {
+		return strings.TrimSpace(value[index:])
+	}
+	return ""
+}
+
+func indentLines(lines []string, indent int) []string {
+	var result []string
+	for _, line := range lines {
+		result = append(result, strings.Repeat(" ", indent)+line)
+	}
+	return result
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func isIgnorableYAML(line string) bool {
+	return isYAMLComment(strings.TrimSpace(line))
+}
+
+func isYAMLComment(value string) bool {
+	return value == "" || strings.HasPrefix(value, "#")
+}
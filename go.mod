@@ -3,12 +3,14 @@ module github.com/cloudfoundry/php-compat-cnb
 go 1.12
 
 require (
+	github.com/Masterminds/semver v1.5.0
 	github.com/buildpack/libbuildpack v1.25.11
 	github.com/cloudfoundry/dagger v0.0.0-20200409132447-59248c69607b
 	github.com/cloudfoundry/libcfbuildpack v1.91.23
 	github.com/google/go-cmp v0.4.0
 	github.com/onsi/gomega v1.10.0
 	github.com/paketo-buildpacks/php-composer v0.0.83
+	github.com/paketo-buildpacks/php-web v0.0.103
 	github.com/sclevine/spec v1.4.0
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -51,18 +51,23 @@ func testIntegration(t *testing.T, when spec.G, it spec.S) {
 	when("deploying the simple_app fixture", func() {
 		it("serves a simple php page with custom httpd config", func() {
 			app, err = PushSimpleApp("simple_app_httpd", []string{httpdURI, phpDistURI, phpCompatURI, phpWebURI}, false)
-			Expect(err).To(HaveOccurred())
+			Expect(err).ToNot(HaveOccurred())
 
-			// because it fails, the error contains the build logs, not app.BuildLogs()
-			Expect(err.Error()).To(ContainSubstring("Found 1 HTTPD configuration files under `.bp-config/httpd`. Customizing HTTPD configuration in this manner is no longer supported. Please migrate your configuration, see the Migration guide for more details."))
+			Expect(app.BuildLogs()).To(ContainSubstring("Moving the directives httpd still needs to `.httpd.conf.d/00-compat-httpd.conf`"))
+
+			body, headers, err := app.HTTPGet("/")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(ContainSubstring("Hello World!"))
+			Expect(headers["X-Compat-Migrated"]).To(Equal([]string{"true"}))
 		})
 
 		it("serves a simple php page with custom nginx config", func() {
 			app, err = PushSimpleApp("simple_app_nginx", []string{httpdURI, phpDistURI, phpCompatURI, phpWebURI}, false)
-			Expect(err).To(HaveOccurred())
+			Expect(err).ToNot(HaveOccurred())
 
-			// because it fails, the error contains the build logs, not app.BuildLogs()
-			Expect(err.Error()).To(ContainSubstring("Found 1 Nginx configuration files under `.bp-config/nginx`. Customizing Nginx configuration in this manner is no longer supported. Please migrate your configuration, see the Migration guide for more details."))
+			body, _, err := app.HTTPGet("/")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(ContainSubstring("Hello World!"))
 		})
 
 		it("serves a simple php page with a .extensions directory", func() {